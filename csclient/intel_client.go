@@ -10,7 +10,9 @@ package csclient
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/aztecqt/center_server/server/intel"
@@ -21,32 +23,220 @@ import (
 
 type IntelClient struct {
 	url string
+
+	// 身份验证，需与服务端intel配置中的collectors一致
+	collector string
+	apiKey    string
+	secret    string
+
+	// 批量模式。开启后SendIntel只是把情报放入缓冲区，由后台定时或者缓冲区满时通过/intel/batch发送
+	// 发送失败（网络错误、服务器错误、队列满）的情报放回缓冲区重发，缓冲区超过上限时丢弃最旧的情报
+	// 批量模式关闭后，发送失败的情报改为逐条发送
+	batchSize int
+	batch     []intel.Intel
+	stopBatch chan struct{} // 关闭后停止定时发送
+	muBatch   sync.Mutex
 }
 
+const intelBatchMaxBuffer = 10000 // 批量缓冲区的上限
+
 func NewIntelClient(url string) *IntelClient {
 	s := new(IntelClient)
 	s.url = url
 	return s
 }
 
+// 使用api key验证
+func (s *IntelClient) SetApiKey(collector, apiKey string) {
+	s.collector = collector
+	s.apiKey = apiKey
+	s.secret = ""
+}
+
+// 使用签名验证
+func (s *IntelClient) SetSecret(collector, secret string) {
+	s.collector = collector
+	s.secret = secret
+	s.apiKey = ""
+}
+
+func (s *IntelClient) headers(body []byte) map[string]string {
+	if len(s.collector) == 0 {
+		return nil
+	}
+
+	h := map[string]string{intel.AuthHeader_Collector: s.collector}
+	if len(s.apiKey) > 0 {
+		h[intel.AuthHeader_ApiKey] = s.apiKey
+	} else if len(s.secret) > 0 {
+		ts := time.Now().UnixMilli()
+		h[intel.AuthHeader_Timestamp] = fmt.Sprintf("%d", ts)
+		h[intel.AuthHeader_Signature] = intel.SignIntelRequest(s.secret, ts, body)
+	}
+	return h
+}
+
 func (s *IntelClient) SendIntelMenu(menu intel.IntelMenu) {
 	b, _ := json.Marshal(menu)
 	url := fmt.Sprintf("%s/intel/menu", s.url)
 	logger.LogInfo("intel_client", "sending intel menu: %s", string(b))
-	network.HttpCall(url, "POST", string(b), nil, func(r *http.Response, err error) {
+	network.HttpCall(url, "POST", string(b), s.headers(b), func(r *http.Response, err error) {
 		if err != nil {
 			logger.LogImportant("intel_client", err.Error())
+		} else if r.StatusCode != http.StatusOK {
+			logger.LogImportant("intel_client", "intel menu rejected, status=%d", r.StatusCode)
 		}
 	})
 }
 
+// 开启批量模式。缓冲区达到maxSize条或者每隔interval发送一次
+// 重复调用时使用新的参数，不会启动多个定时发送
+func (s *IntelClient) EnableBatch(maxSize int, interval time.Duration) {
+	s.muBatch.Lock()
+	defer s.muBatch.Unlock()
+
+	if s.stopBatch != nil {
+		close(s.stopBatch)
+	}
+	s.batchSize = maxSize
+	s.stopBatch = make(chan struct{})
+
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				s.Flush()
+			}
+		}
+	}(s.stopBatch)
+}
+
+// 关闭批量模式，停止定时发送，并发送缓冲区中剩余的情报
+func (s *IntelClient) DisableBatch() {
+	s.muBatch.Lock()
+	if s.stopBatch != nil {
+		close(s.stopBatch)
+		s.stopBatch = nil
+	}
+	s.batchSize = 0
+	s.muBatch.Unlock()
+
+	s.Flush()
+}
+
+// 立即发送批量缓冲区中的情报
+func (s *IntelClient) Flush() {
+	s.muBatch.Lock()
+	intels := s.batch
+	s.batch = nil
+	s.muBatch.Unlock()
+
+	if len(intels) > 0 {
+		s.sendBatch(intels)
+	}
+}
+
+func (s *IntelClient) sendBatch(intels []intel.Intel) {
+	b, _ := json.Marshal(intels)
+	url := fmt.Sprintf("%s/intel/batch", s.url)
+	logger.LogInfo("intel_client", "sending %d intels in batch", len(intels))
+	network.HttpCall(url, "POST", string(b), s.headers(b), func(r *http.Response, err error) {
+		if err != nil {
+			// 网络错误，整批重发
+			logger.LogImportant("intel_client", "intel batch failed, %d intels will be resent, err=%s", len(intels), err.Error())
+			s.requeue(intels)
+			return
+		}
+
+		resp := intel.BatchResp{}
+		if body, err := io.ReadAll(r.Body); err != nil {
+			logger.LogImportant("intel_client", "intel batch failed, %d intels will be resent, err=%s", len(intels), err.Error())
+			s.requeue(intels)
+		} else if err := json.Unmarshal(body, &resp); err != nil {
+			// 服务器错误可以重发，其他错误（验证失败、请求过大等）重发也不会成功
+			if r.StatusCode >= http.StatusInternalServerError {
+				logger.LogImportant("intel_client", "intel batch failed, %d intels will be resent, status=%d", len(intels), r.StatusCode)
+				s.requeue(intels)
+			} else {
+				logger.LogImportant("intel_client", "intel batch failed, %d intels dropped, status=%d, resp=%s", len(intels), r.StatusCode, string(body))
+			}
+		} else if resp.Rejected > 0 {
+			// 服务器队列满而被拒绝的情报放回缓冲区，下次再发
+			retry := make([]intel.Intel, 0)
+			for _, rst := range resp.Results {
+				if rst.Ok {
+					continue
+				}
+
+				if rst.Error == intel.BatchError_QueueFull && rst.Index < len(intels) {
+					retry = append(retry, intels[rst.Index])
+				} else {
+					logger.LogImportant("intel_client", "intel rejected in batch, index=%d, err=%s", rst.Index, rst.Error)
+				}
+			}
+
+			if len(retry) > 0 {
+				logger.LogImportant("intel_client", "server busy, %d intels will be resent", len(retry))
+				s.requeue(retry)
+			}
+		}
+	})
+}
+
+// 把发送失败的情报放回缓冲区头部。超过上限时丢弃最旧的情报
+// 批量模式已关闭时不会再有定时发送，放回缓冲区就再也发不出去了，改为逐条发送
+func (s *IntelClient) requeue(intels []intel.Intel) {
+	s.muBatch.Lock()
+	disabled := s.batchSize == 0
+	if !disabled {
+		s.batch = append(append(make([]intel.Intel, 0, len(intels)+len(s.batch)), intels...), s.batch...)
+		if dropped := len(s.batch) - intelBatchMaxBuffer; dropped > 0 {
+			logger.LogImportant("intel_client", "batch buffer full, %d oldest intels dropped", dropped)
+			s.batch = s.batch[dropped:]
+		}
+	}
+	s.muBatch.Unlock()
+
+	if disabled {
+		logger.LogImportant("intel_client", "batch disabled, %d intels will be sent one by one", len(intels))
+		for _, i := range intels {
+			s.sendSingle(i)
+		}
+	}
+}
+
 func (s *IntelClient) SendIntel(intel intel.Intel) {
+	s.muBatch.Lock()
+	if s.batchSize > 0 {
+		s.batch = append(s.batch, intel)
+		full := len(s.batch) >= s.batchSize
+		s.muBatch.Unlock()
+		if full {
+			s.Flush()
+		}
+		return
+	}
+	s.muBatch.Unlock()
+
+	s.sendSingle(intel)
+}
+
+// 通过/intel/new发送一条情报
+func (s *IntelClient) sendSingle(intel intel.Intel) {
 	b, _ := json.Marshal(intel)
 	url := fmt.Sprintf("%s/intel/new", s.url)
 	logger.LogInfo("intel_client", "sending intel: %s", string(b))
-	network.HttpCall(url, "POST", string(b), nil, func(r *http.Response, err error) {
+	network.HttpCall(url, "POST", string(b), s.headers(b), func(r *http.Response, err error) {
 		if err != nil {
 			logger.LogImportant("intel_client", err.Error())
+		} else if r.StatusCode == http.StatusServiceUnavailable {
+			logger.LogImportant("intel_client", "server busy, intel dropped: %s", string(b))
+		} else if r.StatusCode != http.StatusOK {
+			logger.LogImportant("intel_client", "intel rejected, status=%d", r.StatusCode)
 		}
 	})
 }
@@ -8,12 +8,13 @@
 package csclient
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net"
-	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -30,41 +31,104 @@ type StratergyClient struct {
 	us             udpsocket.Socket
 	latestRespTime time.Time
 	logPrefix      string
+	serverName     string // 服务器登记的策略名，重名时可能被服务器改名
+	muName         sync.Mutex
 	terminal       terminal.Terminal
-	running        bool
+
+	// 生命周期控制
+	handleSignal bool               // 是否由客户端自己监听SIGTERM/SIGINT
+	cancel       context.CancelFunc // 停止run
+	done         chan struct{}      // run退出后关闭
+	muRun        sync.Mutex
+}
+
+// 由客户端自己监听SIGTERM/SIGINT，收到信号后自动Stop。需要在Start之前调用
+// 策略程序有自己的退出逻辑时不要开启，自行调用Stop即可
+func (sc *StratergyClient) EnableSignalHandling() {
+	sc.muRun.Lock()
+	defer sc.muRun.Unlock()
+	sc.handleSignal = true
 }
 
-func (sc *StratergyClient) Start(serverAddr string, serverPort int, guid string, s stratergy.Stratergy, tm terminal.Terminal, onQuit func()) {
+// 启动客户端。ctx结束或者调用Stop后，客户端会汇报退出，然后调用onQuit
+// onQuit调用时客户端已经完全退出，可以在其中调用Stop或者重新Start
+func (sc *StratergyClient) Start(ctx context.Context, serverAddr string, serverPort int, guid string, s stratergy.Stratergy, tm terminal.Terminal, onQuit func()) {
+	sc.muRun.Lock()
+	defer sc.muRun.Unlock()
+
+	if sc.done != nil {
+		logger.LogImportant(sc.logPrefix, "client already started")
+		return
+	}
+
 	sc.guid = guid
 	sc.s = s
 	sc.terminal = tm
 	sc.logPrefix = "csclient"
 
-	go sc.run(serverAddr, serverPort, onQuit)
+	if sc.handleSignal {
+		var stopSignal context.CancelFunc
+		ctx, stopSignal = signal.NotifyContext(ctx, syscall.SIGTERM, syscall.SIGINT)
+		onQuitRaw := onQuit
+		onQuit = func() {
+			stopSignal()
+			if onQuitRaw != nil {
+				onQuitRaw()
+			}
+		}
+	}
+
+	ctx, sc.cancel = context.WithCancel(ctx)
+	sc.done = make(chan struct{})
+	go sc.run(ctx, serverAddr, serverPort, onQuit)
+}
+
+// 停止客户端，等待退出汇报发送完毕、onQuit返回后才返回。可重复调用
+// 在onQuit中调用时直接返回
+func (sc *StratergyClient) Stop() {
+	sc.muRun.Lock()
+	cancel := sc.cancel
+	done := sc.done
+	sc.muRun.Unlock()
+
+	if cancel == nil {
+		return
+	}
+
+	cancel()
+	<-done
 }
 
-func (sc *StratergyClient) run(serverAddr string, serverPort int, onQuit func()) {
-	sc.running = true
+func (sc *StratergyClient) run(ctx context.Context, serverAddr string, serverPort int, onQuit func()) {
+	// 退出时关闭socket，清理运行状态后调用onQuit，最后关闭done让Stop返回
+	defer func() {
+		sc.us.Close()
+
+		sc.muRun.Lock()
+		done, cancel := sc.done, sc.cancel
+		sc.done = nil
+		sc.cancel = nil
+		sc.muRun.Unlock()
+		cancel()
+		defer close(done)
 
-	// 监控程序正常退出
-	go func() {
-		osc := make(chan os.Signal, 1)
-		signal.Notify(osc, syscall.SIGTERM, syscall.SIGINT)
-		<-osc
-		sc.reportQuit()
 		if onQuit != nil {
 			onQuit()
 		}
-		logger.LogImportant(sc.logPrefix, "program is quiting")
-		sc.running = false
 	}()
 
 	// socket连接
-	for {
+	connected := false
+	for !connected {
 		if sc.us.Connect(serverAddr, serverPort, sc.onRecv) {
-			break
+			connected = true
 		} else {
-			time.Sleep(time.Millisecond * 100)
+			select {
+			case <-ctx.Done():
+				logger.LogImportant(sc.logPrefix, "stopped before connected to center server")
+				return
+			case <-time.After(time.Millisecond * 100):
+			}
 		}
 	}
 
@@ -72,10 +136,55 @@ func (sc *StratergyClient) run(serverAddr string, serverPort int, onQuit func())
 
 	// 保持心跳
 	ticker := time.NewTicker(time.Second * 3)
-	for sc.running {
-		<-ticker.C
-		req := stratergys.NewPingReq(sc.guid, sc.s.Name(), sc.s.Class())
-		sc.us.Send(req)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// 退出前一定先把退出汇报发出去
+			logger.LogImportant(sc.logPrefix, "program is quiting")
+			sc.reportQuit()
+			return
+		case <-ticker.C:
+			req := stratergys.NewPingReq(sc.guid, sc.s.Name(), sc.s.Class(), sc.quantEvents())
+			sc.us.Send(req)
+		}
+	}
+}
+
+// 策略可选实现此接口，声明自己处理哪些量化事件。服务器只会向策略投递声明过的事件
+type QuantEventAdvertiser interface {
+	QuantEvents() []string
+}
+
+func (sc *StratergyClient) quantEvents() []string {
+	if qea, ok := sc.s.(QuantEventAdvertiser); ok {
+		return qea.QuantEvents()
+	}
+	return nil
+}
+
+// 服务器登记的策略名。重名被服务器改名时，与策略自己的名字不同
+func (sc *StratergyClient) Name() string {
+	sc.muName.Lock()
+	defer sc.muName.Unlock()
+	if len(sc.serverName) > 0 {
+		return sc.serverName
+	}
+	return sc.s.Name()
+}
+
+func (sc *StratergyClient) setServerName(name string) {
+	if len(name) == 0 {
+		return
+	}
+
+	sc.muName.Lock()
+	defer sc.muName.Unlock()
+	if name != sc.serverName {
+		if name != sc.s.Name() {
+			logger.LogImportant(sc.logPrefix, "name conflict, renamed by center server: %s -> %s", sc.s.Name(), name)
+		}
+		sc.serverName = name
 	}
 }
 
@@ -92,8 +201,11 @@ func (sc *StratergyClient) onRecv(op string, data []byte, addr *net.UDPAddr) {
 		// 心跳返回
 		resp := stratergys.PingResp{}
 		if err := json.Unmarshal(data, &resp); err == nil {
-			if resp.Result == "ok" {
+			if resp.Result == stratergys.PingResult_OK {
 				sc.latestRespTime = time.Now()
+				sc.setServerName(resp.Name)
+			} else {
+				logger.LogImportant(sc.logPrefix, "ping rejected by center server, result=%s", resp.Result)
 			}
 		} else {
 			logger.LogImportant(sc.logPrefix, "unmarshal PingResp failed, str=%s", string(data))
@@ -112,7 +224,7 @@ func (sc *StratergyClient) onRecv(op string, data []byte, addr *net.UDPAddr) {
 
 					// 多条指令时，只有最后一条指令的结果，才反馈给CenterServer
 					if i == len(cmds)-1 {
-						resp := stratergys.NewCommandResp(sc.s.Name(), result, req.Webhook)
+						resp := stratergys.NewCommandResp(sc.Name(), result, req.Webhook)
 						sc.us.Send(resp)
 					}
 				})
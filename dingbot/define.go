@@ -34,11 +34,15 @@ const logPrefix = "dingbot"
 
 // 客户端发送来的消息
 type DingUserMsg struct {
-	SenderNick       string `json:"senderNick"`
-	SenderUserId     string `json:"senderStaffId"`
-	ConversationType string `json:"conversationType"`
-	Webhook          string `json:"sessionWebhook"`
-	Text             struct {
+	SenderNick        string `json:"senderNick"`
+	SenderUserId      string `json:"senderStaffId"`
+	ConversationType  string `json:"conversationType"`
+	ConversationId    string `json:"conversationId"`
+	ConversationTitle string `json:"conversationTitle"`         // 群聊时为群名称
+	IsAdmin           bool   `json:"isAdmin"`                   // 群聊时，发送者是否为群管理员
+	Webhook           string `json:"sessionWebhook"`            // 会话webhook，有有效期
+	WebhookExpireTs   int64  `json:"sessionWebhookExpiredTime"` // 会话webhook的过期时间（毫秒时间戳）
+	Text              struct {
 		Content string `json:"content"`
 	} `json:"text"`
 }
@@ -108,3 +112,66 @@ func toWebhookTextMsg(webhookUrl string, content string) {
 		logger.LogImportant(logPrefix, err.Error())
 	})
 }
+
+// 向webhook（群机器人webhook或者会话webhook）发送文字消息
+func SendTextToWebhook(webhookUrl, content string) {
+	msg := map[string]interface{}{
+		"msgtype": "text",
+		"text":    map[string]string{"content": content},
+	}
+	sendToWebhook(webhookUrl, msg)
+}
+
+// 向webhook发送链接消息
+func SendLinkToWebhook(webhookUrl, title, text, msgUrl, picUrl string) {
+	msg := map[string]interface{}{
+		"msgtype": "link",
+		"link": map[string]string{
+			"title":      title,
+			"text":       text,
+			"messageUrl": msgUrl,
+			"picUrl":     picUrl,
+		},
+	}
+	sendToWebhook(webhookUrl, msg)
+}
+
+func sendToWebhook(webhookUrl string, msg interface{}) {
+	b, _ := json.Marshal(msg)
+	network.HttpCall(webhookUrl, "POST", string(b), network.JsonHeaders(), func(r *http.Response, err error) {
+		if err != nil {
+			logger.LogImportant(logPrefix, "send to webhook failed, err=%s", err.Error())
+		}
+	})
+}
+
+// 向webhook发送markdown消息
+func SendMarkdownToWebhook(webhookUrl, title, text string) {
+	msg := map[string]interface{}{
+		"msgtype":  "markdown",
+		"markdown": map[string]string{"title": title, "text": text},
+	}
+	sendToWebhook(webhookUrl, msg)
+}
+
+// 向webhook发送卡片消息。只有一个按钮时使用整体跳转样式
+func SendActionCardToWebhook(webhookUrl, title, text string, btns []ActionCardButton) {
+	card := map[string]interface{}{"title": title, "text": text}
+	if len(btns) == 1 {
+		card["singleTitle"] = btns[0].Title
+		card["singleURL"] = btns[0].Url
+	} else {
+		list := make([]map[string]string, 0, len(btns))
+		for _, btn := range btns {
+			list = append(list, map[string]string{"title": btn.Title, "actionURL": btn.Url})
+		}
+		card["btnOrientation"] = "0"
+		card["btns"] = list
+	}
+
+	msg := map[string]interface{}{
+		"msgtype":    "actionCard",
+		"actionCard": card,
+	}
+	sendToWebhook(webhookUrl, msg)
+}
@@ -0,0 +1,158 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-17 10:26:41
+ * @Description: 钉钉工作通知中dingtalk.Notifier不支持的消息类型（markdown、卡片）
+ * 使用与Notifier相同的应用配置（agent_id/key/secret）
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package dingbot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aztecqt/dagger/util/dingtalk"
+	"github.com/aztecqt/dagger/util/logger"
+)
+
+const (
+	dingApiGetToken   = "https://oapi.dingtalk.com/gettoken"
+	dingApiWorkNotice = "https://oapi.dingtalk.com/topapi/message/corpconversation/asyncsend_v2"
+)
+
+const workNoticeMaxUsers = 100 // 每次调用最多发送的用户数
+
+// 卡片消息的按钮
+type ActionCardButton struct {
+	Title string `json:"title"`
+	Url   string `json:"url"`
+}
+
+type WorkNotifier struct {
+	cfg    dingtalk.NotifierConfig
+	client *http.Client
+
+	token         string
+	tokenExpireAt time.Time
+	muToken       sync.Mutex
+}
+
+func NewWorkNotifier(cfg dingtalk.NotifierConfig) *WorkNotifier {
+	n := new(WorkNotifier)
+	n.cfg = cfg
+	n.client = &http.Client{Timeout: time.Second * 10}
+	return n
+}
+
+// 获取access token，提前5分钟刷新
+func (n *WorkNotifier) accessToken() (string, error) {
+	n.muToken.Lock()
+	defer n.muToken.Unlock()
+
+	if len(n.token) > 0 && time.Now().Before(n.tokenExpireAt) {
+		return n.token, nil
+	}
+
+	params := url.Values{}
+	params.Set("appkey", n.cfg.Key)
+	params.Set("appsecret", n.cfg.Secret)
+	resp, err := n.client.Get(fmt.Sprintf("%s?%s", dingApiGetToken, params.Encode()))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	rst := struct {
+		ErrCode     int    `json:"errcode"`
+		ErrMsg      string `json:"errmsg"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&rst); err != nil {
+		return "", err
+	}
+
+	if rst.ErrCode != 0 {
+		return "", fmt.Errorf("get token failed, errcode=%d, errmsg=%s", rst.ErrCode, rst.ErrMsg)
+	}
+
+	n.token = rst.AccessToken
+	n.tokenExpireAt = time.Now().Add(time.Duration(rst.ExpiresIn)*time.Second - time.Minute*5)
+	return n.token, nil
+}
+
+// 发送工作通知，在调用者的goroutine中执行。用户较多时分批发送
+func (n *WorkNotifier) send(msg interface{}, uids []string) {
+	for len(uids) > 0 {
+		batch := uids[:min(len(uids), workNoticeMaxUsers)]
+		uids = uids[len(batch):]
+		n.sendBatch(msg, batch)
+	}
+}
+
+func (n *WorkNotifier) sendBatch(msg interface{}, uids []string) {
+	token, err := n.accessToken()
+	if err != nil {
+		logger.LogImportant(logPrefix, "send work notice failed, err=%s", err.Error())
+		return
+	}
+
+	body := map[string]interface{}{
+		"agent_id":    n.cfg.AgentId,
+		"userid_list": strings.Join(uids, ","),
+		"msg":         msg,
+	}
+	b, _ := json.Marshal(body)
+	resp, err := n.client.Post(fmt.Sprintf("%s?access_token=%s", dingApiWorkNotice, token), "application/json", bytes.NewReader(b))
+	if err != nil {
+		logger.LogImportant(logPrefix, "send work notice failed, err=%s", err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	rb, _ := io.ReadAll(resp.Body)
+	rst := struct {
+		ErrCode int    `json:"errcode"`
+		ErrMsg  string `json:"errmsg"`
+	}{}
+	if err := json.Unmarshal(rb, &rst); err != nil || rst.ErrCode != 0 {
+		logger.LogImportant(logPrefix, "send work notice failed, resp=%s", string(rb))
+	}
+}
+
+// 发送markdown消息
+func (n *WorkNotifier) SendMarkdownByUid(title, text string, uids ...string) {
+	n.send(map[string]interface{}{
+		"msgtype":  "markdown",
+		"markdown": map[string]string{"title": title, "text": text},
+	}, uids)
+}
+
+// 发送卡片消息。只有一个按钮时使用整体跳转样式
+func (n *WorkNotifier) SendActionCardByUid(title, text string, btns []ActionCardButton, uids ...string) {
+	card := map[string]interface{}{"title": title, "markdown": text}
+	if len(btns) == 1 {
+		card["single_title"] = btns[0].Title
+		card["single_url"] = btns[0].Url
+	} else {
+		list := make([]map[string]string, 0, len(btns))
+		for _, btn := range btns {
+			list = append(list, map[string]string{"title": btn.Title, "action_url": btn.Url})
+		}
+		card["btn_orientation"] = "0"
+		card["btn_json_list"] = list
+	}
+
+	n.send(map[string]interface{}{
+		"msgtype":     "action_card",
+		"action_card": card,
+	}, uids)
+}
@@ -0,0 +1,98 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-26 16:40:05
+ * @Description: 工作通知的测试，通过替换http.Client的Transport拦截请求
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package dingbot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aztecqt/dagger/util/dingtalk"
+)
+
+type roundTripFunc func(r *http.Request) *http.Response
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r), nil
+}
+
+func jsonResponse(body string) *http.Response {
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}
+}
+
+// 记录发出的工作通知
+func newTestWorkNotifier(t *testing.T) (*WorkNotifier, *int, *[]map[string]interface{}) {
+	tokenCalls := 0
+	bodies := make([]map[string]interface{}, 0)
+	n := NewWorkNotifier(dingtalk.NotifierConfig{Key: "key", Secret: "secret"})
+	n.client = &http.Client{Transport: roundTripFunc(func(r *http.Request) *http.Response {
+		switch {
+		case strings.HasPrefix(r.URL.String(), dingApiGetToken):
+			tokenCalls++
+			return jsonResponse(`{"errcode":0,"access_token":"tk","expires_in":7200}`)
+		case strings.HasPrefix(r.URL.String(), dingApiWorkNotice):
+			if r.URL.Query().Get("access_token") != "tk" {
+				t.Errorf("unexpected access token: %s", r.URL.RawQuery)
+			}
+			body := map[string]interface{}{}
+			json.NewDecoder(r.Body).Decode(&body)
+			bodies = append(bodies, body)
+			return jsonResponse(`{"errcode":0}`)
+		default:
+			t.Errorf("unexpected request: %s", r.URL.String())
+			return jsonResponse(`{}`)
+		}
+	})}
+	return n, &tokenCalls, &bodies
+}
+
+func TestWorkNoticeBatch(t *testing.T) {
+	n, tokenCalls, bodies := newTestWorkNotifier(t)
+	uids := make([]string, 0)
+	for i := 0; i < workNoticeMaxUsers*2+1; i++ {
+		uids = append(uids, fmt.Sprintf("u%d", i))
+	}
+
+	n.SendMarkdownByUid("title", "**text**", uids...)
+	if len(*bodies) != 3 || *tokenCalls != 1 {
+		t.Fatalf("expected 3 batches with 1 token request, got %d batches and %d token requests", len(*bodies), *tokenCalls)
+	}
+
+	for i, expected := range []int{workNoticeMaxUsers, workNoticeMaxUsers, 1} {
+		if users := strings.Split((*bodies)[i]["userid_list"].(string), ","); len(users) != expected {
+			t.Errorf("batch %d: expected %d users, got %d", i, expected, len(users))
+		}
+	}
+
+	msg := (*bodies)[0]["msg"].(map[string]interface{})
+	if msg["msgtype"] != "markdown" || msg["markdown"].(map[string]interface{})["text"] != "**text**" {
+		t.Fatalf("unexpected markdown msg: %v", msg)
+	}
+}
+
+func TestWorkNoticeActionCard(t *testing.T) {
+	n, _, bodies := newTestWorkNotifier(t)
+	n.SendActionCardByUid("title", "text", []ActionCardButton{{Title: "a", Url: "https://a"}}, "u1")
+	n.SendActionCardByUid("title", "text", []ActionCardButton{{Title: "a", Url: "https://a"}, {Title: "b", Url: "https://b"}}, "u1")
+	if len(*bodies) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(*bodies))
+	}
+
+	single := (*bodies)[0]["msg"].(map[string]interface{})["action_card"].(map[string]interface{})
+	if single["single_url"] != "https://a" || single["btn_json_list"] != nil {
+		t.Fatalf("single button card should use single_url: %v", single)
+	}
+
+	multi := (*bodies)[1]["msg"].(map[string]interface{})["action_card"].(map[string]interface{})
+	if btns, ok := multi["btn_json_list"].([]interface{}); !ok || len(btns) != 2 {
+		t.Fatalf("multi button card should use btn_json_list: %v", multi)
+	}
+}
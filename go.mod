@@ -9,6 +9,7 @@ replace github.com/aztecqt/dagger v1.0.1 => ../dagger
 require (
 	github.com/aztecqt/dagger v1.0.1
 	github.com/emirpasic/gods v1.18.0
+	github.com/go-redis/redis v6.15.9+incompatible
 )
 
 require (
@@ -17,7 +18,6 @@ require (
 	github.com/chromedp/chromedp v0.8.6 // indirect
 	github.com/chromedp/sysutil v1.0.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/go-redis/redis v6.15.9+incompatible // indirect
 	github.com/gobwas/httphead v0.1.0 // indirect
 	github.com/gobwas/pool v0.2.1 // indirect
 	github.com/gobwas/ws v1.1.0 // indirect
@@ -0,0 +1,188 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-16 11:03:52
+ * @Description: 管理员对订阅数据的管理：按频道查看订阅者、套用订阅模板、复制订阅、整体导出/导入
+ * 订阅模板在配置中定义，每个模板是一组"频道"或者"频道:子频道"
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ImportMode_Merge   = "merge"   // 导入的用户覆盖同uid的现有用户，其他用户保留
+	ImportMode_Replace = "replace" // 导入的数据替换全部现有数据
+)
+
+// 某频道的一个订阅者
+type ChannelSubscriber struct {
+	Uid     string   `json:"uid"`
+	Nick    string   `json:"nick"`
+	IsGroup bool     `json:"is_group"`
+	Mode    string   `json:"mode"`
+	WlTypes []string `json:"white_list,omitempty"`
+	BlTypes []string `json:"black_list,omitempty"`
+}
+
+func (c ChannelSubscriber) String() string {
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("%s(%s)", c.Nick, c.Uid))
+	if len(c.WlTypes) > 0 {
+		sb.WriteString(fmt.Sprintf(" +%s", strings.Join(c.WlTypes, ",")))
+	}
+	if len(c.BlTypes) > 0 {
+		sb.WriteString(fmt.Sprintf(" -%s", strings.Join(c.BlTypes, ",")))
+	}
+	if c.Mode != DeliveryMode_Immediate {
+		sb.WriteString(fmt.Sprintf(" [%s]", c.Mode))
+	}
+	return sb.String()
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// 按频道列出订阅者，频道->订阅者列表。mainType为空时列出所有频道
+func (df *dingFilter) subscribersByChannel(mainType string) map[string][]ChannelSubscriber {
+	df.mu.RLock()
+	defer df.mu.RUnlock()
+
+	mainType = strings.ToLower(mainType)
+	rst := make(map[string][]ChannelSubscriber)
+	for uid, f := range df.UserTypeFilters {
+		for t, stf := range f.SubTypeFilters {
+			if len(mainType) > 0 && t != mainType {
+				continue
+			}
+
+			rst[t] = append(rst[t], ChannelSubscriber{
+				Uid:     uid,
+				Nick:    f.Nick,
+				IsGroup: f.IsGroup,
+				Mode:    stf.deliveryMode(),
+				WlTypes: sortedKeys(stf.WlSubtypes),
+				BlTypes: sortedKeys(stf.BlSubtypes),
+			})
+		}
+	}
+
+	for _, subs := range rst {
+		sort.Slice(subs, func(i, j int) bool { return subs[i].Uid < subs[j].Uid })
+	}
+	return rst
+}
+
+// 给用户套用订阅模板。模板中的条目为"频道"或者"频道:子频道"，在用户现有订阅的基础上增加
+func (df *dingFilter) applyTemplate(uid string, entries []string) {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+
+	for _, e := range entries {
+		mainType, subType, _ := strings.Cut(e, ":")
+		mainType = strings.ToLower(mainType)
+		subType = strings.ToLower(subType)
+		subFilter := df.findOrCreateUserSubtypeFilter(uid, mainType)
+		if len(subType) > 0 {
+			subFilter.WlSubtypes[subType] = 0
+		}
+	}
+	df.save()
+}
+
+// 把一个用户的订阅设置复制给另一个用户（覆盖目标用户的订阅设置，保留其昵称和群设置）
+func (df *dingFilter) copyUserFilter(fromUid, toUid string) error {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+
+	from := df.userFilter(fromUid)
+	if from == nil {
+		return fmt.Errorf("用户[%s]没有订阅", fromUid)
+	}
+
+	// 通过json做深拷贝
+	b, _ := json.Marshal(from)
+	copied := newDingUserTypeFilter()
+	if err := json.Unmarshal(b, copied); err != nil {
+		return err
+	}
+
+	to := df.findOrCreateUserFilter(toUid)
+	to.SubTypeFilters = copied.SubTypeFilters
+	to.QuietHours = copied.QuietHours
+	to.Mutes = copied.Mutes
+	to.HoldMuted = copied.HoldMuted
+	df.save()
+	return nil
+}
+
+// 导出全部订阅数据
+func (df *dingFilter) exportJson() []byte {
+	df.mu.RLock()
+	defer df.mu.RUnlock()
+	b, _ := json.Marshal(df)
+	return b
+}
+
+// 导入订阅数据，格式与导出的相同。返回导入的用户数量
+func (df *dingFilter) importJson(b []byte, mode string) (int, error) {
+	imported := dingFilter{}
+	if err := json.Unmarshal(b, &imported); err != nil {
+		return 0, err
+	}
+
+	for uid, f := range imported.UserTypeFilters {
+		if f == nil {
+			return 0, fmt.Errorf("empty filter for %s", uid)
+		}
+		if f.SubTypeFilters == nil {
+			f.SubTypeFilters = make(map[string]*dingUserSubtypeFilter)
+		}
+		if f.Mutes == nil {
+			f.Mutes = make(map[string]time.Time)
+		}
+		for t, stf := range f.SubTypeFilters {
+			if stf == nil {
+				return 0, fmt.Errorf("empty filter for %s/%s", uid, t)
+			}
+			if stf.WlSubtypes == nil {
+				stf.WlSubtypes = make(map[string]int)
+			}
+			if stf.BlSubtypes == nil {
+				stf.BlSubtypes = make(map[string]int)
+			}
+		}
+	}
+
+	df.mu.Lock()
+	defer df.mu.Unlock()
+
+	switch mode {
+	case ImportMode_Replace:
+		df.UserTypeFilters = imported.UserTypeFilters
+		if df.UserTypeFilters == nil {
+			df.UserTypeFilters = make(map[string]*dingUserTypeFilter)
+		}
+	case "", ImportMode_Merge:
+		for uid, f := range imported.UserTypeFilters {
+			df.UserTypeFilters[uid] = f
+		}
+	default:
+		return 0, fmt.Errorf("unknown import mode: %s", mode)
+	}
+
+	df.save()
+	return len(imported.UserTypeFilters), nil
+}
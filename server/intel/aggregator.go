@@ -0,0 +1,127 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-09-27 11:14:52
+ * @Description: 情报去重与突发聚合，只影响钉钉推送，不影响redis存储
+ * 去重：同类型/子类型/标题/内容的情报，在窗口期内只推送一次
+ * 聚合：同类型/子类型的情报在窗口期内超过阈值后，剩余的合并为一条汇总消息，在窗口结束时推送
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// 一次突发
+type intelBurst struct {
+	start      time.Time
+	count      int   // 窗口期内的情报总数
+	suppressed int   // 被聚合（未单独推送）的数量
+	latest     Intel // 最近一条被聚合的情报
+}
+
+type intelAggregator struct {
+	dedupWindow    time.Duration
+	burstWindow    time.Duration
+	burstThreshold int
+
+	recent map[string]time.Time   // 去重key->最近一次推送时间
+	bursts map[string]*intelBurst // type/subtype->突发状态
+	mu     sync.Mutex
+}
+
+// 窗口或阈值为0表示关闭对应功能
+func newIntelAggregator(dedupWindowSec, burstWindowSec, burstThreshold int) *intelAggregator {
+	a := new(intelAggregator)
+	a.dedupWindow = time.Duration(dedupWindowSec) * time.Second
+	a.burstWindow = time.Duration(burstWindowSec) * time.Second
+	a.burstThreshold = burstThreshold
+	a.recent = make(map[string]time.Time)
+	a.bursts = make(map[string]*intelBurst)
+	return a
+}
+
+func dedupKey(intel *Intel) string {
+	return fmt.Sprintf("%s\n%s\n%s\n%s", intel.Type, intel.SubType, intel.Title, intel.Content)
+}
+
+func burstKey(intel *Intel) string {
+	return fmt.Sprintf("%s\n%s", intel.Type, intel.SubType)
+}
+
+// 判断一条情报是否应该立即推送
+func (a *intelAggregator) filter(intel *Intel) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+
+	// 去重
+	if a.dedupWindow > 0 {
+		key := dedupKey(intel)
+		if t, ok := a.recent[key]; ok && now.Sub(t) < a.dedupWindow {
+			return false
+		}
+		a.recent[key] = now
+	}
+
+	// 突发聚合
+	if a.burstWindow > 0 && a.burstThreshold > 0 {
+		key := burstKey(intel)
+		b, ok := a.bursts[key]
+		if !ok {
+			b = &intelBurst{start: now}
+			a.bursts[key] = b
+		}
+
+		b.count++
+		if b.count > a.burstThreshold {
+			b.suppressed++
+			b.latest = *intel
+			return false
+		}
+	}
+
+	return true
+}
+
+// 清理过期数据，返回窗口已结束的突发汇总消息
+func (a *intelAggregator) update() []Intel {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+
+	for k, t := range a.recent {
+		if now.Sub(t) >= a.dedupWindow {
+			delete(a.recent, k)
+		}
+	}
+
+	summaries := make([]Intel, 0)
+	for k, b := range a.bursts {
+		if now.Sub(b.start) >= a.burstWindow {
+			if b.suppressed > 0 {
+				summaries = append(summaries, a.summary(b))
+			}
+			delete(a.bursts, k)
+		}
+	}
+
+	return summaries
+}
+
+func (a *intelAggregator) summary(b *intelBurst) Intel {
+	latest := b.latest
+	s := Intel{}
+	s.Seq = latest.Seq
+	s.Time = time.Now()
+	s.Level = latest.Level
+	s.Type = latest.Type
+	s.SubType = latest.SubType
+	s.DingType = DingType_Text
+	s.Title = fmt.Sprintf("[%s/%s] %d similar events in %ds", latest.Type, latest.SubType, b.suppressed, int(a.burstWindow.Seconds()))
+	s.Content = fmt.Sprintf("最近一条(seq=%d):\n%s\n%s", latest.Seq, latest.Title, latest.Content)
+	return s
+}
@@ -0,0 +1,75 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-26 15:20:37
+ * @Description: 情报去重与突发聚合的测试
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAggregatorDedup(t *testing.T) {
+	a := newIntelAggregator(60, 0, 0)
+	intel := Intel{Seq: 1, Type: "news", SubType: "cn", Title: "t", Content: "c"}
+	if !a.filter(&intel) {
+		t.Fatal("first intel should pass")
+	}
+
+	intel.Seq = 2
+	if a.filter(&intel) {
+		t.Fatal("duplicated intel should be dropped")
+	}
+
+	other := Intel{Seq: 3, Type: "news", SubType: "cn", Title: "t", Content: "c2"}
+	if !a.filter(&other) {
+		t.Fatal("intel with different content should pass")
+	}
+
+	// 窗口结束后可以再次推送
+	a.recent[dedupKey(&intel)] = time.Now().Add(-a.dedupWindow)
+	a.update()
+	if !a.filter(&intel) {
+		t.Fatal("intel should pass after dedup window")
+	}
+}
+
+func TestAggregatorBurst(t *testing.T) {
+	a := newIntelAggregator(0, 60, 2)
+	passed := 0
+	for i := 1; i <= 5; i++ {
+		if a.filter(&Intel{Seq: i, Level: 1, Type: "price", SubType: "BTC", Title: "move"}) {
+			passed++
+		}
+	}
+
+	if passed != 2 {
+		t.Fatalf("only %d intels should pass before aggregating, got %d", a.burstThreshold, passed)
+	}
+
+	if !a.filter(&Intel{Seq: 6, Type: "price", SubType: "ETH"}) {
+		t.Fatal("burst should be counted per type/subtype")
+	}
+
+	// 窗口未结束时不汇总
+	if summaries := a.update(); len(summaries) != 0 {
+		t.Fatalf("unexpected summaries: %+v", summaries)
+	}
+
+	for _, b := range a.bursts {
+		b.start = time.Now().Add(-a.burstWindow)
+	}
+
+	summaries := a.update()
+	if len(summaries) != 1 || summaries[0].Seq != 5 || !strings.Contains(summaries[0].Title, "3 similar events") {
+		t.Fatalf("unexpected summaries: %+v", summaries)
+	}
+
+	if len(a.bursts) != 0 || !a.filter(&Intel{Seq: 7, Type: "price", SubType: "BTC"}) {
+		t.Fatal("new burst should start after window")
+	}
+}
@@ -0,0 +1,205 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-11 14:22:10
+ * @Description: collector上报接口的身份验证
+ * 每个collector配置一个名称，以及api key或者签名密钥（二选一，也可以都配置）
+ * api key方式：请求头带上collector名称和api key
+ * 签名方式：请求头带上collector名称、毫秒时间戳、以及对"时间戳\n请求体"的HMAC-SHA256签名（base64），时间戳超出窗口的请求会被拒绝
+ * 同一个签名在时间窗口内只能使用一次，防止重放
+ * 读接口（查询、实时推送、语音播报、统计）使用同样的验证方式，签名内容为"时间戳\n请求URI（路径+查询参数）"，也可以使用管理令牌
+ * 没有配置任何collector时不做验证，兼容旧的collector
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aztecqt/dagger/util"
+	"github.com/aztecqt/dagger/util/logger"
+)
+
+const (
+	AuthHeader_Collector = "X-Intel-Collector"
+	AuthHeader_ApiKey    = "X-Intel-Key"
+	AuthHeader_Timestamp = "X-Intel-Timestamp"
+	AuthHeader_Signature = "X-Intel-Signature"
+)
+
+const authDefaultTimeWindowSec = 300
+
+// 一个collector的验证信息
+type CollectorAuth struct {
+	Name   string `json:"name"`
+	ApiKey string `json:"api_key"` // 为空表示不接受api key方式
+	Secret string `json:"secret"`  // 为空表示不接受签名方式
+}
+
+// 计算签名。collector和服务端使用同样的算法
+func SignIntelRequest(secret string, ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("%d\n", ts)))
+	mac.Write(body)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// 计算读接口的签名，requestURI为路径+查询参数，如/intel/list?since_seq=100
+func SignIntelReadRequest(secret string, ts int64, requestURI string) string {
+	return SignIntelRequest(secret, ts, []byte(requestURI))
+}
+
+type intelAuth struct {
+	collectors map[string]CollectorAuth
+	timeWindow time.Duration
+
+	// 时间窗口内用过的签名->过期时间，用于拒绝重放
+	usedSigs  map[string]time.Time
+	lastPrune time.Time
+
+	// 被拒绝的请求统计，key为"来源 原因"
+	rejects       map[string]int64
+	rejectsReport map[string]int64 // 上次汇报以来的新增部分
+	mu            sync.Mutex
+}
+
+func (a *intelAuth) init(collectors []CollectorAuth, timeWindowSec int) {
+	a.collectors = make(map[string]CollectorAuth)
+	a.usedSigs = make(map[string]time.Time)
+	a.rejects = make(map[string]int64)
+	a.rejectsReport = make(map[string]int64)
+	a.timeWindow = time.Second * time.Duration(util.ValueIf(timeWindowSec > 0, timeWindowSec, authDefaultTimeWindowSec))
+	for _, c := range collectors {
+		a.collectors[c.Name] = c
+	}
+
+	if len(a.collectors) == 0 {
+		logger.LogImportant(logPrefix, "no collector auth configured, intel ingestion is NOT authenticated")
+	} else {
+		logger.LogImportant(logPrefix, "%d collectors configured for auth", len(a.collectors))
+	}
+}
+
+func (a *intelAuth) enabled() bool {
+	return len(a.collectors) > 0
+}
+
+// 验证请求，返回collector名称。body为已读取的请求体
+func (a *intelAuth) verify(r *http.Request, body []byte) (string, bool) {
+	if !a.enabled() {
+		return "", true
+	}
+
+	name := r.Header.Get(AuthHeader_Collector)
+	c, ok := a.collectors[name]
+	if !ok {
+		a.reject(r, name, "unknown collector")
+		return name, false
+	}
+
+	// api key
+	if key := r.Header.Get(AuthHeader_ApiKey); len(key) > 0 {
+		if len(c.ApiKey) > 0 && hmac.Equal([]byte(key), []byte(c.ApiKey)) {
+			return name, true
+		}
+		a.reject(r, name, "wrong api key")
+		return name, false
+	}
+
+	// 签名
+	sig := r.Header.Get(AuthHeader_Signature)
+	if len(sig) == 0 || len(c.Secret) == 0 {
+		a.reject(r, name, "missing credential")
+		return name, false
+	}
+
+	ts, ok := util.String2Int64(r.Header.Get(AuthHeader_Timestamp))
+	if !ok {
+		a.reject(r, name, "invalid timestamp")
+		return name, false
+	}
+
+	if d := time.Since(time.UnixMilli(ts)); d > a.timeWindow || d < -a.timeWindow {
+		a.reject(r, name, "timestamp out of window")
+		return name, false
+	}
+
+	if !hmac.Equal([]byte(sig), []byte(SignIntelRequest(c.Secret, ts, body))) {
+		a.reject(r, name, "wrong signature")
+		return name, false
+	}
+
+	if !a.useSignature(sig, time.UnixMilli(ts).Add(a.timeWindow)) {
+		a.reject(r, name, "replayed signature")
+		return name, false
+	}
+
+	return name, true
+}
+
+// 验证读接口的请求，签名内容为请求URI
+func (a *intelAuth) verifyRead(r *http.Request) (string, bool) {
+	return a.verify(r, []byte(r.URL.RequestURI()))
+}
+
+// 记录一个签名，已经用过的返回false。签名在expire之后时间戳已超出窗口，不再需要记录
+func (a *intelAuth) useSignature(sig string, expire time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(a.lastPrune) > a.timeWindow {
+		for k, t := range a.usedSigs {
+			if now.After(t) {
+				delete(a.usedSigs, k)
+			}
+		}
+		a.lastPrune = now
+	}
+
+	if _, ok := a.usedSigs[sig]; ok {
+		return false
+	}
+
+	a.usedSigs[sig] = expire
+	return true
+}
+
+func (a *intelAuth) reject(r *http.Request, name, reason string) {
+	source := util.ValueIf(len(name) > 0, name, r.RemoteAddr)
+	key := fmt.Sprintf("%s %s", source, reason)
+
+	a.mu.Lock()
+	a.rejects[key]++
+	a.rejectsReport[key]++
+	count := a.rejects[key]
+	a.mu.Unlock()
+
+	logger.LogImportant(logPrefix, "rejected %s from %s(%s): %s, total=%d", r.URL.Path, source, r.RemoteAddr, reason, count)
+}
+
+// 取出上次汇报以来被拒绝的请求统计，没有则返回空字符串
+func (a *intelAuth) takeRejectReport() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.rejectsReport) == 0 {
+		return ""
+	}
+
+	lines := make([]string, 0, len(a.rejectsReport))
+	for k, v := range a.rejectsReport {
+		lines = append(lines, fmt.Sprintf("%s: %d次", k, v))
+	}
+	sort.Strings(lines)
+	a.rejectsReport = make(map[string]int64)
+	return "情报上报接口拒绝了以下请求:\n" + strings.Join(lines, "\n")
+}
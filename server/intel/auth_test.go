@@ -0,0 +1,141 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-25 11:32:47
+ * @Description: collector身份验证的测试
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAuth() *intelAuth {
+	a := &intelAuth{}
+	a.init([]CollectorAuth{
+		{Name: "c1", Secret: "secret1"},
+		{Name: "c2", ApiKey: "key2"},
+	}, 300)
+	return a
+}
+
+func newSignedRequest(method, target, name, secret string, ts int64, body []byte) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(string(body)))
+	r.Header.Set(AuthHeader_Collector, name)
+	r.Header.Set(AuthHeader_Timestamp, fmt.Sprintf("%d", ts))
+	r.Header.Set(AuthHeader_Signature, SignIntelRequest(secret, ts, body))
+	return r
+}
+
+func TestAuthDisabled(t *testing.T) {
+	a := &intelAuth{}
+	a.init(nil, 0)
+	if _, ok := a.verify(httptest.NewRequest("POST", "/intel", nil), nil); !ok {
+		t.Fatal("request should pass when no collector is configured")
+	}
+}
+
+func TestAuthSignature(t *testing.T) {
+	a := newTestAuth()
+	body := []byte(`{"type":"news"}`)
+	ts := time.Now().UnixMilli()
+
+	r := newSignedRequest("POST", "/intel", "c1", "secret1", ts, body)
+	if name, ok := a.verify(r, body); !ok || name != "c1" {
+		t.Fatalf("valid signature rejected: name=%s ok=%v", name, ok)
+	}
+
+	// 同一个签名不能再次使用
+	if _, ok := a.verify(r, body); ok {
+		t.Fatal("replayed signature should be rejected")
+	}
+
+	// 签名与请求体不符
+	r = newSignedRequest("POST", "/intel", "c1", "secret1", ts+1, body)
+	if _, ok := a.verify(r, []byte(`{"type":"other"}`)); ok {
+		t.Fatal("signature of another body should be rejected")
+	}
+
+	// 密钥错误
+	r = newSignedRequest("POST", "/intel", "c1", "wrong", ts+2, body)
+	if _, ok := a.verify(r, body); ok {
+		t.Fatal("signature with wrong secret should be rejected")
+	}
+
+	// 未知collector
+	r = newSignedRequest("POST", "/intel", "c9", "secret1", ts+3, body)
+	if _, ok := a.verify(r, body); ok {
+		t.Fatal("unknown collector should be rejected")
+	}
+
+	if report := a.takeRejectReport(); !strings.Contains(report, "c1 replayed signature: 1次") {
+		t.Fatalf("unexpected reject report: %s", report)
+	}
+}
+
+func TestAuthTimeWindow(t *testing.T) {
+	a := newTestAuth()
+	body := []byte(`{}`)
+	for _, d := range []time.Duration{-time.Minute * 6, time.Minute * 6} {
+		ts := time.Now().Add(d).UnixMilli()
+		if _, ok := a.verify(newSignedRequest("POST", "/intel", "c1", "secret1", ts, body), body); ok {
+			t.Fatalf("timestamp offset %v should be rejected", d)
+		}
+	}
+
+	ts := time.Now().Add(-time.Minute * 4).UnixMilli()
+	if _, ok := a.verify(newSignedRequest("POST", "/intel", "c1", "secret1", ts, body), body); !ok {
+		t.Fatal("timestamp inside window should pass")
+	}
+}
+
+func TestAuthApiKey(t *testing.T) {
+	a := newTestAuth()
+	r := httptest.NewRequest("POST", "/intel", nil)
+	r.Header.Set(AuthHeader_Collector, "c2")
+	r.Header.Set(AuthHeader_ApiKey, "key2")
+	if _, ok := a.verify(r, nil); !ok {
+		t.Fatal("valid api key rejected")
+	}
+
+	r.Header.Set(AuthHeader_ApiKey, "key1")
+	if _, ok := a.verify(r, nil); ok {
+		t.Fatal("wrong api key should be rejected")
+	}
+
+	// c1没有配置api key
+	r.Header.Set(AuthHeader_Collector, "c1")
+	r.Header.Set(AuthHeader_ApiKey, "")
+	if _, ok := a.verify(r, nil); ok {
+		t.Fatal("collector without api key should not accept it")
+	}
+}
+
+func TestAuthVerifyRead(t *testing.T) {
+	a := newTestAuth()
+	ts := time.Now().UnixMilli()
+	uri := "/intel/list?since_seq=100&limit=10"
+
+	r := httptest.NewRequest("GET", uri, nil)
+	r.Header.Set(AuthHeader_Collector, "c1")
+	r.Header.Set(AuthHeader_Timestamp, fmt.Sprintf("%d", ts))
+	r.Header.Set(AuthHeader_Signature, SignIntelReadRequest("secret1", ts, uri))
+	if _, ok := a.verifyRead(r); !ok {
+		t.Fatal("valid read signature rejected")
+	}
+
+	// 修改查询参数后签名失效
+	r = httptest.NewRequest("GET", "/intel/list?since_seq=0&limit=10", nil)
+	r.Header.Set(AuthHeader_Collector, "c1")
+	r.Header.Set(AuthHeader_Timestamp, fmt.Sprintf("%d", ts+1))
+	r.Header.Set(AuthHeader_Signature, SignIntelReadRequest("secret1", ts+1, uri))
+	if _, ok := a.verifyRead(r); ok {
+		t.Fatal("read signature of another uri should be rejected")
+	}
+}
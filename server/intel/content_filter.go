@@ -0,0 +1,170 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-08 14:26:03
+ * @Description: 按标题/内容过滤情报：关键词、正则、最低等级，按频道设置
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// 编译过的正则缓存
+var regexCache sync.Map
+
+func compileRegex(pattern string) (*regexp.Regexp, error) {
+	if re, ok := regexCache.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	regexCache.Store(pattern, re)
+	return re, nil
+}
+
+// 情报的标题和内容是否满足频道的内容过滤规则
+func (f *dingUserSubtypeFilter) matchContent(intel *Intel) bool {
+	if intel.Level < f.MinLevel {
+		return false
+	}
+
+	text := intel.Title + "\n" + intel.Content
+	lowerText := strings.ToLower(text)
+	matchKeyword := func(kw string) bool { return strings.Contains(lowerText, strings.ToLower(kw)) }
+	matchRegex := func(pattern string) bool {
+		re, err := compileRegex(pattern)
+		return err == nil && re.MatchString(text)
+	}
+
+	// 排除规则，命中任意一条即排除
+	if slices.ContainsFunc(f.ExcludeKeywords, matchKeyword) || slices.ContainsFunc(f.ExcludeRegex, matchRegex) {
+		return false
+	}
+
+	// 包含规则，存在时必须命中至少一条
+	if len(f.IncludeKeywords) > 0 || len(f.IncludeRegex) > 0 {
+		return slices.ContainsFunc(f.IncludeKeywords, matchKeyword) || slices.ContainsFunc(f.IncludeRegex, matchRegex)
+	}
+
+	return true
+}
+
+func (f *dingUserSubtypeFilter) contentFilterStr() string {
+	sb := strings.Builder{}
+	if len(f.IncludeKeywords) > 0 {
+		sb.WriteString(fmt.Sprintf("  包含关键词:%s\n", strings.Join(f.IncludeKeywords, ",")))
+	}
+	if len(f.ExcludeKeywords) > 0 {
+		sb.WriteString(fmt.Sprintf("  排除关键词:%s\n", strings.Join(f.ExcludeKeywords, ",")))
+	}
+	if len(f.IncludeRegex) > 0 {
+		sb.WriteString(fmt.Sprintf("  包含正则:%s\n", strings.Join(f.IncludeRegex, " ")))
+	}
+	if len(f.ExcludeRegex) > 0 {
+		sb.WriteString(fmt.Sprintf("  排除正则:%s\n", strings.Join(f.ExcludeRegex, " ")))
+	}
+	if f.MinLevel > 0 {
+		sb.WriteString(fmt.Sprintf("  最低等级:%d\n", f.MinLevel))
+	}
+	return sb.String()
+}
+
+// 内容规则的种类
+const (
+	contentRule_IncludeKeyword = iota
+	contentRule_ExcludeKeyword
+	contentRule_IncludeRegex
+	contentRule_ExcludeRegex
+)
+
+// 用户已订阅频道的过滤设置，未订阅时返回nil。调用者需持有锁
+func (df *dingFilter) subscribedSubtypeFilter(uid, mainType string) *dingUserSubtypeFilter {
+	userFilter := df.userFilter(uid)
+	if userFilter == nil {
+		return nil
+	}
+	return userFilter.SubTypeFilters[mainType]
+}
+
+// 添加一条内容规则。未订阅该频道时返回false，不会因此订阅频道
+func (df *dingFilter) userAddContentRule(uid, mainType string, ruleType int, rule string) bool {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	mainType = strings.ToLower(mainType)
+
+	subFilter := df.subscribedSubtypeFilter(uid, mainType)
+	if subFilter == nil {
+		return false
+	}
+
+	var rules *[]string
+	switch ruleType {
+	case contentRule_IncludeKeyword:
+		rules = &subFilter.IncludeKeywords
+	case contentRule_ExcludeKeyword:
+		rules = &subFilter.ExcludeKeywords
+	case contentRule_IncludeRegex:
+		rules = &subFilter.IncludeRegex
+	case contentRule_ExcludeRegex:
+		rules = &subFilter.ExcludeRegex
+	default:
+		return false
+	}
+
+	if !slices.Contains(*rules, rule) {
+		*rules = append(*rules, rule)
+	}
+	df.save()
+	return true
+}
+
+// 从所有内容规则中删除某条，返回是否删除成功
+func (df *dingFilter) userRemoveContentRule(uid, mainType, rule string) bool {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	mainType = strings.ToLower(mainType)
+
+	subFilter := df.subscribedSubtypeFilter(uid, mainType)
+	if subFilter == nil {
+		return false
+	}
+
+	removed := false
+	for _, rules := range []*[]string{&subFilter.IncludeKeywords, &subFilter.ExcludeKeywords, &subFilter.IncludeRegex, &subFilter.ExcludeRegex} {
+		if i := slices.Index(*rules, rule); i >= 0 {
+			*rules = slices.Delete(*rules, i, i+1)
+			removed = true
+		}
+	}
+
+	if removed {
+		df.save()
+	}
+	return removed
+}
+
+// 设置频道的最低等级。未订阅该频道时返回false
+func (df *dingFilter) userSetMinLevel(uid, mainType string, level int) bool {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	mainType = strings.ToLower(mainType)
+
+	subFilter := df.subscribedSubtypeFilter(uid, mainType)
+	if subFilter == nil {
+		return false
+	}
+
+	subFilter.MinLevel = level
+	df.save()
+	return true
+}
@@ -0,0 +1,119 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-25 13:40:19
+ * @Description: 内容过滤的测试
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import "testing"
+
+func TestMatchContentKeyword(t *testing.T) {
+	f := &dingUserSubtypeFilter{IncludeKeywords: []string{"BTC", "eth"}, ExcludeKeywords: []string{"rumor"}}
+	cases := []struct {
+		title, content string
+		expected       bool
+	}{
+		{"btc breaks 40k", "", true},        // 不区分大小写
+		{"", "ETH upgrade", true},           // 匹配内容
+		{"sol", "nothing here", false},      // 未命中包含规则
+		{"BTC", "Rumor: etf passed", false}, // 命中排除规则
+	}
+
+	for _, c := range cases {
+		if got := f.matchContent(&Intel{Title: c.title, Content: c.content, Level: 1}); got != c.expected {
+			t.Errorf("title=%q content=%q: expected %v, got %v", c.title, c.content, c.expected, got)
+		}
+	}
+}
+
+func TestMatchContentRegex(t *testing.T) {
+	f := &dingUserSubtypeFilter{IncludeRegex: []string{`^\[listing\]`}, ExcludeRegex: []string{`(?i)test\s*net`}}
+	cases := []struct {
+		title    string
+		expected bool
+	}{
+		{"[listing] ABC", true},
+		{"new [listing] ABC", false},
+		{"[listing] ABC Testnet", false},
+	}
+
+	for _, c := range cases {
+		if got := f.matchContent(&Intel{Title: c.title, Level: 1}); got != c.expected {
+			t.Errorf("title=%q: expected %v, got %v", c.title, c.expected, got)
+		}
+	}
+
+	// 无效的正则视为未命中
+	f = &dingUserSubtypeFilter{IncludeRegex: []string{"("}}
+	if f.matchContent(&Intel{Title: "(", Level: 1}) {
+		t.Fatal("invalid regex should not match")
+	}
+}
+
+func TestMatchContentMinLevel(t *testing.T) {
+	f := &dingUserSubtypeFilter{MinLevel: 2}
+	if f.matchContent(&Intel{Level: 1}) || !f.matchContent(&Intel{Level: 2}) {
+		t.Fatal("min level filter broken")
+	}
+
+	// 没有任何规则时全部通过
+	if !(&dingUserSubtypeFilter{}).matchContent(&Intel{Title: "anything"}) {
+		t.Fatal("empty filter should match everything")
+	}
+}
+
+// 内存中的存储后端
+type memFilterStore struct {
+	data []byte
+}
+
+func (s *memFilterStore) name() string { return "memory" }
+
+func (s *memFilterStore) load(decode func(data []byte) error) (bool, error) {
+	if len(s.data) == 0 {
+		return false, nil
+	}
+	return true, decode(s.data)
+}
+
+func (s *memFilterStore) save(data []byte) error {
+	s.data = data
+	return nil
+}
+
+func newTestDingFilter() *dingFilter {
+	df := new(dingFilter)
+	df.init(&memFilterStore{})
+	return df
+}
+
+func TestContentRuleRequiresSubscription(t *testing.T) {
+	df := newTestDingFilter()
+	if df.userAddContentRule("u1", "news", contentRule_IncludeKeyword, "btc") || df.userSetMinLevel("u1", "news", 2) {
+		t.Fatal("content rule should be rejected for unsubscribed channel")
+	}
+
+	if df.userFilter("u1") != nil {
+		t.Fatal("rejected content rule should not subscribe the channel")
+	}
+
+	df.subscribeType("u1", "nick", "news")
+	if !df.userAddContentRule("u1", "News", contentRule_IncludeKeyword, "btc") || !df.userSetMinLevel("u1", "news", 2) {
+		t.Fatal("content rule should be added to subscribed channel")
+	}
+
+	if df.userAddContentRule("u1", "price", contentRule_IncludeKeyword, "btc") {
+		t.Fatal("content rule should be rejected for other channels")
+	}
+
+	f := df.UserTypeFilters["u1"]
+	if len(f.SubTypeFilters) != 1 || f.SubTypeFilters["news"].MinLevel != 2 || f.SubTypeFilters["news"].IncludeKeywords[0] != "btc" {
+		t.Fatalf("unexpected filter: %+v", f.SubTypeFilters)
+	}
+
+	if !df.userRemoveContentRule("u1", "news", "btc") || df.userRemoveContentRule("u1", "news", "btc") {
+		t.Fatal("remove content rule broken")
+	}
+}
@@ -12,19 +12,65 @@ import (
 	"time"
 )
 
+const (
+	maxBodySize      = 1024 * 128      // 单条情报/菜单请求body的最大长度
+	maxBatchBodySize = 1024 * 1024 * 4 // 批量请求body的最大长度
+	maxBatchSize     = 1000            // 批量请求中情报的最大数量
+)
+
+// 情报服务的配置
+type Config struct {
+	Enabled         bool   `json:"enabled"`
+	DingbotSecret   string `json:"ding_bot_secret"`
+	DedupWindowSec  int    `json:"dedup_window_sec"`  // 相同情报的去重窗口，0表示不去重
+	BurstWindowSec  int    `json:"burst_window_sec"`  // 同子类型情报的聚合窗口，0表示不聚合
+	BurstThreshold  int    `json:"burst_threshold"`   // 聚合窗口内单独推送的最大数量，超过的部分合并为一条
+	DigestDailyHour int    `json:"digest_daily_hour"` // 每日摘要的发送时间（0~23点）
+	MenuStaleSec    int    `json:"menu_stale_sec"`    // 菜单超过这个时间未重新上报视为过期，0表示使用默认值（6小时）
+
+	Collectors        []CollectorAuth `json:"collectors"`           // 允许上报的collector，为空表示不验证
+	AuthTimeWindowSec int             `json:"auth_time_window_sec"` // 签名时间戳的允许偏差，0表示使用默认值（300秒）
+
+	FilterStore string `json:"filter_store"` // 订阅数据的存储方式：file（默认）/redis
+	FilterFile  string `json:"filter_file"`  // file方式的文件路径，也是redis方式的迁移来源。默认为ding_filter.json
+
+	AdminUids  []string            `json:"admin_uids"`  // 可以管理他人订阅的钉钉用户id
+	AdminToken string              `json:"admin_token"` // 管理http接口的令牌，为空表示不开放管理接口
+	Templates  map[string][]string `json:"templates"`   // 订阅模板，模板名->["频道"或"频道:子频道"]
+
+	TTSStaleSec      int `json:"tts_stale_sec"`       // 语音播报条目等待超过这个时间后降低优先级，0表示使用默认值（60秒）
+	TTSExpireSec     int `json:"tts_expire_sec"`      // 语音播报条目等待超过这个时间后丢弃，0表示使用默认值（600秒）
+	TTSAckTimeoutSec int `json:"tts_ack_timeout_sec"` // 领取后超过这个时间未确认，可以被重新领取，0表示使用默认值（30秒）
+
+	QueueSize int `json:"queue_size"` // 情报处理队列的容量，0表示使用默认值（1000）
+	Workers   int `json:"workers"`    // 钉钉推送的并发数，0表示使用默认值（4）
+
+	Outputs []OutputConfig `json:"outputs"` // 钉钉以外的投递渠道
+}
+
 // 某种collector可以输出的情报类型
 type IntelMenu struct {
+	Source                 string         `json:"source"` // 可选，上报菜单的collector名称，为空时使用请求来源地址
 	Type                   string         `json:"type"`
 	SubTypes               map[string]int `json:"subtypes"`
 	SubtypeUncertain       bool           `json:"subtype_uncertain"`        // 不特定的Subtype类型
 	SybTypeUncertainReason string         `json:"subtype_uncertain_reason"` // 不特定的理由
+	Icon                   string         `json:"icon"`                     // 可选，该频道链接消息的图片（图片url或者钉钉media id）
 }
 
 const (
-	DingType_Text = "txt"
-	DingType_Link = "link"
+	DingType_Text       = "txt"
+	DingType_Link       = "link"
+	DingType_Markdown   = "md"
+	DingType_ActionCard = "card"
 )
 
+// 卡片消息的按钮
+type IntelButton struct {
+	Title string `json:"title"`
+	Url   string `json:"url"` // 跳转地址，也可以是钉钉支持的其他协议链接
+}
+
 // 一条捕获的情报
 type Intel struct {
 	Seq      int       `json:"seq"`       // 一个递增的ID，主要用于客户端识别新旧消息
@@ -32,9 +78,11 @@ type Intel struct {
 	Level    int       `json:"level"`     // 消息等级。0=调试消息，1=正式消息
 	Type     string    `json:"type"`      // 必填，主类型。用于用户订阅筛选
 	SubType  string    `json:"subtype"`   // 选填，次要类型。用于用户订阅筛选
-	DingType string    `json:"ding_type"` // txt/link表示文字/链接消息。空表示不发给dingding
+	DingType string    `json:"ding_type"` // txt/link/md/card表示文字/链接/markdown/卡片消息。空表示不发给dingding
 	Title    string    `json:"title"`     // 可选
 	Content  string    `json:"content"`   // 必选
 	TTS      string    `json:"tts"`       // 可选，需要语音播报的内容
 	Url      string    `json:"url"`       // 可选
+
+	Buttons []IntelButton `json:"buttons,omitempty"` // 可选，卡片消息的按钮。为空时使用Url生成一个按钮
 }
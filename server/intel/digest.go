@@ -0,0 +1,195 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-09-28 10:40:26
+ * @Description: 情报摘要。订阅模式为hourly/daily的频道，情报先在服务器累积，
+ * 到点后合并为一条消息发给用户。摘要内容需要持久化，避免重启丢失
+ * 到点时用户处于安静时段的，摘要标记为到期，安静时段结束后补发
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aztecqt/dagger/util"
+	"github.com/aztecqt/dagger/util/logger"
+)
+
+const digestFile = "intel_digest.json"
+const digestMaxItems = 100      // 每个摘要最多保留的条目，超过的只计数
+const digestContentMaxLen = 100 // 摘要中每条内容的最大长度
+
+// 投递模式
+const (
+	DeliveryMode_Immediate = "immediate"
+	DeliveryMode_Hourly    = "hourly"
+	DeliveryMode_Daily     = "daily"
+	DeliveryMode_Held      = "held" // 内部使用：静默期间暂存的情报
+)
+
+// 解析投递模式，支持缩写
+func parseDeliveryMode(str string) (string, bool) {
+	switch strings.ToLower(str) {
+	case "i", "immediate":
+		return DeliveryMode_Immediate, true
+	case "h", "hourly":
+		return DeliveryMode_Hourly, true
+	case "d", "daily":
+		return DeliveryMode_Daily, true
+	default:
+		return "", false
+	}
+}
+
+// 摘要中的一条情报
+type digestItem struct {
+	Seq     int       `json:"seq"`
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	SubType string    `json:"subtype"`
+	Title   string    `json:"title"`
+	Content string    `json:"content"`
+	Url     string    `json:"url"`
+}
+
+// 某用户某种模式下的摘要
+type digest struct {
+	Items   []digestItem `json:"items"`
+	Dropped int          `json:"dropped"` // 超过条目上限而未保留的数量
+	Due     bool         `json:"due"`     // 已经到点，但因用户处于安静时段而未发送
+}
+
+// 所有用户的摘要
+type digestBox struct {
+	Digests map[string]map[string]*digest `json:"digests"` // uid->mode->digest
+	dirty   bool                          // 有新加入的情报，尚未保存
+	mu      sync.Mutex
+}
+
+func (d *digestBox) init() {
+	d.Digests = make(map[string]map[string]*digest)
+	if !util.ObjectFromFile(digestFile, d) {
+		logger.LogImportant(logPrefix, "load %s failed", digestFile)
+	} else {
+		logger.LogImportant(logPrefix, "load %s ok", digestFile)
+	}
+}
+
+// 调用者需持有锁
+func (d *digestBox) toFile() {
+	d.dirty = false
+	if !util.ObjectToFile(digestFile, d) {
+		logger.LogImportant(logPrefix, "save %s failed", digestFile)
+	}
+}
+
+// 把一条情报加入某用户的摘要
+func (d *digestBox) add(uid, mode string, intel Intel) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.Digests[uid]; !ok {
+		d.Digests[uid] = make(map[string]*digest)
+	}
+
+	dg, ok := d.Digests[uid][mode]
+	if !ok {
+		dg = &digest{Items: make([]digestItem, 0)}
+		d.Digests[uid][mode] = dg
+	}
+
+	if len(dg.Items) >= digestMaxItems {
+		dg.Dropped++
+	} else {
+		dg.Items = append(dg.Items, digestItem{
+			Seq:     intel.Seq,
+			Time:    intel.Time,
+			Type:    intel.Type,
+			SubType: intel.SubType,
+			Title:   intel.Title,
+			Content: intel.Content,
+			Url:     intel.Url,
+		})
+	}
+
+	d.dirty = true
+}
+
+// 保存有变化的摘要。add在推送线程中频繁调用，不逐条保存
+func (d *digestBox) flush() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.dirty {
+		d.toFile()
+	}
+}
+
+// 取出某种模式下用户的摘要文本，并清空。uid->text
+// dueOnly为true时只取出之前到点时被跳过的摘要
+// skip返回true的用户本次不取出，摘要继续保留并标记为到期，之后以dueOnly方式补发
+func (d *digestBox) take(mode string, dueOnly bool, skip func(uid string) bool) map[string]string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	texts := make(map[string]string)
+	changed := false
+	for uid, dgs := range d.Digests {
+		if dg, ok := dgs[mode]; ok && (dg.Due || !dueOnly) {
+			if skip != nil && skip(uid) {
+				changed = changed || !dg.Due
+				dg.Due = true
+				continue
+			}
+
+			if len(dg.Items) > 0 || dg.Dropped > 0 {
+				texts[uid] = dg.string(mode)
+			}
+			delete(dgs, mode)
+			changed = true
+		}
+
+		if len(dgs) == 0 {
+			delete(d.Digests, uid)
+		}
+	}
+
+	if changed {
+		d.toFile()
+	}
+	return texts
+}
+
+func (dg *digest) string(mode string) string {
+	sort.Slice(dg.Items, func(i, j int) bool { return dg.Items[i].Seq < dg.Items[j].Seq })
+
+	sb := strings.Builder{}
+	if mode == DeliveryMode_Held {
+		sb.WriteString(fmt.Sprintf("静默期间的情报，共%d条\n", len(dg.Items)+dg.Dropped))
+	} else {
+		sb.WriteString(fmt.Sprintf("情报摘要(%s)，共%d条\n", mode, len(dg.Items)+dg.Dropped))
+	}
+	for i, item := range dg.Items {
+		content := []rune(item.Content)
+		if len(content) > digestContentMaxLen {
+			content = append(content[:digestContentMaxLen], []rune("...")...)
+		}
+
+		sb.WriteString(fmt.Sprintf("\n%d. [%s/%s] %s %s\n", i+1, item.Type, item.SubType, item.Time.Format("01-02 15:04"), item.Title))
+		sb.WriteString(string(content))
+		sb.WriteString("\n")
+		if len(item.Url) > 0 {
+			sb.WriteString(item.Url)
+			sb.WriteString("\n")
+		}
+	}
+
+	if dg.Dropped > 0 {
+		sb.WriteString(fmt.Sprintf("\n另有%d条未列出\n", dg.Dropped))
+	}
+	return sb.String()
+}
@@ -0,0 +1,102 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-26 10:21:37
+ * @Description: 情报摘要的测试
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// 切换到临时目录，避免测试中保存的数据文件写入源码目录
+func chdirTemp(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func newTestDigestBox() *digestBox {
+	return &digestBox{Digests: make(map[string]map[string]*digest)}
+}
+
+func TestDigestTake(t *testing.T) {
+	chdirTemp(t)
+	d := newTestDigestBox()
+	d.add("u1", DeliveryMode_Hourly, Intel{Seq: 2, Type: "news", Title: "second"})
+	d.add("u1", DeliveryMode_Hourly, Intel{Seq: 1, Type: "news", Title: "first"})
+	d.add("u1", DeliveryMode_Daily, Intel{Seq: 3, Type: "news", Title: "daily"})
+
+	texts := d.take(DeliveryMode_Hourly, false, nil)
+	text := texts["u1"]
+	if len(texts) != 1 || strings.Index(text, "first") > strings.Index(text, "second") || strings.Contains(text, "daily") {
+		t.Fatalf("unexpected hourly digest: %v", texts)
+	}
+
+	// 每日摘要不受影响
+	if len(d.take(DeliveryMode_Hourly, false, nil)) != 0 || len(d.Digests["u1"]) != 1 {
+		t.Fatalf("hourly digest should be cleared and daily digest kept: %+v", d.Digests)
+	}
+}
+
+func TestDigestDueAfterQuietHours(t *testing.T) {
+	chdirTemp(t)
+	d := newTestDigestBox()
+	d.add("quiet", DeliveryMode_Daily, Intel{Seq: 1, Title: "q1"})
+	d.add("awake", DeliveryMode_Daily, Intel{Seq: 2, Title: "a1"})
+
+	quiet := true
+	skip := func(uid string) bool { return uid == "quiet" && quiet }
+
+	// 到点时只发给不在安静时段的用户
+	texts := d.take(DeliveryMode_Daily, false, skip)
+	if _, ok := texts["awake"]; !ok || len(texts) != 1 {
+		t.Fatalf("unexpected daily digests: %v", texts)
+	}
+
+	// 没有到期的摘要不会被补发
+	d.add("awake", DeliveryMode_Daily, Intel{Seq: 3, Title: "a2"})
+	if texts := d.take(DeliveryMode_Daily, true, skip); len(texts) != 0 {
+		t.Fatalf("digest not due should not be sent: %v", texts)
+	}
+
+	// 安静时段内不补发，期间的新情报并入同一个摘要
+	d.add("quiet", DeliveryMode_Daily, Intel{Seq: 4, Title: "q2"})
+	if texts := d.take(DeliveryMode_Daily, true, skip); len(texts) != 0 {
+		t.Fatalf("digest should be held during quiet hours: %v", texts)
+	}
+
+	// 安静时段结束后补发
+	quiet = false
+	texts = d.take(DeliveryMode_Daily, true, skip)
+	if text := texts["quiet"]; len(texts) != 1 || !strings.Contains(text, "q1") || !strings.Contains(text, "q2") {
+		t.Fatalf("due digest should be sent after quiet hours: %v", texts)
+	}
+
+	if _, ok := d.Digests["quiet"]; ok {
+		t.Fatal("sent digest should be removed")
+	}
+}
+
+func TestDigestMaxItems(t *testing.T) {
+	chdirTemp(t)
+	d := newTestDigestBox()
+	for i := 0; i < digestMaxItems+5; i++ {
+		d.add("u1", DeliveryMode_Daily, Intel{Seq: i})
+	}
+
+	dg := d.Digests["u1"][DeliveryMode_Daily]
+	if len(dg.Items) != digestMaxItems || dg.Dropped != 5 {
+		t.Fatalf("items=%d dropped=%d", len(dg.Items), dg.Dropped)
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-17 14:05:13
+ * @Description: 把情报转换成各种钉钉消息
+ * 缺少必要字段，或者发送途径不支持该消息类型时，降级为文字消息
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"github.com/aztecqt/center_server/dingbot"
+	"github.com/aztecqt/dagger/util"
+)
+
+const defaultButtonTitle = "查看详情"
+
+// 根据情报的字段确定实际使用的消息类型
+func effectiveDingType(intel *Intel) string {
+	switch intel.DingType {
+	case DingType_Link:
+		if len(intel.Url) == 0 {
+			return DingType_Text
+		}
+	case DingType_Markdown:
+		if len(intel.Content) == 0 {
+			return DingType_Text
+		}
+	case DingType_ActionCard:
+		if len(intel.Content) == 0 {
+			return DingType_Text
+		} else if len(intel.Buttons) == 0 && len(intel.Url) == 0 {
+			return DingType_Markdown
+		}
+	default:
+		return DingType_Text
+	}
+	return intel.DingType
+}
+
+// 消息标题，为空时使用频道名
+func intelTitle(intel *Intel) string {
+	return util.ValueIf(len(intel.Title) > 0, intel.Title, intel.Type)
+}
+
+// 文字消息内容
+func intelText(intel *Intel) string {
+	text := intel.Title + "\n" + intel.Content
+	if intel.DingType != DingType_Text && len(intel.Url) > 0 {
+		text += "\n" + intel.Url
+	}
+	return text
+}
+
+// 卡片消息的按钮
+func intelButtons(intel *Intel) []dingbot.ActionCardButton {
+	btns := make([]dingbot.ActionCardButton, 0, len(intel.Buttons))
+	for _, b := range intel.Buttons {
+		if len(b.Url) > 0 {
+			btns = append(btns, dingbot.ActionCardButton{Title: util.ValueIf(len(b.Title) > 0, b.Title, defaultButtonTitle), Url: b.Url})
+		}
+	}
+
+	if len(btns) == 0 && len(intel.Url) > 0 {
+		btns = append(btns, dingbot.ActionCardButton{Title: defaultButtonTitle, Url: intel.Url})
+	}
+	return btns
+}
+
+// 链接消息的图片，优先使用频道菜单中配置的图标
+func (s *Service) intelIcon(intel *Intel) string {
+	if im, ok := s.menu.get(intel.Type); ok && len(im.Icon) > 0 {
+		return im.Icon
+	}
+	return picIdGlobal
+}
+
+// 发送给管理员。dingtalk.Notifier只支持文字和链接消息
+func (s *Service) sendIntelToAdmin(intel *Intel) {
+	if effectiveDingType(intel) == DingType_Link {
+		s.ding.SendLinkByMob(intel.Url, s.intelIcon(intel), intel.Title, intel.Content, s.dingAdminMob)
+	} else {
+		s.ding.SendTextByMob(intelText(intel), s.dingAdminMob)
+	}
+}
+
+// 通过webhook发送给群
+func (s *Service) sendIntelToWebhook(intel *Intel, webhook string) {
+	switch effectiveDingType(intel) {
+	case DingType_Link:
+		dingbot.SendLinkToWebhook(webhook, intel.Title, intel.Content, intel.Url, s.intelIcon(intel))
+	case DingType_Markdown:
+		dingbot.SendMarkdownToWebhook(webhook, intelTitle(intel), intel.Content)
+	case DingType_ActionCard:
+		dingbot.SendActionCardToWebhook(webhook, intelTitle(intel), intel.Content, intelButtons(intel))
+	default:
+		dingbot.SendTextToWebhook(webhook, intelText(intel))
+	}
+}
+
+// 通过工作通知发送给用户。markdown和卡片消息需要工作通知的应用配置，没有时降级为文字
+func (s *Service) sendIntelToUsers(intel *Intel, uids []string) {
+	dingType := effectiveDingType(intel)
+	if s.work == nil && (dingType == DingType_Markdown || dingType == DingType_ActionCard) {
+		dingType = DingType_Text
+	}
+
+	switch dingType {
+	case DingType_Link:
+		s.ding.SendLinkByUid(intel.Url, s.intelIcon(intel), intel.Title, intel.Content, uids...)
+	case DingType_Markdown:
+		s.work.SendMarkdownByUid(intelTitle(intel), intel.Content, uids...)
+	case DingType_ActionCard:
+		s.work.SendActionCardByUid(intelTitle(intel), intel.Content, intelButtons(intel), uids...)
+	default:
+		s.ding.SendTextByUid(intelText(intel), uids...)
+	}
+}
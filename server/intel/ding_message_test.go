@@ -0,0 +1,48 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-26 16:58:31
+ * @Description: 情报钉钉消息类型降级的测试
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import "testing"
+
+func TestEffectiveDingType(t *testing.T) {
+	cases := []struct {
+		intel    Intel
+		expected string
+	}{
+		{Intel{}, DingType_Text},
+		{Intel{DingType: "unknown", Url: "https://x"}, DingType_Text},
+		{Intel{DingType: DingType_Link}, DingType_Text},
+		{Intel{DingType: DingType_Link, Url: "https://x"}, DingType_Link},
+		{Intel{DingType: DingType_Markdown}, DingType_Text},
+		{Intel{DingType: DingType_Markdown, Content: "**x**"}, DingType_Markdown},
+		{Intel{DingType: DingType_ActionCard, Url: "https://x"}, DingType_Text},
+		{Intel{DingType: DingType_ActionCard, Content: "x"}, DingType_Markdown},
+		{Intel{DingType: DingType_ActionCard, Content: "x", Url: "https://x"}, DingType_ActionCard},
+		{Intel{DingType: DingType_ActionCard, Content: "x", Buttons: []IntelButton{{Url: "https://x"}}}, DingType_ActionCard},
+	}
+
+	for i, c := range cases {
+		if got := effectiveDingType(&c.intel); got != c.expected {
+			t.Errorf("case %d: expected %s, got %s", i, c.expected, got)
+		}
+	}
+}
+
+func TestIntelButtons(t *testing.T) {
+	intel := &Intel{Url: "https://detail", Buttons: []IntelButton{{Title: "a", Url: "https://a"}, {Title: "no url"}, {Url: "https://b"}}}
+	btns := intelButtons(intel)
+	if len(btns) != 2 || btns[0].Title != "a" || btns[1].Title != defaultButtonTitle || btns[1].Url != "https://b" {
+		t.Fatalf("unexpected buttons: %+v", btns)
+	}
+
+	// 没有有效按钮时使用Url
+	intel.Buttons = []IntelButton{{Title: "no url"}}
+	if btns := intelButtons(intel); len(btns) != 1 || btns[0].Url != "https://detail" {
+		t.Fatalf("unexpected buttons: %+v", btns)
+	}
+}
@@ -9,9 +9,11 @@
 package intel
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/aztecqt/dagger/util"
 	"github.com/aztecqt/dagger/util/logger"
@@ -21,11 +23,34 @@ import (
 type dingUserTypeFilter struct {
 	Nick           string                            `json:"nick"`
 	SubTypeFilters map[string]*dingUserSubtypeFilter `json:"types"`
+	QuietHours     *quietHours                       `json:"quiet_hours,omitempty"` // 每日安静时段
+	Mutes          map[string]time.Time              `json:"mutes,omitempty"`       // 频道->静音截止时间
+	HoldMuted      bool                              `json:"hold_muted"`            // 静默期间的情报暂存（true）还是丢弃（false）
+
+	// 群订阅。群的key为groupKeyPrefix+conversationId
+	IsGroup              bool   `json:"is_group,omitempty"`
+	GroupWebhook         string `json:"group_webhook,omitempty"`          // 群机器人的webhook，由群管理员设置，长期有效
+	SessionWebhook       string `json:"session_webhook,omitempty"`        // 最近一次群消息的会话webhook
+	SessionWebhookExpire int64  `json:"session_webhook_expire,omitempty"` // 会话webhook的过期时间（毫秒时间戳）
+}
+
+// 群订阅可用的webhook，优先使用群机器人webhook
+func (d *dingUserTypeFilter) groupWebhook() string {
+	if len(d.GroupWebhook) > 0 {
+		return d.GroupWebhook
+	}
+
+	if len(d.SessionWebhook) > 0 && time.Now().UnixMilli() < d.SessionWebhookExpire {
+		return d.SessionWebhook
+	}
+
+	return ""
 }
 
 func newDingUserTypeFilter() *dingUserTypeFilter {
 	f := new(dingUserTypeFilter)
 	f.SubTypeFilters = make(map[string]*dingUserSubtypeFilter)
+	f.Mutes = make(map[string]time.Time)
 	return f
 }
 
@@ -47,10 +72,30 @@ func (d *dingUserTypeFilter) match(mainType, subType string) bool {
 	}
 }
 
+// 按类型、子类型以及内容规则匹配一条情报
+func (d *dingUserTypeFilter) matchIntel(intel *Intel) bool {
+	return d.match(intel.Type, intel.SubType) && d.SubTypeFilters[intel.Type].matchContent(intel)
+}
+
 // 子类型过滤数据
 type dingUserSubtypeFilter struct {
 	WlSubtypes map[string]int `json:"white_list"` // 子类型白名单。为空则表示全部允许
 	BlSubtypes map[string]int `json:"black_list"` // 子类型黑名单
+	Mode       string         `json:"mode"`       // 投递模式：immediate/hourly/daily，为空等同于immediate
+
+	// 内容过滤
+	IncludeKeywords []string `json:"include_kw,omitempty"` // 标题或内容包含其中任一关键词才接收（不区分大小写）
+	ExcludeKeywords []string `json:"exclude_kw,omitempty"` // 标题或内容包含其中任一关键词则不接收
+	IncludeRegex    []string `json:"include_re,omitempty"` // 同上，正则表达式
+	ExcludeRegex    []string `json:"exclude_re,omitempty"`
+	MinLevel        int      `json:"min_level,omitempty"` // 最低情报等级
+}
+
+func (f *dingUserSubtypeFilter) deliveryMode() string {
+	if len(f.Mode) == 0 {
+		return DeliveryMode_Immediate
+	}
+	return f.Mode
 }
 
 func newDingUserSubtypeFilter() *dingUserSubtypeFilter {
@@ -65,42 +110,112 @@ type dingFilter struct {
 	// 所有用户的订阅数据，以uid作为key
 	UserTypeFilters map[string]*dingUserTypeFilter `json:"user_filter"`
 
+	// 存储后端
+	store filterStore
+	dirty bool // 有未保存的次要变化（如群会话的过期时间）
+
 	// 线程安全
 	mu sync.RWMutex
 }
 
 // 初始化
-func (df *dingFilter) init() {
+func (df *dingFilter) init(store filterStore) {
 	df.UserTypeFilters = make(map[string]*dingUserTypeFilter)
-	df.fromFile()
+	df.store = store
+	df.load()
 }
 
-// 寻找符合条件的用户id列表
-func (df *dingFilter) findMatchedUsers(mainType, subType string) []string {
-	uids := make([]string, 0)
+// 寻找符合条件的用户，返回uid->投递模式
+// 处于静默中的用户不会返回，而是放进silenced：uid->是否暂存
+// 摘要模式的频道不受安静时段影响（摘要本身会避开安静时段发送），只受静音影响
+func (df *dingFilter) findMatchedUsers(intel *Intel) (uids map[string]string, silenced map[string]bool) {
+	df.mu.RLock()
+	defer df.mu.RUnlock()
+
+	uids = make(map[string]string)
+	silenced = make(map[string]bool)
+	now := time.Now()
 	for uid, dutf := range df.UserTypeFilters {
-		if dutf.match(mainType, subType) {
-			uids = append(uids, uid)
+		if dutf.matchIntel(intel) {
+			mode := dutf.SubTypeFilters[intel.Type].deliveryMode()
+			if mode != DeliveryMode_Immediate && !dutf.muted(intel.Type, now) {
+				uids[uid] = mode
+			} else if dutf.silenced(intel.Type, now) {
+				silenced[uid] = dutf.HoldMuted
+			} else {
+				uids[uid] = mode
+			}
 		}
 	}
-	return uids
+	return
+}
+
+// 用户是否订阅了某情报，不考虑静默和投递模式
+func (df *dingFilter) userSubscribed(uid string, intel *Intel) bool {
+	df.mu.RLock()
+	defer df.mu.RUnlock()
+	f := df.userFilter(uid)
+	return f != nil && f.matchIntel(intel)
+}
+
+// 用户当前是否处于安静时段
+func (df *dingFilter) userInQuietHours(uid string) bool {
+	df.mu.RLock()
+	defer df.mu.RUnlock()
+	if f := df.userFilter(uid); f != nil && f.QuietHours != nil {
+		return f.QuietHours.active(time.Now())
+	}
+	return false
 }
 
-// 保存文件
-func (df *dingFilter) toFile() {
-	if !util.ObjectToFile("ding_filter.json", df) {
-		logger.LogImportant(logPrefix, "save ding_filter.json failed")
+// 用户当前是否处于任何形式的静默中
+func (df *dingFilter) userSilencedAny(uid string) bool {
+	df.mu.RLock()
+	defer df.mu.RUnlock()
+	if f := df.userFilter(uid); f != nil {
+		return f.silencedAny(time.Now())
+	}
+	return false
+}
+
+// 保存。调用者需持有锁
+func (df *dingFilter) save() {
+	df.dirty = false
+	b, err := json.Marshal(df)
+	if err != nil {
+		logger.LogImportant(logPrefix, "marshal ding filter failed, err=%s", err.Error())
+		return
+	}
+
+	if err := df.store.save(b); err != nil {
+		logger.LogImportant(logPrefix, "save ding filter to %s failed, err=%s", df.store.name(), err.Error())
 	} else {
-		logger.LogImportant(logPrefix, "save ding_filter.json ok")
+		logger.LogImportant(logPrefix, "save ding filter to %s ok", df.store.name())
 	}
 }
 
-// 加载
-func (df *dingFilter) fromFile() {
-	if !util.ObjectFromFile("ding_filter.json", df) {
-		logger.LogImportant(logPrefix, "load ding_filter.json failed")
+// 加载。存储中的数据都无法解析时，为避免覆盖原有数据，直接退出
+func (df *dingFilter) load() {
+	ok, err := df.store.load(func(b []byte) error {
+		// 先解析到临时对象，失败时不影响当前数据
+		loaded := dingFilter{}
+		if err := json.Unmarshal(b, &loaded); err != nil {
+			return err
+		}
+
+		df.UserTypeFilters = loaded.UserTypeFilters
+		if df.UserTypeFilters == nil {
+			df.UserTypeFilters = make(map[string]*dingUserTypeFilter)
+		}
+		return nil
+	})
+
+	if err != nil {
+		logger.LogPanic(logPrefix, "load ding filter from %s failed, err=%s", df.store.name(), err.Error())
+	} else if !ok {
+		logger.LogImportant(logPrefix, "no ding filter in %s", df.store.name())
 	} else {
-		logger.LogImportant(logPrefix, "load ding_filter.json ok")
+		logger.LogImportant(logPrefix, "load ding filter from %s ok, %d users", df.store.name(), len(df.UserTypeFilters))
 	}
 }
 
@@ -113,14 +228,27 @@ func (df *dingFilter) userFilter(uid string) *dingUserTypeFilter {
 	}
 }
 
+// 用户昵称（群则为群名称），没有订阅时返回空字符串
+func (df *dingFilter) userNick(uid string) string {
+	df.mu.RLock()
+	defer df.mu.RUnlock()
+	if f := df.userFilter(uid); f != nil {
+		return f.Nick
+	}
+	return ""
+}
+
 // 返回某用户的过滤器详情
 func (df *dingFilter) userFilterStr(uid string) string {
+	df.mu.RLock()
+	defer df.mu.RUnlock()
+
 	ss := strings.Builder{}
 	f := df.userFilter(uid)
 	if f == nil {
 		ss.WriteString("nothing")
 	} else {
-		ss.WriteString(fmt.Sprintf("用户昵称:[%s]\n", f.Nick))
+		ss.WriteString(fmt.Sprintf("%s:[%s]\n", util.ValueIf(f.IsGroup, "群名称", "用户昵称"), f.Nick))
 		ss.WriteString(fmt.Sprintf("已订阅内容:\n"))
 		for k, dusf := range f.SubTypeFilters {
 			ss.WriteString(fmt.Sprintf("*[%s]\n", k))
@@ -138,7 +266,12 @@ func (df *dingFilter) userFilterStr(uid string) string {
 			if len(blTypes) > 0 {
 				ss.WriteString(fmt.Sprintf("  -%s\n", strings.Join(blTypes, ",")))
 			}
+			if dusf.deliveryMode() != DeliveryMode_Immediate {
+				ss.WriteString(fmt.Sprintf("  投递模式:%s\n", dusf.deliveryMode()))
+			}
+			ss.WriteString(dusf.contentFilterStr())
 		}
+		ss.WriteString(f.quietStr(time.Now()))
 	}
 	return ss.String()
 }
@@ -178,7 +311,7 @@ func (df *dingFilter) subscribeType(uid, nick, mainType string) {
 	filter := df.findOrCreateUserFilter(uid)
 	filter.Nick = nick
 	df.findOrCreateUserSubtypeFilter(uid, mainType)
-	df.toFile()
+	df.save()
 }
 
 // 反订阅某类型
@@ -190,7 +323,7 @@ func (df *dingFilter) unsubscribeType(uid, nick, mainType string) {
 	filter := df.findOrCreateUserFilter(uid)
 	filter.Nick = nick
 	delete(filter.SubTypeFilters, mainType)
-	df.toFile()
+	df.save()
 }
 
 // 子类型加入白名单
@@ -202,7 +335,7 @@ func (df *dingFilter) userAddSubtypeWhiteList(uid, mainType, subType string) {
 
 	subFilter := df.findOrCreateUserSubtypeFilter(uid, mainType)
 	subFilter.WlSubtypes[subType] = 0
-	df.toFile()
+	df.save()
 }
 
 // 子类型移出白名单
@@ -214,7 +347,7 @@ func (df *dingFilter) userRemoveSubtypeWhiteList(uid, mainType, subType string)
 
 	subFilter := df.findOrCreateUserSubtypeFilter(uid, mainType)
 	delete(subFilter.WlSubtypes, subType)
-	df.toFile()
+	df.save()
 }
 
 // 清空白名单
@@ -225,7 +358,7 @@ func (df *dingFilter) userClearSubtypeWhiteList(uid, mainType string) {
 
 	subFilter := df.findOrCreateUserSubtypeFilter(uid, mainType)
 	subFilter.WlSubtypes = make(map[string]int)
-	df.toFile()
+	df.save()
 }
 
 // 子类型加入黑名单
@@ -237,7 +370,7 @@ func (df *dingFilter) userAddSubtypeBlackList(uid, mainType, subType string) {
 
 	subFilter := df.findOrCreateUserSubtypeFilter(uid, mainType)
 	subFilter.BlSubtypes[subType] = 0
-	df.toFile()
+	df.save()
 }
 
 // 子类型移出黑名单
@@ -249,7 +382,7 @@ func (df *dingFilter) userRemoveSubtypeBlackList(uid, mainType, subType string)
 
 	subFilter := df.findOrCreateUserSubtypeFilter(uid, mainType)
 	delete(subFilter.BlSubtypes, subType)
-	df.toFile()
+	df.save()
 }
 
 // 清空黑名单
@@ -260,5 +393,138 @@ func (df *dingFilter) userClearSubtypeBlackList(uid, mainType string) {
 
 	subFilter := df.findOrCreateUserSubtypeFilter(uid, mainType)
 	subFilter.BlSubtypes = make(map[string]int)
-	df.toFile()
+	df.save()
+}
+
+// 设置某频道的投递模式。频道未订阅时返回false
+func (df *dingFilter) userSetDeliveryMode(uid, mainType, mode string) bool {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	mainType = strings.ToLower(mainType)
+
+	userFilter := df.userFilter(uid)
+	if userFilter == nil {
+		return false
+	}
+
+	subFilter, ok := userFilter.SubTypeFilters[mainType]
+	if !ok {
+		return false
+	}
+
+	subFilter.Mode = mode
+	df.save()
+	return true
+}
+
+// 设置安静时段，qh为nil表示取消
+func (df *dingFilter) userSetQuietHours(uid, nick string, qh *quietHours) {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+
+	filter := df.findOrCreateUserFilter(uid)
+	filter.Nick = nick
+	filter.QuietHours = qh
+	df.save()
+}
+
+// 静音某频道（或all）至某时刻
+func (df *dingFilter) userMute(uid, nick, mainType string, until time.Time) {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	mainType = strings.ToLower(mainType)
+
+	filter := df.findOrCreateUserFilter(uid)
+	filter.Nick = nick
+	if filter.Mutes == nil {
+		filter.Mutes = make(map[string]time.Time)
+	}
+
+	// 顺便清理已过期的静音
+	for ch, t := range filter.Mutes {
+		if time.Now().After(t) {
+			delete(filter.Mutes, ch)
+		}
+	}
+
+	filter.Mutes[mainType] = until
+	df.save()
+}
+
+// 取消静音。mainType为all时取消所有静音
+func (df *dingFilter) userUnmute(uid, mainType string) {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	mainType = strings.ToLower(mainType)
+
+	filter := df.userFilter(uid)
+	if filter == nil {
+		return
+	}
+
+	if mainType == muteAllChannels {
+		filter.Mutes = make(map[string]time.Time)
+	} else {
+		delete(filter.Mutes, mainType)
+	}
+	df.save()
+}
+
+// 设置静默期间的情报是否暂存
+func (df *dingFilter) userSetHoldMuted(uid, nick string, hold bool) {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+
+	filter := df.findOrCreateUserFilter(uid)
+	filter.Nick = nick
+	filter.HoldMuted = hold
+	df.save()
+}
+
+// 记录群的最新会话webhook。每条群消息都会调用，只有群名或webhook变化时才立即保存
+func (df *dingFilter) groupUpdateSession(gid, title, webhook string, expireTs int64) {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+
+	filter := df.findOrCreateUserFilter(gid)
+	changed := !filter.IsGroup || filter.Nick != title || filter.SessionWebhook != webhook
+	filter.IsGroup = true
+	filter.Nick = title
+	filter.SessionWebhook = webhook
+	filter.SessionWebhookExpire = expireTs
+	if changed {
+		df.save()
+	} else {
+		df.dirty = true
+	}
+}
+
+// 保存未保存的次要变化
+func (df *dingFilter) flush() {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	if df.dirty {
+		df.save()
+	}
+}
+
+// 设置群机器人webhook
+func (df *dingFilter) groupSetWebhook(gid, webhook string) {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+
+	filter := df.findOrCreateUserFilter(gid)
+	filter.IsGroup = true
+	filter.GroupWebhook = webhook
+	df.save()
+}
+
+// 查询订阅者是否为群，以及群当前可用的webhook
+func (df *dingFilter) groupInfo(id string) (isGroup bool, webhook string) {
+	df.mu.RLock()
+	defer df.mu.RUnlock()
+	if f := df.userFilter(id); f != nil && f.IsGroup {
+		return true, f.groupWebhook()
+	}
+	return false, ""
 }
@@ -0,0 +1,181 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-13 10:12:37
+ * @Description: 订阅数据（dingFilter）的存储后端
+ * file：保存为本地json文件，先写临时文件再替换，替换前把旧文件保留为.bak。主文件缺失或无法解析时从.bak加载
+ * redis：整体保存在redis的一个hash字段中。redis中没有数据时，从旧的json文件迁移
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/aztecqt/dagger/util"
+	"github.com/aztecqt/dagger/util/logger"
+)
+
+const (
+	FilterStore_File  = "file"
+	FilterStore_Redis = "redis"
+)
+
+const (
+	filterDefaultFile         = "ding_filter.json"
+	filterRedisKey            = "intel_ding_filter"
+	filterRedisField_Filters  = "filters"
+	filterRedisField_Migrated = "migrated_from"
+)
+
+// 订阅数据的存储后端。数据的序列化由dingFilter负责
+type filterStore interface {
+	name() string
+	load(decode func(data []byte) error) (bool, error) // 用decode解析读到的数据。没有数据时返回false，数据无法解析时返回错误
+	save(data []byte) error
+}
+
+// 根据配置创建存储后端
+func newFilterStore(kind, path string, rc *util.RedisClient) filterStore {
+	path = util.ValueIf(len(path) > 0, path, filterDefaultFile)
+	switch kind {
+	case "", FilterStore_File:
+		return &fileFilterStore{path: path}
+	case FilterStore_Redis:
+		return &redisFilterStore{rc: rc, legacy: &fileFilterStore{path: path}}
+	default:
+		logger.LogPanic(logPrefix, "unknown filter store: %s", kind)
+		return nil
+	}
+}
+
+// 本地文件
+type fileFilterStore struct {
+	path       string
+	mainBroken bool // 主文件无法解析，下次保存时不用它覆盖备份
+}
+
+func (s *fileFilterStore) name() string {
+	return fmt.Sprintf("file(%s)", s.path)
+}
+
+func (s *fileFilterStore) backupPath() string {
+	return s.path + ".bak"
+}
+
+// 依次尝试主文件和备份文件，返回第一个能解析的。两个都存在但都无法解析时返回错误
+func (s *fileFilterStore) load(decode func(data []byte) error) (bool, error) {
+	var lastErr error
+	for _, path := range []string{s.path, s.backupPath()} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logger.LogImportant(logPrefix, "read %s failed, err=%s", path, err.Error())
+			}
+			continue
+		}
+
+		if len(data) == 0 {
+			continue
+		}
+
+		if err := decode(data); err != nil {
+			logger.LogImportant(logPrefix, "parse %s failed, err=%s", path, err.Error())
+			lastErr = fmt.Errorf("parse %s failed: %s", path, err.Error())
+			s.mainBroken = s.mainBroken || path == s.path
+			continue
+		}
+
+		if path != s.path {
+			logger.LogImportant(logPrefix, "%s unavailable, loaded from %s", s.path, path)
+		}
+		return true, nil
+	}
+
+	return false, lastErr
+}
+
+func (s *fileFilterStore) save(data []byte) error {
+	if dir := filepath.Dir(s.path); len(dir) > 0 {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// 保留上一个版本
+	if _, err := os.Stat(s.path); err == nil && !s.mainBroken {
+		if err := os.Rename(s.path, s.backupPath()); err != nil {
+			logger.LogImportant(logPrefix, "backup %s failed, err=%s", s.path, err.Error())
+		}
+	}
+
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	s.mainBroken = false
+	return nil
+}
+
+// redis
+type redisFilterStore struct {
+	rc     *util.RedisClient
+	legacy *fileFilterStore // 迁移来源
+}
+
+func (s *redisFilterStore) name() string {
+	return fmt.Sprintf("redis(%s)", filterRedisKey)
+}
+
+func (s *redisFilterStore) load(decode func(data []byte) error) (bool, error) {
+	if str, ok := s.rc.HGet(filterRedisKey, filterRedisField_Filters); ok && len(str) > 0 {
+		return true, decode([]byte(str))
+	}
+
+	// redis中还没有数据，从旧的json文件迁移
+	var data []byte
+	ok, err := s.legacy.load(func(b []byte) error {
+		if err := decode(b); err != nil {
+			return err
+		}
+		data = b
+		return nil
+	})
+	if !ok {
+		return false, err
+	}
+
+	if err := s.save(data); err != nil {
+		logger.LogImportant(logPrefix, "migrate %s to redis failed, err=%s", s.legacy.path, err.Error())
+	} else {
+		s.rc.HSet(filterRedisKey, filterRedisField_Migrated, s.legacy.path)
+		logger.LogImportant(logPrefix, "migrated %s to redis", s.legacy.path)
+	}
+	return true, nil
+}
+
+func (s *redisFilterStore) save(data []byte) error {
+	if !s.rc.HSet(filterRedisKey, filterRedisField_Filters, string(data)) {
+		return fmt.Errorf("redis hset failed")
+	}
+	return nil
+}
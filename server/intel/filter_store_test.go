@@ -0,0 +1,96 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-26 11:26:44
+ * @Description: 订阅数据存储后端的测试
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestFileStore(t *testing.T, main, backup string) *fileFilterStore {
+	s := &fileFilterStore{path: filepath.Join(t.TempDir(), "ding_filter.json")}
+	if len(main) > 0 {
+		os.WriteFile(s.path, []byte(main), 0644)
+	}
+	if len(backup) > 0 {
+		os.WriteFile(s.backupPath(), []byte(backup), 0644)
+	}
+	return s
+}
+
+func decodeJson(v *map[string]int) func(data []byte) error {
+	return func(data []byte) error { return json.Unmarshal(data, v) }
+}
+
+func TestFileFilterStoreFallback(t *testing.T) {
+	cases := []struct {
+		name, main, backup string
+		ok, fail           bool
+		expected           int
+	}{
+		{"main", `{"v":1}`, `{"v":2}`, true, false, 1},
+		{"main missing", "", `{"v":2}`, true, false, 2},
+		{"main corrupt", `{"v":`, `{"v":2}`, true, false, 2},
+		{"both corrupt", `{"v":`, `{"v"`, false, true, 0},
+		{"corrupt without backup", `{"v":`, "", false, true, 0},
+		{"no data", "", "", false, false, 0},
+	}
+
+	for _, c := range cases {
+		s := newTestFileStore(t, c.main, c.backup)
+		v := map[string]int{}
+		ok, err := s.load(decodeJson(&v))
+		if ok != c.ok || (err != nil) != c.fail || v["v"] != c.expected {
+			t.Errorf("%s: ok=%v err=%v v=%v", c.name, ok, err, v)
+		}
+	}
+}
+
+func TestFileFilterStoreSave(t *testing.T) {
+	s := newTestFileStore(t, "", "")
+	s.save([]byte(`{"v":1}`))
+	s.save([]byte(`{"v":2}`))
+
+	v := map[string]int{}
+	if ok, err := s.load(decodeJson(&v)); !ok || err != nil || v["v"] != 2 {
+		t.Fatalf("ok=%v err=%v v=%v", ok, err, v)
+	}
+
+	if b, _ := os.ReadFile(s.backupPath()); string(b) != `{"v":1}` {
+		t.Fatalf("backup should keep previous version, got %s", b)
+	}
+}
+
+func TestFileFilterStoreKeepBackup(t *testing.T) {
+	// 从备份加载后保存，损坏的主文件不能覆盖备份
+	s := newTestFileStore(t, `{"v":`, `{"v":1}`)
+	v := map[string]int{}
+	s.load(decodeJson(&v))
+	s.save([]byte(`{"v":2}`))
+
+	if b, _ := os.ReadFile(s.backupPath()); string(b) != `{"v":1}` {
+		t.Fatalf("backup should not be replaced by corrupt main file, got %s", b)
+	}
+
+	// 之后恢复正常的备份流程
+	s.save([]byte(`{"v":3}`))
+	if b, _ := os.ReadFile(s.backupPath()); string(b) != `{"v":2}` {
+		t.Fatalf("backup should keep previous version, got %s", b)
+	}
+}
+
+func TestDingFilterLoadFromBackup(t *testing.T) {
+	s := newTestFileStore(t, `{"user_filter":{"u1":`, `{"user_filter":{"u2":{}}}`)
+	df := new(dingFilter)
+	df.init(s)
+	if _, ok := df.UserTypeFilters["u2"]; !ok || len(df.UserTypeFilters) != 1 {
+		t.Fatalf("ding filter should be loaded from backup, got %v", df.UserTypeFilters)
+	}
+}
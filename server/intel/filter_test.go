@@ -0,0 +1,94 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-26 16:12:48
+ * @Description: 群订阅的测试
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGroupWebhook(t *testing.T) {
+	f := newDingUserTypeFilter()
+	f.SessionWebhook = "https://session"
+	f.SessionWebhookExpire = time.Now().Add(time.Hour).UnixMilli()
+	if f.groupWebhook() != "https://session" {
+		t.Fatal("session webhook should be used before it expires")
+	}
+
+	f.GroupWebhook = "https://group"
+	if f.groupWebhook() != "https://group" {
+		t.Fatal("group webhook should be preferred")
+	}
+
+	f.GroupWebhook = ""
+	f.SessionWebhookExpire = time.Now().Add(-time.Second).UnixMilli()
+	if f.groupWebhook() != "" {
+		t.Fatal("expired session webhook should not be used")
+	}
+}
+
+func TestGroupUpdateSession(t *testing.T) {
+	store := &memFilterStore{}
+	df := new(dingFilter)
+	df.init(store)
+
+	gid := groupKeyPrefix + "cid"
+	expire := time.Now().Add(time.Hour).UnixMilli()
+	df.groupUpdateSession(gid, "group1", "https://session", expire)
+	if isGroup, webhook := df.groupInfo(gid); !isGroup || webhook != "https://session" {
+		t.Fatalf("unexpected group info: %v %s", isGroup, webhook)
+	}
+
+	// 只有过期时间变化时不立即保存，由flush保存
+	saved := string(store.data)
+	df.groupUpdateSession(gid, "group1", "https://session", expire+1000)
+	if string(store.data) != saved || !df.dirty {
+		t.Fatal("expire time change should be saved later")
+	}
+
+	df.flush()
+	if string(store.data) == saved || df.dirty {
+		t.Fatal("flush should save pending changes")
+	}
+
+	saved = string(store.data)
+	df.groupUpdateSession(gid, "group2", "https://session", expire+1000)
+	if string(store.data) == saved || !strings.Contains(string(store.data), "group2") {
+		t.Fatal("title change should be saved immediately")
+	}
+
+	if isGroup, _ := df.groupInfo("u1"); isGroup {
+		t.Fatal("user should not be a group")
+	}
+}
+
+func TestOnCmdGroupWebhook(t *testing.T) {
+	s := &Service{menu: newTestMenuBook(), filter: newTestDingFilter()}
+	gid := groupKeyPrefix + "cid"
+	resp := ""
+	onResp := func(str string) { resp = str }
+
+	if s.OnCommand("hook https://x", "u1", "nick", onResp); resp != "`hook` is only available in group chat" {
+		t.Fatalf("unexpected response: %s", resp)
+	}
+
+	if s.OnCommand("hook http://x", gid, "group", onResp); resp != "invalid webhook `http://x`" {
+		t.Fatalf("unexpected response: %s", resp)
+	}
+
+	s.OnCommand("hook https://x", gid, "group", onResp)
+	if _, webhook := s.filter.groupInfo(gid); webhook != "https://x" {
+		t.Fatalf("group webhook should be set, got %s", webhook)
+	}
+
+	s.OnCommand("hook off", gid, "group", onResp)
+	if _, webhook := s.filter.groupInfo(gid); resp != "group webhook cleared" || len(webhook) != 0 {
+		t.Fatalf("group webhook should be cleared, got %s", webhook)
+	}
+}
@@ -0,0 +1,264 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-10 10:05:44
+ * @Description: 情报菜单（可订阅的频道/子频道）。菜单持久化到文件，重启后无需等待collector重新上报
+ * 每个菜单记录最近一次上报的时间和来源，长时间未上报的菜单视为过期，并通知管理员
+ * 另外从实际收到的情报中学习频道/子频道，弥补collector未上报或者子频道不确定的情况
+ * 调试情报不参与学习，很久（默认30天）没有再出现的频道/子频道会被清理。保留时长远大于菜单的过期时长，
+ * 避免频道暂时沉寂后用户无法再操作已有的订阅
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aztecqt/dagger/util"
+	"github.com/aztecqt/dagger/util/logger"
+)
+
+const menuFile = "intel_menu.json"
+const menuDefaultStaleDuration = time.Hour * 6
+const menuObservedRetention = time.Hour * 24 * 30 // 观察记录的保留时长
+
+// 一个频道的菜单及其上报情况
+type menuEntry struct {
+	Menu         IntelMenu `json:"menu"`
+	AnnounceTime time.Time `json:"announce_time"` // 最近一次上报时间
+	Source       string    `json:"source"`        // 最近一次上报的来源
+	StaleAlerted bool      `json:"stale_alerted"` // 是否已经发送过过期提醒
+}
+
+func (e *menuEntry) stale(staleDuration time.Duration) bool {
+	return time.Since(e.AnnounceTime) > staleDuration
+}
+
+// 从情报中观察到的子频道
+type observedSubtype struct {
+	Name     string    `json:"-"`
+	Count    int64     `json:"count"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+type intelMenuBook struct {
+	Entries           map[string]*menuEntry                  `json:"entries"`
+	Observed          map[string]map[string]*observedSubtype `json:"observed"`       // mainType-subType-观察记录
+	ObservedTypes     map[string]time.Time                   `json:"observed_types"` // mainType-最近出现时间
+	keys              []string
+	staleDuration     time.Duration
+	observedRetention time.Duration
+	dirty             bool // 观察记录有变化，尚未保存
+	mu                sync.RWMutex
+}
+
+func (b *intelMenuBook) init(staleSec int) {
+	b.Entries = make(map[string]*menuEntry)
+	b.Observed = make(map[string]map[string]*observedSubtype)
+	b.ObservedTypes = make(map[string]time.Time)
+	b.staleDuration = util.ValueIf(staleSec > 0, time.Duration(staleSec)*time.Second, menuDefaultStaleDuration)
+	b.observedRetention = menuObservedRetention
+	if !util.ObjectFromFile(menuFile, b) {
+		logger.LogImportant(logPrefix, "load %s failed", menuFile)
+	} else {
+		logger.LogImportant(logPrefix, "load %s ok, %d menus", menuFile, len(b.Entries))
+	}
+	if b.Entries == nil {
+		b.Entries = make(map[string]*menuEntry)
+	}
+	if b.Observed == nil {
+		b.Observed = make(map[string]map[string]*observedSubtype)
+	}
+	if b.ObservedTypes == nil {
+		b.ObservedTypes = make(map[string]time.Time)
+	}
+
+	// 旧文件中没有频道的出现时间，从头开始计算过期
+	for mainType := range b.Observed {
+		if _, ok := b.ObservedTypes[mainType]; !ok {
+			b.ObservedTypes[mainType] = time.Now()
+		}
+	}
+	b.refreshKeys()
+}
+
+func (b *intelMenuBook) toFile() {
+	if !util.ObjectToFile(menuFile, b) {
+		logger.LogImportant(logPrefix, "save %s failed", menuFile)
+	}
+}
+
+// 调用者需持有锁
+func (b *intelMenuBook) refreshKeys() {
+	keys := make([]string, 0, len(b.Entries))
+	for k := range b.Entries {
+		keys = append(keys, k)
+	}
+	for k := range b.Observed {
+		if _, ok := b.Entries[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	b.keys = keys
+}
+
+// collector上报菜单
+func (b *intelMenuBook) announce(menu IntelMenu, source string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.Entries[menu.Type] = &menuEntry{Menu: menu, AnnounceTime: time.Now(), Source: source}
+	b.refreshKeys()
+	b.toFile()
+}
+
+// 记录一条收到的情报。调试情报不记录，避免测试用的频道名变成可订阅的频道
+func (b *intelMenuBook) observe(intel *Intel) {
+	if len(intel.Type) == 0 || intel.Level == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subs, ok := b.Observed[intel.Type]
+	if !ok {
+		subs = make(map[string]*observedSubtype)
+		b.Observed[intel.Type] = subs
+		b.refreshKeys()
+	}
+
+	now := time.Now()
+	b.ObservedTypes[intel.Type] = now
+	if len(intel.SubType) > 0 {
+		o, ok := subs[intel.SubType]
+		if !ok {
+			o = new(observedSubtype)
+			subs[intel.SubType] = o
+		}
+		o.Count++
+		o.LastSeen = now
+	}
+
+	b.dirty = true
+}
+
+// 清理超过保留时长没有再出现的频道/子频道。调用者需持有锁
+func (b *intelMenuBook) prune(now time.Time) {
+	pruned := false
+	for mainType, subs := range b.Observed {
+		for name, o := range subs {
+			if now.Sub(o.LastSeen) > b.observedRetention {
+				delete(subs, name)
+				pruned = true
+			}
+		}
+
+		if now.Sub(b.ObservedTypes[mainType]) > b.observedRetention {
+			delete(b.Observed, mainType)
+			delete(b.ObservedTypes, mainType)
+			pruned = true
+		}
+	}
+
+	if pruned {
+		b.refreshKeys()
+		b.dirty = true
+	}
+}
+
+// 清理过期的观察记录，保存有变化的观察记录。情报频率较高，不在observe中逐条保存
+func (b *intelMenuBook) flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.prune(time.Now())
+	if b.dirty {
+		b.dirty = false
+		b.toFile()
+	}
+}
+
+// 查询某频道的菜单。没有上报过菜单，但观察到过情报的频道，返回一个空菜单
+func (b *intelMenuBook) get(mainType string) (IntelMenu, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if e, ok := b.Entries[mainType]; ok {
+		return e.Menu, true
+	} else if _, ok := b.Observed[mainType]; ok {
+		return IntelMenu{Type: mainType, SubTypes: map[string]int{}}, true
+	}
+	return IntelMenu{}, false
+}
+
+// 某频道下观察到的子频道，按最近出现时间倒序排列
+func (b *intelMenuBook) observedSubtypes(mainType string) []observedSubtype {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	rst := make([]observedSubtype, 0)
+	for name, o := range b.Observed[mainType] {
+		c := *o
+		c.Name = name
+		rst = append(rst, c)
+	}
+
+	sort.Slice(rst, func(i, j int) bool { return rst[i].LastSeen.After(rst[j].LastSeen) })
+	return rst
+}
+
+// 某频道下是否观察到过某子频道
+func (b *intelMenuBook) hasObserved(mainType, subType string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	_, ok := b.Observed[mainType][subType]
+	return ok
+}
+
+// 某频道的上报情况
+func (b *intelMenuBook) entry(mainType string) (menuEntry, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if e, ok := b.Entries[mainType]; ok {
+		return *e, true
+	}
+	return menuEntry{}, false
+}
+
+// 某频道是否过期
+func (b *intelMenuBook) isStale(mainType string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if e, ok := b.Entries[mainType]; ok {
+		return e.stale(b.staleDuration)
+	}
+	return false
+}
+
+// 按名称排序的频道列表
+func (b *intelMenuBook) mainTypes() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.keys
+}
+
+// 返回新近过期（尚未提醒过）的菜单，并标记为已提醒
+func (b *intelMenuBook) takeNewlyStale() []menuEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	rst := make([]menuEntry, 0)
+	for _, e := range b.Entries {
+		if !e.StaleAlerted && e.stale(b.staleDuration) {
+			e.StaleAlerted = true
+			rst = append(rst, *e)
+		}
+	}
+
+	if len(rst) > 0 {
+		b.toFile()
+	}
+	return rst
+}
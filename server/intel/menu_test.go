@@ -0,0 +1,111 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-26 13:15:02
+ * @Description: 情报菜单自动学习的测试
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestMenuBook() *intelMenuBook {
+	return &intelMenuBook{
+		Entries:           make(map[string]*menuEntry),
+		Observed:          make(map[string]map[string]*observedSubtype),
+		ObservedTypes:     make(map[string]time.Time),
+		staleDuration:     time.Hour * 6,
+		observedRetention: menuObservedRetention,
+	}
+}
+
+func TestMenuObserve(t *testing.T) {
+	b := newTestMenuBook()
+	b.observe(&Intel{Type: "debug", SubType: "x", Level: 0})
+	b.observe(&Intel{Type: "news", SubType: "cn", Level: 1})
+	b.observe(&Intel{Type: "news", SubType: "cn", Level: 2})
+
+	if _, ok := b.get("debug"); ok {
+		t.Fatal("debug intel should not be observed")
+	}
+
+	if _, ok := b.get("news"); !ok || !b.hasObserved("news", "cn") || b.Observed["news"]["cn"].Count != 2 {
+		t.Fatalf("news/cn should be observed: %+v", b.Observed)
+	}
+}
+
+func TestMenuPrune(t *testing.T) {
+	b := newTestMenuBook()
+	b.observe(&Intel{Type: "news", SubType: "cn", Level: 1})
+	b.observe(&Intel{Type: "news", SubType: "us", Level: 1})
+	now := time.Now()
+
+	// 超过菜单过期时长，但还在保留时长内
+	b.prune(now.Add(b.staleDuration * 2))
+	if !b.hasObserved("news", "cn") {
+		t.Fatal("observed subtype should be kept after menu stale duration")
+	}
+
+	// 频道仍然活跃，但某个子频道超过保留时长
+	b.Observed["news"]["us"].LastSeen = now.Add(-b.observedRetention - time.Hour)
+	b.prune(now)
+	if b.hasObserved("news", "us") || !b.hasObserved("news", "cn") {
+		t.Fatalf("only the retired subtype should be pruned: %+v", b.Observed["news"])
+	}
+
+	b.prune(now.Add(b.observedRetention + time.Hour))
+	if _, ok := b.get("news"); ok || len(b.mainTypes()) != 0 {
+		t.Fatal("observed type should be pruned after retention")
+	}
+}
+
+func TestUnsubscribeRetiredChannel(t *testing.T) {
+	s := &Service{menu: newTestMenuBook(), filter: newTestDingFilter()}
+	s.menu.observe(&Intel{Type: "news", SubType: "cn", Level: 1})
+	s.filter.subscribeType("u1", "nick", "news")
+	s.filter.userAddSubtypeWhiteList("u1", "news", "cn")
+
+	// 频道已经不在菜单中
+	s.menu.prune(time.Now().Add(s.menu.observedRetention + time.Hour))
+	resp := ""
+	onResp := func(str string) { resp = str }
+	if s.OnCommand("s news", "u1", "nick", onResp); resp != "频道[news]不存在" {
+		t.Fatalf("subscribe should check the channel, got %q", resp)
+	}
+
+	s.OnCommand("uss news cn", "u1", "nick", onResp)
+	s.OnCommand("css news", "u1", "nick", onResp)
+	s.OnCommand("us news", "u1", "nick", onResp)
+	if resp != "unsubscribe [news] done" || len(s.filter.UserTypeFilters["u1"].SubTypeFilters) != 0 {
+		t.Fatalf("unsubscribe should work for retired channel, got %q", resp)
+	}
+}
+
+func TestMenuStaleAlert(t *testing.T) {
+	chdirTemp(t)
+	b := newTestMenuBook()
+	b.announce(IntelMenu{Type: "price"}, "c1")
+	b.announce(IntelMenu{Type: "news"}, "c2")
+	if b.isStale("price") || len(b.takeNewlyStale()) != 0 {
+		t.Fatal("fresh menu should not be stale")
+	}
+
+	b.Entries["price"].AnnounceTime = time.Now().Add(-b.staleDuration - time.Second)
+	if stale := b.takeNewlyStale(); !b.isStale("price") || len(stale) != 1 || stale[0].Source != "c1" {
+		t.Fatalf("price should be alerted once, got %+v", stale)
+	}
+
+	if len(b.takeNewlyStale()) != 0 {
+		t.Fatal("stale menu should only be alerted once")
+	}
+
+	// 重新上报后恢复，再次过期时重新提醒
+	b.announce(IntelMenu{Type: "price"}, "c1")
+	b.Entries["price"].AnnounceTime = time.Now().Add(-b.staleDuration - time.Second)
+	if len(b.takeNewlyStale()) != 1 {
+		t.Fatal("re-announced menu should be alerted again")
+	}
+}
@@ -0,0 +1,291 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-23 10:35:18
+ * @Description: 钉钉以外的情报投递渠道
+ * webhook：把情报以json POST到指定地址，失败时重试
+ * file：把情报以NDJSON（每行一条json）追加到本地文件，可用于离线测试或者供其他工具读取
+ * smtp：以邮件发送
+ * 每个渠道有自己的频道过滤条件，语法与实时推送相同；也可以绑定到订阅者，按订阅者在钉钉上的订阅设置投递
+ * 每个渠道有独立的队列和goroutine，按流水号顺序投递，慢的渠道不影响存储和钉钉推送
+ * 渠道收到的是未经去重聚合的原始情报
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aztecqt/dagger/util"
+	"github.com/aztecqt/dagger/util/logger"
+)
+
+const (
+	OutputKind_Webhook = "webhook"
+	OutputKind_File    = "file"
+	OutputKind_Smtp    = "smtp"
+)
+
+const (
+	outputQueueSize         = 1000
+	outputDefaultTimeoutSec = 5
+	outputDefaultRetries    = 3
+	outputFileDatePattern   = "{date}" // 文件路径中的日期占位符，用于按天分割文件
+)
+
+// 一个投递渠道的配置
+type OutputConfig struct {
+	Name     string   `json:"name"`
+	Kind     string   `json:"kind"`      // webhook/file/smtp
+	Types    []string `json:"types"`     // 投递的频道，为空表示所有频道
+	Wl       []string `json:"wl"`        // 子频道白名单，格式为"频道:子频道"
+	Bl       []string `json:"bl"`        // 子频道黑名单，格式同上
+	MinLevel int      `json:"min_level"` // 最低情报等级，0表示包括调试消息
+
+	// 订阅者uid。不为空时，投递这些订阅者订阅的情报（频道、子频道、内容过滤与钉钉订阅一致，不受静默和投递模式影响），忽略Types/Wl/Bl
+	Subscribers []string `json:"subscribers"`
+
+	// webhook
+	Url        string            `json:"url"`
+	Headers    map[string]string `json:"headers"`
+	Retries    int               `json:"retries"`     // 失败后的重试次数，0表示使用默认值（3）
+	TimeoutSec int               `json:"timeout_sec"` // 0表示使用默认值（5秒）
+
+	// file
+	Path string `json:"path"` // 可以包含{date}，按天写入不同文件
+
+	// smtp
+	SmtpAddr      string   `json:"smtp_addr"` // host:port
+	SmtpUser      string   `json:"smtp_user"` // 为空表示不需要验证
+	SmtpPassword  string   `json:"smtp_password"`
+	MailFrom      string   `json:"mail_from"`
+	MailTo        []string `json:"mail_to"`
+	SubjectPrefix string   `json:"subject_prefix"`
+}
+
+// 投递渠道
+type deliveryChannel interface {
+	deliver(intel *Intel) error
+}
+
+type output struct {
+	cfg     OutputConfig
+	filter  *dingUserTypeFilter
+	channel deliveryChannel
+	queue   chan Intel
+}
+
+// subscribed用于判断订阅者是否订阅了情报
+func (o *output) match(intel *Intel, subscribed func(uid string, intel *Intel) bool) bool {
+	if intel.Level < o.cfg.MinLevel {
+		return false
+	}
+
+	if len(o.cfg.Subscribers) > 0 {
+		for _, uid := range o.cfg.Subscribers {
+			if subscribed(uid, intel) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return o.filter == nil || o.filter.match(strings.ToLower(intel.Type), strings.ToLower(intel.SubType))
+}
+
+func newOutput(cfg OutputConfig) (*output, error) {
+	o := &output{cfg: cfg, filter: buildTypeFilter(cfg.Types, cfg.Wl, cfg.Bl), queue: make(chan Intel, outputQueueSize)}
+	switch cfg.Kind {
+	case OutputKind_Webhook:
+		if len(cfg.Url) == 0 {
+			return nil, fmt.Errorf("missing url")
+		}
+		o.channel = newWebhookChannel(cfg)
+	case OutputKind_File:
+		if len(cfg.Path) == 0 {
+			return nil, fmt.Errorf("missing path")
+		}
+		o.channel = &fileChannel{path: cfg.Path}
+	case OutputKind_Smtp:
+		if len(cfg.SmtpAddr) == 0 || len(cfg.MailFrom) == 0 || len(cfg.MailTo) == 0 {
+			return nil, fmt.Errorf("missing smtp_addr/mail_from/mail_to")
+		}
+		o.channel = &smtpChannel{cfg: cfg}
+	default:
+		return nil, fmt.Errorf("unknown kind: %s", cfg.Kind)
+	}
+	return o, nil
+}
+
+func (o *output) start() {
+	go func() {
+		for intel := range o.queue {
+			func() {
+				defer util.DefaultRecover()
+				if err := o.channel.deliver(&intel); err != nil {
+					logger.LogImportant(logPrefix, "output %s deliver intel(seq=%d) failed: %s", o.cfg.Name, intel.Seq, err.Error())
+				}
+			}()
+		}
+	}()
+}
+
+// 放入投递队列，不阻塞。队列满时丢弃
+func (o *output) enqueue(intel *Intel, subscribed func(uid string, intel *Intel) bool) {
+	if !o.match(intel, subscribed) {
+		return
+	}
+
+	select {
+	case o.queue <- *intel:
+	default:
+		logger.LogImportant(logPrefix, "output %s queue full, intel(seq=%d) dropped", o.cfg.Name, intel.Seq)
+	}
+}
+
+// 创建并启动所有配置的投递渠道，配置有误的渠道不启用
+func newOutputs(cfgs []OutputConfig) []*output {
+	outputs := make([]*output, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		if o, err := newOutput(cfg); err != nil {
+			logger.LogImportant(logPrefix, "output %s disabled: %s", cfg.Name, err.Error())
+		} else {
+			o.start()
+			outputs = append(outputs, o)
+			logger.LogImportant(logPrefix, "output %s(%s) enabled", cfg.Name, cfg.Kind)
+		}
+	}
+	return outputs
+}
+
+// webhook
+type webhookChannel struct {
+	url     string
+	headers map[string]string
+	retries int
+	client  *http.Client
+}
+
+func newWebhookChannel(cfg OutputConfig) *webhookChannel {
+	c := new(webhookChannel)
+	c.url = cfg.Url
+	c.headers = cfg.Headers
+	c.retries = util.ValueIf(cfg.Retries > 0, cfg.Retries, outputDefaultRetries)
+	c.client = &http.Client{Timeout: time.Second * time.Duration(util.ValueIf(cfg.TimeoutSec > 0, cfg.TimeoutSec, outputDefaultTimeoutSec))}
+	return c
+}
+
+func (c *webhookChannel) post(body []byte) error {
+	req, err := http.NewRequest("POST", c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range c.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status=%d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (c *webhookChannel) deliver(intel *Intel) error {
+	body, _ := json.Marshal(intel)
+	var err error
+	for i := 0; i <= c.retries; i++ {
+		if i > 0 {
+			time.Sleep(time.Second * time.Duration(i))
+		}
+
+		if err = c.post(body); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// 本地NDJSON文件
+type fileChannel struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (c *fileChannel) deliver(intel *Intel) error {
+	path := strings.ReplaceAll(c.path, outputFileDatePattern, time.Now().Format(time.DateOnly))
+	line, _ := json.Marshal(intel)
+	line = append(line, '\n')
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if dir := filepath.Dir(path); len(dir) > 0 {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(line)
+	return err
+}
+
+// 邮件
+type smtpChannel struct {
+	cfg OutputConfig
+}
+
+// 邮件头中去掉换行，避免情报内容注入其他邮件头
+var mailHeaderReplacer = strings.NewReplacer("\r", " ", "\n", " ")
+
+// 邮件内容，包括邮件头
+func (c *smtpChannel) message(intel *Intel) string {
+	subject := fmt.Sprintf("%s[%s/%s] %s", c.cfg.SubjectPrefix, intel.Type, intel.SubType, intelTitle(intel))
+	subject = mime.QEncoding.Encode("utf-8", mailHeaderReplacer.Replace(subject))
+	body := intel.Content
+	if len(intel.Url) > 0 {
+		body += "\r\n\r\n" + intel.Url
+	}
+
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("From: %s\r\n", c.cfg.MailFrom))
+	sb.WriteString(fmt.Sprintf("To: %s\r\n", strings.Join(c.cfg.MailTo, ", ")))
+	sb.WriteString(fmt.Sprintf("Subject: %s\r\n", subject))
+	sb.WriteString("MIME-Version: 1.0\r\n")
+	sb.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	sb.WriteString("\r\n")
+	sb.WriteString(body)
+	return sb.String()
+}
+
+func (c *smtpChannel) deliver(intel *Intel) error {
+	var auth smtp.Auth
+	if len(c.cfg.SmtpUser) > 0 {
+		host, _, _ := strings.Cut(c.cfg.SmtpAddr, ":")
+		auth = smtp.PlainAuth("", c.cfg.SmtpUser, c.cfg.SmtpPassword, host)
+	}
+	return smtp.SendMail(c.cfg.SmtpAddr, auth, c.cfg.MailFrom, c.cfg.MailTo, []byte(c.message(intel)))
+}
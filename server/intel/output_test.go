@@ -0,0 +1,118 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-26 17:52:19
+ * @Description: 情报投递渠道的测试
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutputMatch(t *testing.T) {
+	o, err := newOutput(OutputConfig{Kind: OutputKind_File, Path: "x", Types: []string{"news"}, Bl: []string{"news:doge"}, MinLevel: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		intel    Intel
+		expected bool
+	}{
+		{Intel{Type: "News", SubType: "btc", Level: 1}, true},
+		{Intel{Type: "news", SubType: "doge", Level: 1}, false},
+		{Intel{Type: "price", Level: 1}, false},
+		{Intel{Type: "news", Level: 0}, false},
+	}
+	for i, c := range cases {
+		if o.match(&c.intel, nil) != c.expected {
+			t.Errorf("case %d: expected %v", i, c.expected)
+		}
+	}
+
+	// 绑定订阅者时按订阅者的订阅设置投递，忽略频道配置
+	o.cfg.Subscribers = []string{"u1", "u2"}
+	subscribed := func(uid string, intel *Intel) bool { return uid == "u2" && intel.Type == "price" }
+	if !o.match(&Intel{Type: "price", Level: 1}, subscribed) || o.match(&Intel{Type: "news", SubType: "btc", Level: 1}, subscribed) {
+		t.Fatal("output bound to subscribers should follow their subscriptions")
+	}
+}
+
+func TestNewOutputConfig(t *testing.T) {
+	for _, cfg := range []OutputConfig{
+		{Kind: OutputKind_Webhook},
+		{Kind: OutputKind_File},
+		{Kind: OutputKind_Smtp, SmtpAddr: "localhost:25", MailFrom: "a@x"},
+		{Kind: "unknown"},
+	} {
+		if _, err := newOutput(cfg); err == nil {
+			t.Errorf("%+v should be rejected", cfg)
+		}
+	}
+}
+
+func TestWebhookChannelRetry(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		intel := Intel{}
+		b, _ := io.ReadAll(r.Body)
+		if json.Unmarshal(b, &intel) != nil || intel.Seq != 3 || r.Header.Get("X-Key") != "k" {
+			t.Errorf("unexpected request: %s %v", b, r.Header)
+		}
+		if calls == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	c := newWebhookChannel(OutputConfig{Url: srv.URL, Headers: map[string]string{"X-Key": "k"}, Retries: 1})
+	if err := c.deliver(&Intel{Seq: 3}); err != nil || calls != 2 {
+		t.Fatalf("webhook should succeed after retry, err=%v calls=%d", err, calls)
+	}
+}
+
+func TestFileChannel(t *testing.T) {
+	dir := t.TempDir()
+	c := &fileChannel{path: filepath.Join(dir, "sub", "intel_"+outputFileDatePattern+".ndjson")}
+	c.deliver(&Intel{Seq: 1, Type: "news"})
+	c.deliver(&Intel{Seq: 2, Type: "news"})
+
+	path := filepath.Join(dir, "sub", "intel_"+time.Now().Format(time.DateOnly)+".ndjson")
+	b, err := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if err != nil || len(lines) != 2 || !strings.Contains(lines[1], `"seq":2`) {
+		t.Fatalf("unexpected file content: %s err=%v", b, err)
+	}
+}
+
+func TestSmtpMessage(t *testing.T) {
+	c := &smtpChannel{cfg: OutputConfig{MailFrom: "a@x", MailTo: []string{"b@x", "c@x"}, SubjectPrefix: "[intel]"}}
+	msg := c.message(&Intel{Type: "news", SubType: "cn", Title: "标题\r\nBcc: evil@x", Content: "body", Url: "https://x"})
+
+	header, body, _ := strings.Cut(msg, "\r\n\r\n")
+	lines := strings.Split(header, "\r\n")
+	if len(lines) != 5 || lines[1] != "To: b@x, c@x" {
+		t.Fatalf("unexpected header: %q", header)
+	}
+
+	// 标题中的换行不能产生新的邮件头，非ascii字符需要编码
+	subject, ok := strings.CutPrefix(lines[2], "Subject: ")
+	if !ok || !strings.HasPrefix(subject, "=?utf-8?q?") || strings.Contains(header, "\nBcc") {
+		t.Fatalf("subject should be sanitized and encoded: %q", lines[2])
+	}
+
+	if body != "body\r\n\r\nhttps://x" {
+		t.Fatalf("unexpected body: %q", body)
+	}
+}
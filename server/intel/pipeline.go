@@ -0,0 +1,153 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-20 10:07:35
+ * @Description: 情报处理流水线
+ * http请求只负责分配流水号并放入有界队列，之后立即返回，由后台完成存储和推送：
+ * 1. 存储阶段（单个goroutine，按流水号顺序）：写redis、统计、去重聚合判断、实时推送、语音播报队列
+ * 2. 推送阶段（多个worker）：钉钉推送，较慢，不影响存储阶段
+ * 队列满时拒绝新的情报，由接口返回503通知collector稍后重试
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/aztecqt/dagger/util"
+	"github.com/aztecqt/dagger/util/logger"
+)
+
+const (
+	PipelineHeader_QueueDepth    = "X-Intel-Queue-Depth"
+	PipelineHeader_QueueCapacity = "X-Intel-Queue-Capacity"
+)
+
+const (
+	pipelineDefaultQueueSize = 1000
+	pipelineDefaultWorkers   = 4
+	pipelineWarnRatio        = 0.8 // 队列深度超过容量的这个比例时记录警告
+)
+
+// 流水线的运行指标
+type PipelineMetrics struct {
+	QueueDepth     int   `json:"queue_depth"` // 等待存储的情报数量
+	QueueCapacity  int   `json:"queue_capacity"`
+	QueueHighWater int   `json:"queue_high_water"` // 启动以来的最大队列深度
+	DingDepth      int   `json:"ding_depth"`       // 等待钉钉推送的情报数量
+	DingCapacity   int   `json:"ding_capacity"`
+	Workers        int   `json:"workers"`
+	Accepted       int64 `json:"accepted"`
+	Rejected       int64 `json:"rejected"` // 因队列满被拒绝的数量
+	Stored         int64 `json:"stored"`
+	Delivered      int64 `json:"delivered"` // 完成钉钉推送的数量
+}
+
+type intelPipeline struct {
+	queue   chan Intel
+	dingQ   chan Intel
+	workers int
+
+	// 流水号
+	lastSeq int
+	muSeq   sync.Mutex
+
+	highWater int32
+	accepted  int64
+	rejected  int64
+	stored    int64
+	delivered int64
+	warned    int32 // 是否已经对当前这次高水位发出过警告
+}
+
+func (p *intelPipeline) init(lastSeq, queueSize, workers int) {
+	queueSize = util.ValueIf(queueSize > 0, queueSize, pipelineDefaultQueueSize)
+	p.workers = util.ValueIf(workers > 0, workers, pipelineDefaultWorkers)
+	p.queue = make(chan Intel, queueSize)
+	p.dingQ = make(chan Intel, queueSize)
+	p.lastSeq = lastSeq
+}
+
+// 启动后台处理。store按顺序执行，deliver由多个worker并发执行
+func (p *intelPipeline) start(store func(intel *Intel) bool, deliver func(intel Intel)) {
+	go func() {
+		for intel := range p.queue {
+			func() {
+				defer util.DefaultRecover()
+				send := store(&intel)
+				atomic.AddInt64(&p.stored, 1)
+				if send {
+					p.dingQ <- intel
+				}
+			}()
+		}
+	}()
+
+	for i := 0; i < p.workers; i++ {
+		go func() {
+			for intel := range p.dingQ {
+				func() {
+					defer util.DefaultRecover()
+					deliver(intel)
+					atomic.AddInt64(&p.delivered, 1)
+				}()
+			}
+		}()
+	}
+}
+
+// 分配流水号并放入队列。队列满时返回false
+func (p *intelPipeline) submit(intel Intel) (int, bool) {
+	p.muSeq.Lock()
+	defer p.muSeq.Unlock()
+
+	// 只有持有锁的一方向队列写入，检查容量后写入不会阻塞，且队列中的顺序与流水号一致
+	depth := len(p.queue)
+	if depth >= cap(p.queue) {
+		atomic.AddInt64(&p.rejected, 1)
+		return 0, false
+	}
+
+	p.lastSeq++
+	intel.Seq = p.lastSeq
+	p.queue <- intel
+	atomic.AddInt64(&p.accepted, 1)
+
+	depth++
+	if int32(depth) > atomic.LoadInt32(&p.highWater) {
+		atomic.StoreInt32(&p.highWater, int32(depth))
+	}
+
+	if float64(depth) >= float64(cap(p.queue))*pipelineWarnRatio {
+		if atomic.CompareAndSwapInt32(&p.warned, 0, 1) {
+			logger.LogImportant(logPrefix, "intel queue is filling up, depth=%d, capacity=%d", depth, cap(p.queue))
+		}
+	} else if depth == 1 {
+		atomic.StoreInt32(&p.warned, 0)
+	}
+
+	return intel.Seq, true
+}
+
+// 最新分配的流水号
+func (p *intelPipeline) latestSeq() int {
+	p.muSeq.Lock()
+	defer p.muSeq.Unlock()
+	return p.lastSeq
+}
+
+func (p *intelPipeline) metrics() PipelineMetrics {
+	return PipelineMetrics{
+		QueueDepth:     len(p.queue),
+		QueueCapacity:  cap(p.queue),
+		QueueHighWater: int(atomic.LoadInt32(&p.highWater)),
+		DingDepth:      len(p.dingQ),
+		DingCapacity:   cap(p.dingQ),
+		Workers:        p.workers,
+		Accepted:       atomic.LoadInt64(&p.accepted),
+		Rejected:       atomic.LoadInt64(&p.rejected),
+		Stored:         atomic.LoadInt64(&p.stored),
+		Delivered:      atomic.LoadInt64(&p.delivered),
+	}
+}
@@ -0,0 +1,110 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-25 11:05:22
+ * @Description: 情报处理流水线的测试
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestPipelineSubmitBackpressure(t *testing.T) {
+	p := &intelPipeline{}
+	p.init(100, 3, 1)
+
+	for i := 1; i <= 3; i++ {
+		seq, ok := p.submit(Intel{})
+		if !ok || seq != 100+i {
+			t.Fatalf("submit %d: seq=%d ok=%v", i, seq, ok)
+		}
+	}
+
+	// 队列已满，拒绝且不消耗流水号
+	if _, ok := p.submit(Intel{}); ok {
+		t.Fatal("submit should be rejected when queue is full")
+	}
+
+	m := p.metrics()
+	if m.Accepted != 3 || m.Rejected != 1 || m.QueueDepth != 3 || m.QueueHighWater != 3 {
+		t.Fatalf("unexpected metrics: %+v", m)
+	}
+
+	if p.latestSeq() != 103 {
+		t.Fatalf("latest seq should be 103, got %d", p.latestSeq())
+	}
+
+	// 腾出空间后可以继续提交
+	<-p.queue
+	if seq, ok := p.submit(Intel{}); !ok || seq != 104 {
+		t.Fatalf("submit after drain: seq=%d ok=%v", seq, ok)
+	}
+}
+
+func TestPipelineSubmitOrder(t *testing.T) {
+	p := &intelPipeline{}
+	p.init(0, 1000, 1)
+
+	// 并发提交，队列中的顺序应与流水号一致
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				p.submit(Intel{})
+			}
+		}()
+	}
+	wg.Wait()
+
+	close(p.queue)
+	expected := 1
+	for intel := range p.queue {
+		if intel.Seq != expected {
+			t.Fatalf("queue order broken: expected seq %d, got %d", expected, intel.Seq)
+		}
+		expected++
+	}
+
+	if expected != 501 {
+		t.Fatalf("expected 500 intels, got %d", expected-1)
+	}
+}
+
+func TestPipelineStoreOrder(t *testing.T) {
+	p := &intelPipeline{}
+	p.init(0, 100, 2)
+
+	stored := make([]int, 0, 20)
+	delivered := make(chan int, 20)
+	p.start(
+		func(intel *Intel) bool {
+			stored = append(stored, intel.Seq)
+			return intel.Seq%2 == 0 // 只推送偶数流水号
+		},
+		func(intel Intel) { delivered <- intel.Seq })
+
+	for i := 0; i < 20; i++ {
+		p.submit(Intel{})
+	}
+
+	for i := 0; i < 10; i++ {
+		if seq := <-delivered; seq%2 != 0 {
+			t.Fatalf("seq %d should not be delivered", seq)
+		}
+	}
+
+	// 流水号20的推送发生在它的存储之后，此时所有存储已经完成
+	if len(stored) != 20 {
+		t.Fatalf("expected 20 stored, got %d", len(stored))
+	}
+	for i, seq := range stored {
+		if seq != i+1 {
+			t.Fatalf("store order broken at %d: got seq %d", i, seq)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-09-29 09:52:37
+ * @Description: 订阅者的免打扰设置：每日固定的安静时段，以及按频道的临时静音
+ * 静默期间的情报可以丢弃，或者暂存起来等静默结束后一并发送
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aztecqt/dagger/util"
+)
+
+const muteAllChannels = "all" // 静音所有频道
+
+// 每日安静时段，[Start, End)，可以跨越0点
+type quietHours struct {
+	Start    int    `json:"start"`
+	End      int    `json:"end"`
+	Timezone string `json:"tz"`
+
+	loc *time.Location // 由Timezone解析，设置和加载时解析一次
+}
+
+func (q *quietHours) UnmarshalJSON(b []byte) error {
+	type rawQuietHours quietHours
+	if err := json.Unmarshal(b, (*rawQuietHours)(q)); err != nil {
+		return err
+	}
+
+	q.resolveLocation()
+	return nil
+}
+
+func (q *quietHours) resolveLocation() {
+	q.loc = time.Local
+	if len(q.Timezone) > 0 {
+		if loc, err := time.LoadLocation(q.Timezone); err == nil {
+			q.loc = loc
+		}
+	}
+}
+
+// 解析 "23-8" 格式的时段
+func parseQuietHours(str, tz string) (*quietHours, error) {
+	start, end, ok := strings.Cut(str, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid quiet hours `%s`, should be like 23-8", str)
+	}
+
+	qh := new(quietHours)
+	var ok1, ok2 bool
+	qh.Start, ok1 = util.String2Int(start)
+	qh.End, ok2 = util.String2Int(end)
+	if !ok1 || !ok2 || qh.Start < 0 || qh.Start > 23 || qh.End < 0 || qh.End > 23 || qh.Start == qh.End {
+		return nil, fmt.Errorf("invalid quiet hours `%s`, should be like 23-8", str)
+	}
+
+	if len(tz) > 0 {
+		if _, err := time.LoadLocation(tz); err != nil {
+			return nil, fmt.Errorf("invalid timezone `%s`", tz)
+		}
+		qh.Timezone = tz
+	}
+
+	qh.resolveLocation()
+	return qh, nil
+}
+
+func (q *quietHours) location() *time.Location {
+	if q.loc != nil {
+		return q.loc
+	}
+	return time.Local
+}
+
+func (q *quietHours) active(now time.Time) bool {
+	h := now.In(q.location()).Hour()
+	if q.Start < q.End {
+		return h >= q.Start && h < q.End
+	} else {
+		return h >= q.Start || h < q.End
+	}
+}
+
+func (q *quietHours) string() string {
+	return fmt.Sprintf("%02d:00-%02d:00 (%s)", q.Start, q.End, q.location().String())
+}
+
+// 解析静音时长，在time.ParseDuration的基础上支持天，如1d
+func parseMuteDuration(str string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(str, "d"); ok {
+		if n, ok := util.String2Int(days); ok && n > 0 {
+			return time.Hour * 24 * time.Duration(n), nil
+		}
+	}
+
+	d, err := time.ParseDuration(str)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration `%s`, should be like 30m/2h/1d", str)
+	}
+	return d, nil
+}
+
+// 用户当前是否对某频道静默（安静时段或静音）
+func (d *dingUserTypeFilter) silenced(mainType string, now time.Time) bool {
+	if d.QuietHours != nil && d.QuietHours.active(now) {
+		return true
+	}
+
+	return d.muted(mainType, now)
+}
+
+// 用户当前是否静音了某频道
+func (d *dingUserTypeFilter) muted(mainType string, now time.Time) bool {
+	for _, ch := range []string{mainType, muteAllChannels} {
+		if until, ok := d.Mutes[ch]; ok && now.Before(until) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// 用户当前是否处于任何形式的静默中
+func (d *dingUserTypeFilter) silencedAny(now time.Time) bool {
+	if d.QuietHours != nil && d.QuietHours.active(now) {
+		return true
+	}
+
+	for _, until := range d.Mutes {
+		if now.Before(until) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (d *dingUserTypeFilter) quietStr(now time.Time) string {
+	sb := strings.Builder{}
+	if d.QuietHours != nil {
+		sb.WriteString(fmt.Sprintf("安静时段:%s\n", d.QuietHours.string()))
+	}
+
+	for ch, until := range d.Mutes {
+		if now.Before(until) {
+			sb.WriteString(fmt.Sprintf("静音[%s]至%s\n", ch, until.Format(time.DateTime)))
+		}
+	}
+
+	if sb.Len() > 0 {
+		sb.WriteString(fmt.Sprintf("静默期间的情报:%s\n", util.ValueIf(d.HoldMuted, "暂存，结束后发送", "丢弃")))
+	}
+	return sb.String()
+}
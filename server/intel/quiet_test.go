@@ -0,0 +1,88 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-25 14:02:33
+ * @Description: 免打扰设置的测试
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseQuietHours(t *testing.T) {
+	for _, str := range []string{"23", "23-23", "24-8", "-1-8", "a-8", "8-"} {
+		if _, err := parseQuietHours(str, ""); err == nil {
+			t.Errorf("`%s` should be invalid", str)
+		}
+	}
+
+	if _, err := parseQuietHours("23-8", "Not/AZone"); err == nil {
+		t.Error("invalid timezone should be rejected")
+	}
+
+	qh, err := parseQuietHours("23-8", "Asia/Shanghai")
+	if err != nil || qh.Start != 23 || qh.End != 8 || qh.location().String() != "Asia/Shanghai" {
+		t.Fatalf("qh=%+v err=%v", qh, err)
+	}
+}
+
+func TestQuietHoursActive(t *testing.T) {
+	day := func(h, m int) time.Time { return time.Date(2023, 10, 25, h, m, 0, 0, time.UTC) }
+
+	// 同一天内的时段
+	qh, _ := parseQuietHours("12-14", "UTC")
+	cases := map[time.Time]bool{day(11, 59): false, day(12, 0): true, day(13, 59): true, day(14, 0): false}
+	for now, expected := range cases {
+		if qh.active(now) != expected {
+			t.Errorf("12-14 at %s: expected %v", now.Format(time.TimeOnly), expected)
+		}
+	}
+
+	// 跨越0点的时段
+	qh, _ = parseQuietHours("23-8", "UTC")
+	cases = map[time.Time]bool{day(22, 59): false, day(23, 0): true, day(0, 0): true, day(7, 59): true, day(8, 0): false, day(12, 0): false}
+	for now, expected := range cases {
+		if qh.active(now) != expected {
+			t.Errorf("23-8 at %s: expected %v", now.Format(time.TimeOnly), expected)
+		}
+	}
+}
+
+func TestQuietHoursTimezone(t *testing.T) {
+	// UTC 15:00 即上海时间 23:00
+	qh, _ := parseQuietHours("23-8", "Asia/Shanghai")
+	now := time.Date(2023, 10, 25, 15, 0, 0, 0, time.UTC)
+	if !qh.active(now) {
+		t.Fatal("quiet hours should be evaluated in its own timezone")
+	}
+
+	// 从文件加载时同样解析时区
+	loaded := new(quietHours)
+	b, _ := json.Marshal(qh)
+	if err := json.Unmarshal(b, loaded); err != nil || !loaded.active(now) || loaded.active(now.Add(-time.Hour)) {
+		t.Fatalf("loaded quiet hours broken: %+v err=%v", loaded, err)
+	}
+}
+
+func TestSilenced(t *testing.T) {
+	now := time.Date(2023, 10, 25, 12, 0, 0, 0, time.UTC)
+	d := &dingUserTypeFilter{Mutes: map[string]time.Time{"news": now.Add(time.Hour)}}
+	if !d.silenced("news", now) || d.silenced("price", now) || d.silenced("news", now.Add(time.Hour)) {
+		t.Fatal("channel mute broken")
+	}
+
+	d.Mutes[muteAllChannels] = now.Add(time.Minute)
+	if !d.muted("price", now) || !d.silencedAny(now) {
+		t.Fatal("mute all broken")
+	}
+
+	d = &dingUserTypeFilter{}
+	d.QuietHours, _ = parseQuietHours("11-13", "UTC")
+	if !d.silenced("price", now) || d.muted("price", now) {
+		t.Fatal("quiet hours should silence but not mute")
+	}
+}
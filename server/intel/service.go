@@ -17,6 +17,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/aztecqt/center_server/dingbot"
 	"github.com/aztecqt/center_server/server/web"
@@ -27,6 +29,10 @@ import (
 
 const logPrefix = "service-intel"
 const picIdGlobal = "@lALPDeREZUXvbJDNAgDNAgA"
+const groupKeyPrefix = "group:" // 群订阅者的key前缀
+
+// 群里所有成员都可以执行的命令，其余命令只有群管理员可以执行
+var groupReadonlyCmds = map[string]bool{"help": true, "ls": true, "my": true, "stats": true, "find": true, "show": true}
 
 const (
 	IntelRedisKey_Status      = "intel_status"
@@ -36,44 +42,200 @@ const (
 
 type Service struct {
 	// 钉钉用户的订阅和过滤
-	filter   *dingFilter
-	menu     map[string]IntelMenu // 所有可供订阅的情报类型\子类型
-	menuKeys []string
+	filter *dingFilter
+	menu   *intelMenuBook // 所有可供订阅的情报类型\子类型
 
 	// 用于接受机器人消息时的验证
 	dingBotSecret string
 
+	// 用于collector上报时的验证
+	auth intelAuth
+
+	// 管理员
+	adminUids  map[string]bool
+	adminToken string
+	templates  map[string][]string
+
 	// 直接发送给钉钉客户端
 	ding         *dingtalk.Notifier
+	work         *dingbot.WorkNotifier // markdown、卡片等消息，为nil时降级为文字消息
 	dingAdminMob int64
 
 	// redis服务器用于暂存接收到的intel，供IntelSpeaker客户端使用
-	rc           *util.RedisClient
-	lastIntelSeq int
+	rc   *util.RedisClient
+	list intelListReader // 读取redis中的情报列表，用于查询和搜索
+
+	// 情报处理流水线，负责分配流水号
+	pipeline intelPipeline
+
+	// 实时推送
+	stream *web.SSEHub
+
+	// 统计
+	stats intelStats
+
+	// 语音播报
+	tts       ttsQueue
+	ttsStream *web.SSEHub
+
+	// 钉钉以外的投递渠道
+	outputs []*output
+
+	// 钉钉推送前的去重和聚合
+	aggregator *intelAggregator
+
+	// 摘要模式下累积的情报
+	digests         *digestBox
+	digestDailyHour int
 }
 
-func (s *Service) Start(webservice *web.Service, ding *dingtalk.Notifier, rc *util.RedisClient, dingAdminMob int64, dingBotSecret string) {
+func (s *Service) Start(webservice *web.Service, ding *dingtalk.Notifier, work *dingbot.WorkNotifier, rc *util.RedisClient, redisCfg util.RedisConfig, dingAdminMob int64, cfg Config) {
 	s.filter = new(dingFilter)
-	s.filter.init()
+	s.filter.init(newFilterStore(cfg.FilterStore, cfg.FilterFile, rc))
 
-	s.menu = make(map[string]IntelMenu)
+	s.menu = new(intelMenuBook)
+	s.menu.init(cfg.MenuStaleSec)
+	s.stream = web.NewSSEHub()
+	s.tts.init(cfg.TTSStaleSec, cfg.TTSExpireSec, cfg.TTSAckTimeoutSec)
+	s.stats.init()
+	s.ttsStream = web.NewSSEHub()
 
 	s.ding = ding
+	s.work = work
 	s.dingAdminMob = dingAdminMob
-	s.dingBotSecret = dingBotSecret
+	s.dingBotSecret = cfg.DingbotSecret
+	s.auth.init(cfg.Collectors, cfg.AuthTimeWindowSec)
+	s.adminUids = make(map[string]bool)
+	for _, uid := range cfg.AdminUids {
+		s.adminUids[uid] = true
+	}
+	s.adminToken = cfg.AdminToken
+	s.templates = cfg.Templates
+	s.aggregator = newIntelAggregator(cfg.DedupWindowSec, cfg.BurstWindowSec, cfg.BurstThreshold)
+	s.digests = new(digestBox)
+	s.digests.init()
+	s.digestDailyHour = cfg.DigestDailyHour
 
 	// 创建redis连接
 	s.rc = rc
+	if len(redisCfg.Addr) > 0 {
+		s.list = newRedisListReader(redisCfg)
+	}
+	lastSeq := 0
 	if idstr, ok := s.rc.HGet(IntelRedisKey_Status, IntelRedisField_LatestSeq); ok {
-		s.lastIntelSeq = util.String2IntPanic(idstr)
+		lastSeq = util.String2IntPanic(idstr)
 	}
 
+	s.outputs = newOutputs(cfg.Outputs)
+	s.pipeline.init(lastSeq, cfg.QueueSize, cfg.Workers)
+	s.pipeline.start(s.storeIntel, s.sendToDing)
+
 	webservice.RegisterPath("/intel/new", s.onNewIntel)
 	webservice.RegisterPath("/intel/menu", s.onNewIntelMenu)
+	webservice.RegisterPath("/intel/batch", s.onHttpIntelBatch)
+	webservice.RegisterPath("/intel/list", s.onHttpIntelList)
+	webservice.RegisterPath("/intel/get", s.onHttpIntelGet)
+	webservice.RegisterPath("/intel/stream", s.onHttpIntelStream)
+	webservice.RegisterPath("/intel/stats", s.onHttpIntelStats)
+	webservice.RegisterPath("/intel/pipeline", s.onHttpIntelPipeline)
+	webservice.RegisterPath("/intel/tts/register", s.onHttpTTSRegister)
+	webservice.RegisterPath("/intel/tts/pull", s.onHttpTTSPull)
+	webservice.RegisterPath("/intel/tts/stream", s.onHttpTTSStream)
+	webservice.RegisterPath("/intel/tts/ack", s.onHttpTTSAck)
+	webservice.RegisterPath("/intel/admin/subscribers", s.onHttpAdminSubscribers)
+	webservice.RegisterPath("/intel/admin/templates", s.onHttpAdminTemplates)
+	webservice.RegisterPath("/intel/admin/apply", s.onHttpAdminApply)
+	webservice.RegisterPath("/intel/admin/copy", s.onHttpAdminCopy)
+	webservice.RegisterPath("/intel/admin/export", s.onHttpAdminExport)
+	webservice.RegisterPath("/intel/admin/import", s.onHttpAdminImport)
 	webservice.RegisterPath("/dingbots/message_assist", s.onDingMessage_MessageAssist)
+	go s.update()
 	logger.LogImportant(logPrefix, "started")
 }
 
+func (s *Service) update() {
+	ticker := time.NewTicker(time.Second)
+	lastTime := time.Now()
+	for {
+		<-ticker.C
+		now := time.Now()
+
+		// 推送窗口已结束的聚合消息
+		func() {
+			defer util.DefaultRecover()
+			for _, summary := range s.aggregator.update() {
+				s.sendToDing(summary)
+			}
+		}()
+
+		// 整点发送摘要
+		func() {
+			defer util.DefaultRecover()
+			if lastTime.Hour() != now.Hour() {
+				s.sendDigests(DeliveryMode_Hourly, false)
+				if now.Hour() == s.digestDailyHour {
+					s.sendDigests(DeliveryMode_Daily, false)
+				}
+
+				if report := s.auth.takeRejectReport(); len(report) > 0 {
+					s.ding.SendTextByMob(report, s.dingAdminMob)
+				}
+			}
+		}()
+
+		// 静默结束的用户，发送暂存的情报，以及安静时段内到点的摘要，保存摘要和订阅数据
+		// 检查过期菜单，保存自动发现的子频道
+		// 丢弃过期的语音播报，保存统计数据
+		if lastTime.Minute() != now.Minute() {
+			func() {
+				defer util.DefaultRecover()
+				s.sendDigests(DeliveryMode_Held, false)
+				s.sendDigests(DeliveryMode_Hourly, true)
+				s.sendDigests(DeliveryMode_Daily, true)
+				s.digests.flush()
+				s.filter.flush()
+			}()
+
+			func() {
+				defer util.DefaultRecover()
+				for _, e := range s.menu.takeNewlyStale() {
+					msg := fmt.Sprintf("情报频道[%s]已超过%s未上报菜单\n来源:%s\n上次上报:%s",
+						e.Menu.Type, s.menu.staleDuration.String(), e.Source, e.AnnounceTime.Format(time.DateTime))
+					logger.LogImportant(logPrefix, msg)
+					s.ding.SendTextByMob(msg, s.dingAdminMob)
+				}
+				s.menu.flush()
+			}()
+
+			func() {
+				defer util.DefaultRecover()
+				s.tts.cleanup()
+				s.stats.flush()
+			}()
+		}
+
+		lastTime = now
+	}
+}
+
+// 发送某种模式下累积的摘要，dueOnly为true时只补发之前因安静时段而跳过的摘要
+// 暂存的情报要等所有静默结束才发送，摘要只避开安静时段
+func (s *Service) sendDigests(mode string, dueOnly bool) {
+	skip := s.filter.userInQuietHours
+	if mode == DeliveryMode_Held {
+		skip = s.filter.userSilencedAny
+	}
+
+	texts := s.digests.take(mode, dueOnly, skip)
+	for uid, text := range texts {
+		s.sendTextToSubscriber(text, uid)
+	}
+
+	if len(texts) > 0 {
+		logger.LogInfo(logPrefix, "%s digests sent to %d users", mode, len(texts))
+	}
+}
+
 func (s *Service) onDingMessage_MessageAssist(w http.ResponseWriter, r *http.Request) {
 	defer util.DefaultRecover()
 
@@ -92,109 +254,259 @@ func (s *Service) onDingMessage_MessageAssist(w http.ResponseWriter, r *http.Req
 		msg.Text.Content,
 		msg.Webhook)
 
-	// 仅支持单聊
+	content := strings.TrimSpace(msg.Text.Content)
 	if msg.ConversationType == "1" {
-		cmd := fmt.Sprintf("%s %s %s", msg.Text.Content, msg.SenderUserId, msg.SenderNick)
-		s.OnCommand(cmd, func(s string) {
+		// 单聊，以用户身份执行命令
+		s.OnCommand(content, msg.SenderUserId, msg.SenderNick, func(s string) {
 			dingbot.ReplayTextMsg(s, msg.Webhook)
 		})
 	} else {
-		dingbot.ReplayTextMsg("请私聊", msg.Webhook)
+		// 群聊，以群的身份执行命令。只有群管理员可以修改群订阅
+		gid := groupKeyPrefix + msg.ConversationId
+		title := strings.ReplaceAll(msg.ConversationTitle, " ", "_")
+		s.filter.groupUpdateSession(gid, title, msg.Webhook, msg.WebhookExpireTs)
+
+		op, _, _ := strings.Cut(content, " ")
+		if !msg.IsAdmin && !groupReadonlyCmds[op] {
+			dingbot.ReplayTextMsg("只有群管理员可以修改群订阅", msg.Webhook)
+		} else {
+			s.OnCommand(content, gid, title, func(s string) {
+				dingbot.ReplayTextMsg(s, msg.Webhook)
+			})
+		}
 	}
 
 	io.WriteString(w, "acknowledged")
 }
 
+// 读取完整的请求体并验证collector身份。失败时已写入错误应答
+func (s *Service) readIntelBody(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, string, bool) {
+	if r.Method != "POST" {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return nil, "", false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		logger.LogImportant(logPrefix, "read body error, err=%s", err.Error())
+		http.Error(w, "read body error", http.StatusBadRequest)
+		return nil, "", false
+	}
+
+	if int64(len(body)) > limit {
+		http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+		return nil, "", false
+	}
+
+	collector, ok := s.auth.verify(r, body)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return nil, "", false
+	}
+
+	return body, collector, true
+}
+
+// 验证读接口的请求，管理令牌也可以通过。失败时已写入错误应答
+func (s *Service) checkReader(w http.ResponseWriter, r *http.Request) bool {
+	if s.adminTokenValid(r) {
+		return true
+	}
+
+	if _, ok := s.auth.verifyRead(r); !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
 func (s *Service) onNewIntelMenu(w http.ResponseWriter, r *http.Request) {
 	defer util.DefaultRecover()
-	if r.Method == "POST" {
-		// TODO:加密验证?
-		menu := IntelMenu{}
-		body := make([]byte, 1024*128)
-		n, err := r.Body.Read(body)
-		if err == nil || err == io.EOF {
-			err = json.Unmarshal(body[:n], &menu)
-			if err != nil {
-				logger.LogImportant(logPrefix, "parse body error, err=%s", err.Error())
-				io.WriteString(w, "internal error")
-			}
+	body, collector, ok := s.readIntelBody(w, r, maxBodySize)
+	if !ok {
+		return
+	}
 
-			// 解析成功，记录这个menu
-			io.WriteString(w, "ok")
-			s.menu[menu.Type] = menu
-			keys := make([]string, 0, len(s.menu))
-			for k := range s.menu {
-				keys = append(keys, k)
-			}
-			s.menuKeys = keys
-		} else {
-			logger.LogImportant(logPrefix, "read body error, err=%s", err.Error())
-			io.WriteString(w, "internal error")
-		}
+	menu := IntelMenu{}
+	if err := json.Unmarshal(body, &menu); err != nil {
+		logger.LogImportant(logPrefix, "parse body error, err=%s", err.Error())
+		http.Error(w, "parse body error", http.StatusBadRequest)
+		return
+	}
+
+	if len(menu.Type) == 0 {
+		http.Error(w, "missing type", http.StatusBadRequest)
+		return
 	}
+
+	// 解析成功，记录这个menu
+	source := util.ValueIf(len(collector) > 0, collector, menu.Source)
+	source = util.ValueIf(len(source) > 0, source, r.RemoteAddr)
+	s.menu.announce(menu, source)
+	io.WriteString(w, "ok")
 }
 
 func (s *Service) onNewIntel(w http.ResponseWriter, r *http.Request) {
 	defer util.DefaultRecover()
-	if r.Method == "POST" {
-		// TODO:加密验证?
-		intel := Intel{}
-		body := make([]byte, 1024*128)
-		n, err := r.Body.Read(body)
-		if err == nil || err == io.EOF {
-			err = json.Unmarshal(body[:n], &intel)
-			if err != nil {
-				logger.LogImportant(logPrefix, "parse body error, err=%s", err.Error())
-				io.WriteString(w, "internal error")
-			}
+	body, _, ok := s.readIntelBody(w, r, maxBodySize)
+	if !ok {
+		return
+	}
 
-			// 解析成功，处理这个intel
-			io.WriteString(w, "ok")
-			s.processIntel(intel)
-		} else {
-			logger.LogImportant(logPrefix, "read body error, err=%s", err.Error())
-			io.WriteString(w, "internal error")
-		}
+	intel, err := parseIntel(body)
+	if err != nil {
+		logger.LogImportant(logPrefix, "invalid intel, err=%s", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 解析成功，放入流水线
+	s.writePipelineHeaders(w)
+	if _, ok := s.submitIntel(intel); !ok {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "queue full", http.StatusServiceUnavailable)
+		return
 	}
+	io.WriteString(w, "ok")
 }
 
-func (s *Service) processIntel(intel Intel) {
+// 在应答中附带流水线的队列深度，供collector调整发送速度
+func (s *Service) writePipelineHeaders(w http.ResponseWriter) {
+	m := s.pipeline.metrics()
+	w.Header().Set(PipelineHeader_QueueDepth, fmt.Sprintf("%d", m.QueueDepth))
+	w.Header().Set(PipelineHeader_QueueCapacity, fmt.Sprintf("%d", m.QueueCapacity))
+}
+
+// 解析并检查一条上报的情报，单条和批量上报共用
+func parseIntel(b []byte) (Intel, error) {
+	intel := Intel{}
+	if err := json.Unmarshal(b, &intel); err != nil {
+		return intel, fmt.Errorf("parse error: %s", err.Error())
+	}
+
+	if len(intel.Type) == 0 {
+		return intel, fmt.Errorf("missing type")
+	}
+	return intel, nil
+}
+
+// 把情报提交到处理流水线，返回分配的流水号。队列满时返回false
+func (s *Service) submitIntel(intel Intel) (int, bool) {
+	// 没有时间的情报无法按时间查询和搜索，以收到的时间为准
+	if intel.Time.IsZero() {
+		intel.Time = time.Now()
+	}
+
 	if intel.Level == 0 {
 		intel.Content = fmt.Sprintf("%s\n[debug]", intel.Content)
 	}
+	return s.pipeline.submit(intel)
+}
 
-	// 分配流水号
-	s.lastIntelSeq++
-	intel.Seq = s.lastIntelSeq
+// 流水线的存储阶段，按流水号顺序执行。返回是否需要推送给钉钉
+func (s *Service) storeIntel(intel *Intel) bool {
+	s.menu.observe(intel)
+	s.stats.recordIntel(intel)
 
-	b, _ := json.Marshal(intel)
-	logger.LogInfo(logPrefix, "processing intel: %s", string(b))
+	str := intelJson(*intel)
+	logger.LogInfo(logPrefix, "processing intel: %s", str)
 
-	// 发给钉钉
+	// 是否发给钉钉
+	send := false
 	if len(intel.DingType) > 0 {
-		if intel.Level == 0 {
-			// 只发送给管理员
-			if intel.DingType == DingType_Link {
-				s.ding.SendLinkByMob(intel.Url, picIdGlobal, intel.Title, intel.Content, s.dingAdminMob)
-			} else if intel.DingType == DingType_Text {
-				s.ding.SendTextByMob(intel.Title+"\n"+intel.Content, s.dingAdminMob)
-			}
+		if s.aggregator.filter(intel) {
+			send = true
 		} else {
-			// 发送给订阅者
-			uids := s.filter.findMatchedUsers(intel.Type, intel.SubType)
-			if intel.DingType == DingType_Link {
-				s.ding.SendLinkByUid(intel.Url, picIdGlobal, intel.Title, intel.Content, uids...)
-			} else if intel.DingType == DingType_Text {
-				s.ding.SendTextByUid(intel.Title+"\n"+intel.Content, uids...)
-			}
+			logger.LogInfo(logPrefix, "intel(seq=%d) deduped or aggregated", intel.Seq)
 		}
-		logger.LogInfo(logPrefix, "send to dingding done")
 	}
 
 	// 保存到redis
-	if _, ok := s.rc.RPush(IntelRedisKey_List, string(b)); ok {
+	if _, ok := s.rc.RPush(IntelRedisKey_List, str); ok {
 		s.rc.HSet(IntelRedisKey_Status, IntelRedisField_LatestSeq, intel.Seq) // 写入最新序列号
 		s.rc.LTrim(IntelRedisKey_List, -50000, -1)                            // 保留一定数量的消息
 	}
 	logger.LogInfo(logPrefix, "save to redis done")
+
+	// 推送给实时订阅者
+	s.stream.Publish(intelToSSEEvent(*intel, str))
+
+	// 放入语音播报队列
+	s.enqueueTTS(intel)
+
+	// 投递给其他渠道
+	for _, o := range s.outputs {
+		o.enqueue(intel, s.filter.userSubscribed)
+	}
+	return send
+}
+
+// 把情报推送给钉钉
+func (s *Service) sendToDing(intel Intel) {
+	if intel.Level == 0 {
+		// 只发送给管理员
+		s.sendIntelToAdmin(&intel)
+	} else {
+		// 发送给订阅者，摘要模式的用户先累积起来
+		uids := make([]string, 0)
+		matched, silenced := s.filter.findMatchedUsers(&intel)
+		for uid, mode := range matched {
+			if mode == DeliveryMode_Immediate {
+				uids = append(uids, uid)
+			} else {
+				s.digests.add(uid, mode, intel)
+			}
+		}
+
+		// 静默中的用户，按设置暂存或丢弃
+		for uid, hold := range silenced {
+			if hold {
+				s.digests.add(uid, DeliveryMode_Held, intel)
+			}
+		}
+
+		// 群订阅者通过webhook发送
+		users := make([]string, 0, len(uids))
+		for _, uid := range uids {
+			if isGroup, webhook := s.filter.groupInfo(uid); isGroup {
+				if len(webhook) == 0 {
+					logger.LogImportant(logPrefix, "group %s has no available webhook, intel(seq=%d) not delivered", uid, intel.Seq)
+				} else {
+					s.sendIntelToWebhook(&intel, webhook)
+					s.stats.recordDelivery(uid)
+				}
+			} else {
+				users = append(users, uid)
+			}
+		}
+
+		if len(users) == 0 {
+			return
+		}
+
+		s.sendIntelToUsers(&intel, users)
+		s.stats.recordDelivery(users...)
+	}
+	logger.LogInfo(logPrefix, "send to dingding done")
+}
+
+// 给单个订阅者（用户或群）发送文字消息
+func (s *Service) sendTextToSubscriber(text, uid string) {
+	if isGroup, webhook := s.filter.groupInfo(uid); isGroup {
+		if len(webhook) > 0 {
+			dingbot.SendTextToWebhook(webhook, text)
+			s.stats.recordDelivery(uid)
+		} else {
+			logger.LogImportant(logPrefix, "group %s has no available webhook", uid)
+		}
+	} else {
+		s.ding.SendTextByUid(text, uid)
+		s.stats.recordDelivery(uid)
+	}
+}
+
+func intelJson(intel Intel) string {
+	b, _ := json.Marshal(intel)
+	return string(b)
 }
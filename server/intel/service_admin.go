@@ -0,0 +1,296 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-16 14:37:20
+ * @Description: 管理员命令和管理http接口
+ * 钉钉命令只有配置在admin_uids中的用户可以执行；http接口需要在请求头中带上admin_token
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/aztecqt/dagger/util"
+	"github.com/aztecqt/dagger/util/logger"
+)
+
+const AdminHeader_Token = "X-Intel-Admin-Token"
+const maxImportBodySize = 1024 * 1024 * 16
+
+// 管理员命令
+var adminCmds = map[string]bool{"subs": true, "tpl": true, "apply": true, "cp": true}
+
+func (c *Service) isAdmin(uid string) bool {
+	return c.adminUids[uid]
+}
+
+func (c *Service) adminHelpStr() string {
+	sb := strings.Builder{}
+	sb.WriteString("管理员命令：\n")
+	sb.WriteString("subs [chName] (查看各频道的订阅者)\n")
+	sb.WriteString("tpl (查看所有订阅模板)\n")
+	sb.WriteString("apply <tplName> <uid> [uid...] (给用户套用订阅模板)\n")
+	sb.WriteString("cp <fromUid> <toUid> (把一个用户的订阅设置复制给另一个用户)\n")
+	return sb.String()
+}
+
+func (c *Service) onCmdSubscribers(splited []string, onResp func(string)) {
+	mainType := ""
+	if len(splited) >= 2 {
+		mainType = c.tryConvertFromIndexToMainType(splited[1])
+	}
+
+	subs := c.filter.subscribersByChannel(mainType)
+	if len(subs) == 0 {
+		onResp("没有订阅者")
+		return
+	}
+
+	channels := make([]string, 0, len(subs))
+	for ch := range subs {
+		channels = append(channels, ch)
+	}
+	sort.Strings(channels)
+
+	sb := strings.Builder{}
+	for _, ch := range channels {
+		sb.WriteString(fmt.Sprintf("*[%s] %d个订阅者\n", ch, len(subs[ch])))
+		for _, s := range subs[ch] {
+			sb.WriteString(fmt.Sprintf("  %s\n", s.String()))
+		}
+	}
+	onResp(sb.String())
+}
+
+func (c *Service) onCmdTemplates(onResp func(string)) {
+	if len(c.templates) == 0 {
+		onResp("没有配置订阅模板")
+		return
+	}
+
+	names := make([]string, 0, len(c.templates))
+	for name := range c.templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sb := strings.Builder{}
+	for _, name := range names {
+		sb.WriteString(fmt.Sprintf("%s: %s\n", name, strings.Join(c.templates[name], ",")))
+	}
+	onResp(sb.String())
+}
+
+func (c *Service) onCmdApplyTemplate(splited []string, uid string, onResp func(string)) {
+	if len(splited) < 3 {
+		onResp(fmt.Sprintf("not enough param for command `apply`, type help for more info"))
+		return
+	}
+
+	msg, ok := c.applyTemplate(splited[1], splited[2:])
+	if ok {
+		logger.LogImportant(logPrefix, "admin %s: %s", uid, msg)
+	}
+	onResp(msg)
+}
+
+func (c *Service) onCmdCopyFilter(splited []string, uid string, onResp func(string)) {
+	if len(splited) < 3 {
+		onResp(fmt.Sprintf("not enough param for command `cp`, type help for more info"))
+		return
+	}
+
+	if err := c.filter.copyUserFilter(splited[1], splited[2]); err != nil {
+		onResp(err.Error())
+	} else {
+		logger.LogImportant(logPrefix, "admin %s: copied filter from %s to %s", uid, splited[1], splited[2])
+		onResp(fmt.Sprintf("已将[%s]的订阅设置复制给[%s]", splited[1], splited[2]))
+	}
+}
+
+// 给一组用户套用模板
+func (c *Service) applyTemplate(tplName string, uids []string) (string, bool) {
+	entries, ok := c.templates[tplName]
+	if !ok {
+		return fmt.Sprintf("订阅模板[%s]不存在", tplName), false
+	}
+
+	for _, uid := range uids {
+		c.filter.applyTemplate(uid, entries)
+	}
+	return fmt.Sprintf("已给%s套用订阅模板[%s]", strings.Join(uids, ","), tplName), true
+}
+
+// 请求是否带有正确的管理令牌
+func (s *Service) adminTokenValid(r *http.Request) bool {
+	return len(s.adminToken) > 0 && hmac.Equal([]byte(r.Header.Get(AdminHeader_Token)), []byte(s.adminToken))
+}
+
+// 验证管理接口的令牌。失败时已写入错误应答
+func (s *Service) checkAdminToken(w http.ResponseWriter, r *http.Request) bool {
+	if len(s.adminToken) == 0 {
+		http.Error(w, "admin api disabled", http.StatusForbidden)
+		return false
+	}
+
+	if !s.adminTokenValid(r) {
+		logger.LogImportant(logPrefix, "rejected admin request %s from %s", r.URL.Path, r.RemoteAddr)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+func writeJson(w http.ResponseWriter, obj interface{}) {
+	b, _ := json.Marshal(obj)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// GET /intel/admin/subscribers?type=xxx
+// 返回频道->订阅者列表，type为空时返回所有频道
+func (s *Service) onHttpAdminSubscribers(w http.ResponseWriter, r *http.Request) {
+	defer util.DefaultRecover()
+	if !s.checkAdminToken(w, r) {
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJson(w, s.filter.subscribersByChannel(r.URL.Query().Get("type")))
+}
+
+// GET /intel/admin/templates
+func (s *Service) onHttpAdminTemplates(w http.ResponseWriter, r *http.Request) {
+	defer util.DefaultRecover()
+	if !s.checkAdminToken(w, r) {
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJson(w, s.templates)
+}
+
+// POST /intel/admin/apply?template=xxx&uids=uid1,uid2
+func (s *Service) onHttpAdminApply(w http.ResponseWriter, r *http.Request) {
+	defer util.DefaultRecover()
+	if !s.checkAdminToken(w, r) {
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	uids := splitParam(q.Get("uids"))
+	if len(uids) == 0 {
+		http.Error(w, "missing uids", http.StatusBadRequest)
+		return
+	}
+
+	tplName := q.Get("template")
+	if _, ok := s.templates[tplName]; !ok {
+		http.Error(w, "template not found", http.StatusNotFound)
+		return
+	}
+
+	msg, _ := s.applyTemplate(tplName, uids)
+	logger.LogImportant(logPrefix, "admin api from %s: %s", r.RemoteAddr, msg)
+	io.WriteString(w, "ok")
+}
+
+// POST /intel/admin/copy?from=uid1&to=uid2
+func (s *Service) onHttpAdminCopy(w http.ResponseWriter, r *http.Request) {
+	defer util.DefaultRecover()
+	if !s.checkAdminToken(w, r) {
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	from, to := q.Get("from"), q.Get("to")
+	if len(from) == 0 || len(to) == 0 {
+		http.Error(w, "missing from/to", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.filter.copyUserFilter(from, to); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	logger.LogImportant(logPrefix, "admin api from %s: copied filter from %s to %s", r.RemoteAddr, from, to)
+	io.WriteString(w, "ok")
+}
+
+// GET /intel/admin/export
+// 导出全部订阅数据，格式与ding_filter.json相同
+func (s *Service) onHttpAdminExport(w http.ResponseWriter, r *http.Request) {
+	defer util.DefaultRecover()
+	if !s.checkAdminToken(w, r) {
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(s.filter.exportJson())
+}
+
+// POST /intel/admin/import?mode=merge|replace
+// body为导出的订阅数据。merge：覆盖同uid的用户，保留其他用户；replace：替换全部数据
+func (s *Service) onHttpAdminImport(w http.ResponseWriter, r *http.Request) {
+	defer util.DefaultRecover()
+	if !s.checkAdminToken(w, r) {
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxImportBodySize+1))
+	if err != nil {
+		http.Error(w, "read body error", http.StatusBadRequest)
+		return
+	}
+
+	if len(body) > maxImportBodySize {
+		http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	n, err := s.filter.importJson(body, r.URL.Query().Get("mode"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	logger.LogImportant(logPrefix, "admin api from %s: imported %d users", r.RemoteAddr, n)
+	io.WriteString(w, fmt.Sprintf("imported %d users", n))
+}
@@ -0,0 +1,76 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-26 09:48:15
+ * @Description: 管理员命令权限的测试
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestAdminService() *Service {
+	return &Service{
+		adminUids: map[string]bool{"admin01": true},
+		templates: map[string][]string{"basic": {"news"}},
+	}
+}
+
+func TestAdminCmdRejected(t *testing.T) {
+	s := newTestAdminService()
+
+	// 昵称中带有管理员uid和空格，不能冒充管理员
+	for _, nick := range []string{"admin01 x", "x admin01", "admin01"} {
+		resp := ""
+		s.OnCommand("tpl", "user01", nick, func(str string) { resp = str })
+		if resp != "只有管理员可以执行该命令" {
+			t.Errorf("nick=%q: admin command should be rejected, got %q", nick, resp)
+		}
+	}
+
+	// 命令参数中的uid同样不能冒充
+	resp := ""
+	s.OnCommand("tpl admin01 nick", "user01", "nick", func(str string) { resp = str })
+	if resp != "只有管理员可以执行该命令" {
+		t.Errorf("admin command should be rejected, got %q", resp)
+	}
+}
+
+func TestAdminCmdAccepted(t *testing.T) {
+	s := newTestAdminService()
+	resp := ""
+	s.OnCommand("tpl", "admin01", "nick with spaces", func(str string) { resp = str })
+	if !strings.Contains(resp, "basic: news") {
+		t.Fatalf("admin should list templates, got %q", resp)
+	}
+}
+
+func newTokenRequest(token string) *http.Request {
+	r := httptest.NewRequest("GET", "/intel/admin/templates", nil)
+	if len(token) > 0 {
+		r.Header.Set(AdminHeader_Token, token)
+	}
+	return r
+}
+
+func TestAdminTokenValid(t *testing.T) {
+	s := &Service{}
+	s.adminToken = "token"
+	for token, expected := range map[string]bool{"token": true, "Token": false, "": false, "token1": false} {
+		r := newTokenRequest(token)
+		if s.adminTokenValid(r) != expected {
+			t.Errorf("token=%q: expected %v", token, expected)
+		}
+	}
+
+	// 没有配置令牌时一律拒绝
+	s.adminToken = ""
+	if s.adminTokenValid(newTokenRequest("")) {
+		t.Error("empty admin token should reject all requests")
+	}
+}
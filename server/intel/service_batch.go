@@ -0,0 +1,135 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-12 09:48:31
+ * @Description: 批量上报情报。body可以是情报的json数组，也可以是每行一条情报的NDJSON
+ * 每条情报单独解析和处理，返回逐条的结果
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aztecqt/dagger/util"
+	"github.com/aztecqt/dagger/util/logger"
+)
+
+// 处理队列已满，collector应稍后重试
+const BatchError_QueueFull = "queue full"
+
+// 批量请求中一条情报的处理结果
+type BatchItemResult struct {
+	Index int    `json:"index"` // 在请求中的序号，从0开始
+	Ok    bool   `json:"ok"`
+	Seq   int    `json:"seq,omitempty"` // 分配的流水号
+	Error string `json:"error,omitempty"`
+}
+
+// /intel/batch 的返回内容
+type BatchResp struct {
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Results  []BatchItemResult `json:"results"`
+}
+
+// 把body拆分成单条情报的原始json
+func splitBatchBody(body []byte, contentType string) ([]json.RawMessage, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 {
+		return nil, fmt.Errorf("empty body")
+	}
+
+	// json数组
+	if trimmed[0] == '[' && !strings.Contains(contentType, "ndjson") {
+		items := make([]json.RawMessage, 0)
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			return nil, err
+		}
+		return items, nil
+	}
+
+	// NDJSON，忽略空行
+	items := make([]json.RawMessage, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(trimmed))
+	scanner.Buffer(make([]byte, 0, 64*1024), maxBodySize)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) > 0 {
+			items = append(items, json.RawMessage(append([]byte(nil), line...)))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+// POST /intel/batch
+// 全部成功返回200，部分成功返回207，全部失败返回400（全部因队列满而失败时返回503），body均为BatchResp
+func (s *Service) onHttpIntelBatch(w http.ResponseWriter, r *http.Request) {
+	defer util.DefaultRecover()
+	body, collector, ok := s.readIntelBody(w, r, maxBatchBodySize)
+	if !ok {
+		return
+	}
+
+	items, err := splitBatchBody(body, r.Header.Get("Content-Type"))
+	if err != nil {
+		logger.LogImportant(logPrefix, "parse batch body error, err=%s", err.Error())
+		http.Error(w, "parse body error", http.StatusBadRequest)
+		return
+	}
+
+	if len(items) > maxBatchSize {
+		http.Error(w, fmt.Sprintf("too many intels, max=%d", maxBatchSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	resp := BatchResp{Results: make([]BatchItemResult, 0, len(items))}
+	full := 0
+	for i, item := range items {
+		rst := BatchItemResult{Index: i}
+		if intel, err := parseIntel(item); err != nil {
+			rst.Error = err.Error()
+		} else if seq, ok := s.submitIntel(intel); !ok {
+			rst.Error = BatchError_QueueFull
+			full++
+		} else {
+			rst.Seq = seq
+			rst.Ok = true
+		}
+
+		if rst.Ok {
+			resp.Accepted++
+		} else {
+			resp.Rejected++
+		}
+		resp.Results = append(resp.Results, rst)
+	}
+
+	logger.LogInfo(logPrefix, "batch from %s: accepted=%d, rejected=%d", util.ValueIf(len(collector) > 0, collector, r.RemoteAddr), resp.Accepted, resp.Rejected)
+
+	status := http.StatusOK
+	if resp.Accepted == 0 && full > 0 {
+		status = http.StatusServiceUnavailable
+		w.Header().Set("Retry-After", "1")
+	} else if resp.Accepted == 0 {
+		status = http.StatusBadRequest
+	} else if resp.Rejected > 0 {
+		status = http.StatusMultiStatus
+	}
+
+	b, _ := json.Marshal(resp)
+	s.writePipelineHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
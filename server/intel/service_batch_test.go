@@ -0,0 +1,95 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-25 11:58:06
+ * @Description: 情报上报请求解析的测试
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSplitBatchBodyArray(t *testing.T) {
+	items, err := splitBatchBody([]byte(` [{"type":"a"}, {"type":"b"}] `), "application/json")
+	if err != nil || len(items) != 2 || string(items[1]) != `{"type":"b"}` {
+		t.Fatalf("items=%v err=%v", items, err)
+	}
+
+	if _, err := splitBatchBody([]byte(`[{"type":"a"},`), "application/json"); err == nil {
+		t.Fatal("broken json array should fail")
+	}
+}
+
+func TestSplitBatchBodyNdjson(t *testing.T) {
+	body := "{\"type\":\"a\"}\n\n  \r\n{\"type\":\"b\"}\r\n{\"type\":\"c\"}"
+	items, err := splitBatchBody([]byte(body), "application/x-ndjson")
+	if err != nil || len(items) != 3 {
+		t.Fatalf("items=%v err=%v", items, err)
+	}
+
+	for i, s := range []string{`{"type":"a"}`, `{"type":"b"}`, `{"type":"c"}`} {
+		if string(items[i]) != s {
+			t.Fatalf("item %d: expected %s, got %s", i, s, items[i])
+		}
+	}
+
+	// 声明为ndjson时，以[开头的行也按单行处理
+	items, err = splitBatchBody([]byte("[1]\n[2]"), "application/x-ndjson")
+	if err != nil || len(items) != 2 {
+		t.Fatalf("items=%v err=%v", items, err)
+	}
+}
+
+func TestSplitBatchBodyEmpty(t *testing.T) {
+	for _, body := range []string{"", " \n\t\r\n"} {
+		if _, err := splitBatchBody([]byte(body), ""); err == nil {
+			t.Fatalf("empty body %q should fail", body)
+		}
+	}
+}
+
+func TestParseIntel(t *testing.T) {
+	if intel, err := parseIntel([]byte(`{"type":"news","level":1}`)); err != nil || intel.Type != "news" {
+		t.Fatalf("intel=%+v err=%v", intel, err)
+	}
+
+	for _, body := range []string{`{"level":1}`, `{"type":`, `[]`} {
+		if _, err := parseIntel([]byte(body)); err == nil {
+			t.Errorf("%s should be rejected", body)
+		}
+	}
+}
+
+func newTestIntelService() *Service {
+	s := &Service{}
+	s.pipeline.init(0, 10, 1)
+	return s
+}
+
+// 单条和批量上报使用同样的检查
+func TestIntelEndpointsRejectMissingType(t *testing.T) {
+	s := newTestIntelService()
+	w := httptest.NewRecorder()
+	s.onNewIntel(w, httptest.NewRequest("POST", "/intel/new", strings.NewReader(`{"title":"x"}`)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "missing type") {
+		t.Fatalf("single intel without type: status=%d body=%s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	s.onHttpIntelBatch(w, httptest.NewRequest("POST", "/intel/batch", strings.NewReader(`[{"title":"x"},{"type":"news"}]`)))
+	resp := BatchResp{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusMultiStatus || resp.Accepted != 1 || resp.Results[0].Error != "missing type" || resp.Results[1].Seq != 1 {
+		t.Fatalf("batch: status=%d body=%s", w.Code, w.Body.String())
+	}
+
+	if s.pipeline.latestSeq() != 1 {
+		t.Fatalf("only the valid intel should be submitted, latest seq=%d", s.pipeline.latestSeq())
+	}
+}
@@ -10,27 +10,24 @@ package intel
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/aztecqt/dagger/util"
 )
 
-func (s *Service) OnCommand(cmdLine string, onResp func(string)) {
+// uid和nick由调用者从消息中直接取得，不能从命令行中解析，否则用户可以通过昵称伪造uid
+func (s *Service) OnCommand(cmdLine, uid, nick string, onResp func(string)) {
 	splited := strings.Split(cmdLine, " ")
-	var op, uid, nick string
+	op := splited[0]
 
-	if len(splited) < 3 {
-		onResp(fmt.Sprintf("internal error"))
+	if adminCmds[op] && !s.isAdmin(uid) {
+		onResp("只有管理员可以执行该命令")
 		return
-	} else {
-		op = splited[0]
-		uid = splited[len(splited)-2]
-		nick = splited[len(splited)-1]
-		splited = splited[:len(splited)-2]
 	}
 
 	switch op {
 	case "help":
-		s.onCmdHelp(onResp)
+		s.onCmdHelp(uid, onResp)
 	case "test":
 		s.onCmdTest(onResp)
 	case "ls":
@@ -51,12 +48,50 @@ func (s *Service) OnCommand(cmdLine string, onResp func(string)) {
 		s.onCmdUnexcludeSub(splited, uid, nick, onResp)
 	case "css":
 		s.onCmdClearSubchannelSettings(splited, uid, nick, onResp)
+	case "mode":
+		s.onCmdDeliveryMode(splited, uid, nick, onResp)
+	case "inc":
+		s.onCmdContentRule(splited, uid, nick, contentRule_IncludeKeyword, onResp)
+	case "exc":
+		s.onCmdContentRule(splited, uid, nick, contentRule_ExcludeKeyword, onResp)
+	case "incre":
+		s.onCmdContentRule(splited, uid, nick, contentRule_IncludeRegex, onResp)
+	case "excre":
+		s.onCmdContentRule(splited, uid, nick, contentRule_ExcludeRegex, onResp)
+	case "rmkw":
+		s.onCmdRemoveContentRule(splited, uid, nick, onResp)
+	case "lvl":
+		s.onCmdMinLevel(splited, uid, nick, onResp)
+	case "hook":
+		s.onCmdGroupWebhook(splited, uid, nick, onResp)
+	case "quiet":
+		s.onCmdQuietHours(splited, uid, nick, onResp)
+	case "mute":
+		s.onCmdMute(splited, uid, nick, onResp)
+	case "unmute":
+		s.onCmdUnmute(splited, uid, nick, onResp)
+	case "muteact":
+		s.onCmdMuteAction(splited, uid, nick, onResp)
+	case "stats":
+		s.onCmdStats(splited, uid, onResp)
+	case "find":
+		s.onCmdFind(splited, uid, onResp)
+	case "show":
+		s.onCmdShow(splited, uid, onResp)
+	case "subs":
+		s.onCmdSubscribers(splited, onResp)
+	case "tpl":
+		s.onCmdTemplates(onResp)
+	case "apply":
+		s.onCmdApplyTemplate(splited, uid, onResp)
+	case "cp":
+		s.onCmdCopyFilter(splited, uid, onResp)
 	default:
 		onResp(fmt.Sprintf("unknown command: `%s`", op))
 	}
 }
 
-func (c *Service) onCmdHelp(onResp func(string)) {
+func (c *Service) onCmdHelp(uid string, onResp func(string)) {
 	sb := strings.Builder{}
 	sb.WriteString("情报订阅命令格式：\n")
 	sb.WriteString("ls (查看所有可订阅的频道)\n")
@@ -69,6 +104,25 @@ func (c *Service) onCmdHelp(onResp func(string)) {
 	sb.WriteString("xs <chName> <sub_chName> (exclude-subchannel, 排除子频道)\n")
 	sb.WriteString("uxs <chName> <sub_chName> (unexclude-subchannel,取消排除子频道)\n")
 	sb.WriteString("css <chName> (clear-subchannel-settings, 清空某频道下的子频道设置，回到默认全部接收的状态)\n")
+	sb.WriteString("mode <chName> <i|h|d> (设置频道的投递模式：immediate立即推送/hourly每小时摘要/daily每日摘要)\n")
+	sb.WriteString("inc <chName> <keyword> (只接收标题或内容包含关键词的情报，可设置多个)\n")
+	sb.WriteString("exc <chName> <keyword> (排除标题或内容包含关键词的情报)\n")
+	sb.WriteString("incre <chName> <regex> (同inc，使用正则表达式)\n")
+	sb.WriteString("excre <chName> <regex> (同exc，使用正则表达式)\n")
+	sb.WriteString("rmkw <chName> <keyword|regex> (删除关键词/正则规则)\n")
+	sb.WriteString("lvl <chName> <level> (只接收不低于该等级的情报)\n")
+	sb.WriteString("hook <url|off> (仅群聊，设置群机器人webhook用于推送。不设置时使用最近一次会话的webhook，会过期)\n")
+	sb.WriteString("quiet <start-end> [timezone] (设置每日安静时段，如quiet 23-8 Asia/Shanghai)\n")
+	sb.WriteString("quiet off (取消安静时段)\n")
+	sb.WriteString("mute <chName|all> <duration> (静音频道一段时间，如mute news 2h/mute all 1d)\n")
+	sb.WriteString("unmute <chName|all> (取消静音)\n")
+	sb.WriteString("muteact <hold|drop> (静默期间的情报：暂存到结束后发送/丢弃)\n")
+	sb.WriteString("stats [chName] (查看本小时和今日的情报数量，以及自己收到的推送数量)\n")
+	sb.WriteString("find <keyword> [chName|all] [hours] (搜索最近的情报，默认24小时内，最多7天)\n")
+	sb.WriteString("show <seq> (查看一条情报的完整内容)\n")
+	if c.isAdmin(uid) {
+		sb.WriteString(c.adminHelpStr())
+	}
 	onResp(sb.String())
 }
 
@@ -88,8 +142,8 @@ func (c *Service) onCmdTest(onResp func(string)) {
 	i2.Title = "test-intel"
 	i2.Content = "barrrrrrrrrrrrrrrr"
 
-	c.processIntel(i1)
-	c.processIntel(i2)
+	c.submitIntel(i1)
+	c.submitIntel(i2)
 	onResp("test intel sended")
 }
 
@@ -98,14 +152,14 @@ func (c *Service) onCmdLs(splited []string, onResp func(string)) {
 		// 展示所有频道名
 		sb := strings.Builder{}
 		sb.WriteString("当前可订阅的channel：\n")
-		for i, mainType := range c.menuKeys {
-			sb.WriteString(fmt.Sprintf("%d. %s\n", i+1, mainType))
+		for i, mainType := range c.menu.mainTypes() {
+			sb.WriteString(fmt.Sprintf("%d. %s%s\n", i+1, mainType, util.ValueIf(c.menu.isStale(mainType), " (过期)", "")))
 		}
 		onResp(sb.String())
 	} else {
 		// 展示特定频道的子频道名
 		mainType := c.tryConvertFromIndexToMainType(splited[1])
-		if im, ok := c.menu[mainType]; ok {
+		if im, ok := c.menu.get(mainType); ok {
 			onResp(c.intelMenuStr(mainType, im))
 		} else {
 			onResp(fmt.Sprintf("channel `%s` 不存在", mainType))
@@ -114,24 +168,59 @@ func (c *Service) onCmdLs(splited []string, onResp func(string)) {
 }
 
 func (c *Service) intelMenuStr(mainType string, im IntelMenu) string {
+	observed := c.menu.observedSubtypes(mainType)
+	observedStr := func(o observedSubtype) string {
+		return fmt.Sprintf("%s (%d条, 最近:%s)", o.Name, o.Count, o.LastSeen.Format(time.DateTime))
+	}
+
+	str := ""
 	if im.SubtypeUncertain {
-		return fmt.Sprintf("%s:\n%s", mainType, im.SybTypeUncertainReason)
+		str = fmt.Sprintf("%s:\n%s", mainType, im.SybTypeUncertainReason)
+	} else if len(im.SubTypes) == 0 && len(observed) == 0 {
+		str = fmt.Sprintf("[%s]:\n没有子频道", mainType)
 	} else if len(im.SubTypes) == 0 {
-		return fmt.Sprintf("[%s]:\n没有子频道", mainType)
+		str = fmt.Sprintf("[%s]:", mainType)
 	} else {
 		sb := strings.Builder{}
 		sb.WriteString(fmt.Sprintf("[%s]的当前子频道为:\n", mainType))
+		seen := make(map[string]observedSubtype)
+		for _, o := range observed {
+			seen[o.Name] = o
+		}
 		i := 0
 		for k := range im.SubTypes {
 			i++
-			sb.WriteString(fmt.Sprintf("%d. %s\n", i, k))
+			if o, ok := seen[k]; ok {
+				sb.WriteString(fmt.Sprintf("%d. %s\n", i, observedStr(o)))
+			} else {
+				sb.WriteString(fmt.Sprintf("%d. %s\n", i, k))
+			}
+		}
+		str = sb.String()
+	}
+
+	// 菜单中没有，但从情报中发现的子频道
+	sb := strings.Builder{}
+	i := 0
+	for _, o := range observed {
+		if _, ok := im.SubTypes[o.Name]; !ok {
+			i++
+			sb.WriteString(fmt.Sprintf("%d. %s\n", i, observedStr(o)))
 		}
-		return sb.String()
 	}
+	if i > 0 {
+		str += fmt.Sprintf("\n从情报中发现的子频道:\n%s", sb.String())
+	}
+
+	if e, ok := c.menu.entry(mainType); ok {
+		str += fmt.Sprintf("\n菜单来源:%s\n上报时间:%s%s", e.Source, e.AnnounceTime.Format(time.DateTime), util.ValueIf(c.menu.isStale(mainType), " (过期)", ""))
+	}
+	return str
 }
 
+// 检查频道/子频道是否存在。只用于订阅类的命令，取消类的命令不检查，频道不再出现后用户仍然可以清理自己的订阅
 func (c *Service) checkIntelType(mainType, subType string) (bool, string) {
-	if im, ok := c.menu[mainType]; !ok {
+	if im, ok := c.menu.get(mainType); !ok {
 		return false, fmt.Sprintf("频道[%s]不存在", mainType)
 	} else {
 		if len(subType) == 0 {
@@ -140,6 +229,8 @@ func (c *Service) checkIntelType(mainType, subType string) (bool, string) {
 			return true, ""
 		} else if _, ok := im.SubTypes[subType]; ok {
 			return true, ""
+		} else if c.menu.hasObserved(mainType, subType) {
+			return true, ""
 		} else {
 			return false, fmt.Sprintf("频道[%s]下不存在子频道[%s]", mainType, subType)
 		}
@@ -149,8 +240,9 @@ func (c *Service) checkIntelType(mainType, subType string) (bool, string) {
 func (c *Service) tryConvertFromIndexToMainType(mainType string) string {
 	if index, ok := util.String2Int(mainType); ok {
 		index--
-		if index >= 0 && index < len(c.menuKeys) {
-			return c.menuKeys[index]
+		mainTypes := c.menu.mainTypes()
+		if index >= 0 && index < len(mainTypes) {
+			return mainTypes[index]
 		}
 	}
 	return mainType
@@ -184,10 +276,6 @@ func (c *Service) onCmdUnsubscribe(splited []string, uid, nick string, onResp fu
 	}
 
 	mainType := c.tryConvertFromIndexToMainType(splited[1])
-	if ok, msg := c.checkIntelType(mainType, ""); !ok {
-		onResp(msg)
-		return
-	}
 
 	c.filter.unsubscribeType(uid, nick, mainType)
 	onResp(fmt.Sprintf("unsubscribe [%s] done", mainType))
@@ -218,10 +306,6 @@ func (c *Service) onCmdUnsubscribeSub(splited []string, uid, nick string, onResp
 
 	mainType := c.tryConvertFromIndexToMainType(splited[1])
 	subType := splited[2]
-	if ok, msg := c.checkIntelType(mainType, subType); !ok {
-		onResp(msg)
-		return
-	}
 
 	c.filter.userRemoveSubtypeWhiteList(uid, mainType, subType)
 	onResp(fmt.Sprintf("[%s] removed from [%s]'s white list", subType, mainType))
@@ -252,10 +336,6 @@ func (c *Service) onCmdUnexcludeSub(splited []string, uid, nick string, onResp f
 
 	mainType := c.tryConvertFromIndexToMainType(splited[1])
 	subType := splited[2]
-	if ok, msg := c.checkIntelType(mainType, subType); !ok {
-		onResp(msg)
-		return
-	}
 
 	c.filter.userRemoveSubtypeBlackList(uid, mainType, subType)
 	onResp(fmt.Sprintf("[%s] removed from [%s]'s black list", subType, mainType))
@@ -267,13 +347,211 @@ func (c *Service) onCmdClearSubchannelSettings(splited []string, uid, nick strin
 		return
 	}
 
+	mainType := c.tryConvertFromIndexToMainType(splited[1])
+
+	c.filter.userClearSubtypeWhiteList(uid, mainType)
+	c.filter.userClearSubtypeBlackList(uid, mainType)
+	onResp(fmt.Sprintf("[%s]'s white/black list cleared", mainType))
+}
+
+func (c *Service) onCmdDeliveryMode(splited []string, uid, nick string, onResp func(string)) {
+	if len(splited) < 3 {
+		onResp(fmt.Sprintf("not enough param for command `mode`, type help for more info"))
+		return
+	}
+
 	mainType := c.tryConvertFromIndexToMainType(splited[1])
 	if ok, msg := c.checkIntelType(mainType, ""); !ok {
 		onResp(msg)
 		return
 	}
 
-	c.filter.userClearSubtypeWhiteList(uid, mainType)
-	c.filter.userClearSubtypeBlackList(uid, mainType)
-	onResp(fmt.Sprintf("[%s]'s white/black list cleared", mainType))
+	mode, ok := parseDeliveryMode(splited[2])
+	if !ok {
+		onResp(fmt.Sprintf("unknown mode `%s`, should be i/h/d", splited[2]))
+		return
+	}
+
+	if !c.filter.userSetDeliveryMode(uid, mainType, mode) {
+		onResp(fmt.Sprintf("[%s] is not subscribed", mainType))
+		return
+	}
+
+	onResp(fmt.Sprintf("[%s]'s delivery mode set to %s", mainType, mode))
+}
+
+func (c *Service) onCmdQuietHours(splited []string, uid, nick string, onResp func(string)) {
+	if len(splited) < 2 {
+		onResp(fmt.Sprintf("not enough param for command `quiet`, type help for more info"))
+		return
+	}
+
+	if splited[1] == "off" {
+		c.filter.userSetQuietHours(uid, nick, nil)
+		onResp("quiet hours cleared")
+		return
+	}
+
+	tz := ""
+	if len(splited) >= 3 {
+		tz = splited[2]
+	}
+
+	qh, err := parseQuietHours(splited[1], tz)
+	if err != nil {
+		onResp(err.Error())
+		return
+	}
+
+	c.filter.userSetQuietHours(uid, nick, qh)
+	onResp(fmt.Sprintf("quiet hours set to %s", qh.string()))
+}
+
+func (c *Service) onCmdMute(splited []string, uid, nick string, onResp func(string)) {
+	if len(splited) < 3 {
+		onResp(fmt.Sprintf("not enough param for command `mute`, type help for more info"))
+		return
+	}
+
+	mainType := splited[1]
+	if mainType != muteAllChannels {
+		mainType = c.tryConvertFromIndexToMainType(mainType)
+		if ok, msg := c.checkIntelType(mainType, ""); !ok {
+			onResp(msg)
+			return
+		}
+	}
+
+	d, err := parseMuteDuration(splited[2])
+	if err != nil {
+		onResp(err.Error())
+		return
+	}
+
+	until := time.Now().Add(d)
+	c.filter.userMute(uid, nick, mainType, until)
+	onResp(fmt.Sprintf("[%s] muted until %s", mainType, until.Format(time.DateTime)))
+}
+
+func (c *Service) onCmdUnmute(splited []string, uid, nick string, onResp func(string)) {
+	if len(splited) < 2 {
+		onResp(fmt.Sprintf("not enough param for command `unmute`, type help for more info"))
+		return
+	}
+
+	mainType := splited[1]
+	if mainType != muteAllChannels {
+		mainType = c.tryConvertFromIndexToMainType(mainType)
+	}
+
+	c.filter.userUnmute(uid, mainType)
+	onResp(fmt.Sprintf("[%s] unmuted", mainType))
+}
+
+func (c *Service) onCmdMuteAction(splited []string, uid, nick string, onResp func(string)) {
+	if len(splited) < 2 {
+		onResp(fmt.Sprintf("not enough param for command `muteact`, type help for more info"))
+		return
+	}
+
+	switch splited[1] {
+	case "hold":
+		c.filter.userSetHoldMuted(uid, nick, true)
+		onResp("intel during silence will be held and sent afterwards")
+	case "drop":
+		c.filter.userSetHoldMuted(uid, nick, false)
+		onResp("intel during silence will be dropped")
+	default:
+		onResp(fmt.Sprintf("unknown action `%s`, should be hold/drop", splited[1]))
+	}
+}
+
+func (c *Service) onCmdContentRule(splited []string, uid, nick string, ruleType int, onResp func(string)) {
+	if len(splited) < 3 {
+		onResp(fmt.Sprintf("not enough param for command `%s`, type help for more info", splited[0]))
+		return
+	}
+
+	mainType := c.tryConvertFromIndexToMainType(splited[1])
+	if ok, msg := c.checkIntelType(mainType, ""); !ok {
+		onResp(msg)
+		return
+	}
+
+	// 关键词/正则中可以包含空格
+	rule := strings.Join(splited[2:], " ")
+	if ruleType == contentRule_IncludeRegex || ruleType == contentRule_ExcludeRegex {
+		if _, err := compileRegex(rule); err != nil {
+			onResp(fmt.Sprintf("invalid regex `%s`: %s", rule, err.Error()))
+			return
+		}
+	}
+
+	if !c.filter.userAddContentRule(uid, mainType, ruleType, rule) {
+		onResp(fmt.Sprintf("[%s] is not subscribed", mainType))
+		return
+	}
+	onResp(fmt.Sprintf("rule `%s` added to [%s]", rule, mainType))
+}
+
+func (c *Service) onCmdRemoveContentRule(splited []string, uid, nick string, onResp func(string)) {
+	if len(splited) < 3 {
+		onResp(fmt.Sprintf("not enough param for command `rmkw`, type help for more info"))
+		return
+	}
+
+	mainType := c.tryConvertFromIndexToMainType(splited[1])
+	rule := strings.Join(splited[2:], " ")
+	if c.filter.userRemoveContentRule(uid, mainType, rule) {
+		onResp(fmt.Sprintf("rule `%s` removed from [%s]", rule, mainType))
+	} else {
+		onResp(fmt.Sprintf("rule `%s` not found in [%s]", rule, mainType))
+	}
+}
+
+func (c *Service) onCmdMinLevel(splited []string, uid, nick string, onResp func(string)) {
+	if len(splited) < 3 {
+		onResp(fmt.Sprintf("not enough param for command `lvl`, type help for more info"))
+		return
+	}
+
+	mainType := c.tryConvertFromIndexToMainType(splited[1])
+	if ok, msg := c.checkIntelType(mainType, ""); !ok {
+		onResp(msg)
+		return
+	}
+
+	level, ok := util.String2Int(splited[2])
+	if !ok || level < 0 {
+		onResp(fmt.Sprintf("invalid level `%s`", splited[2]))
+		return
+	}
+
+	if !c.filter.userSetMinLevel(uid, mainType, level) {
+		onResp(fmt.Sprintf("[%s] is not subscribed", mainType))
+		return
+	}
+	onResp(fmt.Sprintf("[%s]'s min level set to %d", mainType, level))
+}
+
+func (c *Service) onCmdGroupWebhook(splited []string, uid, nick string, onResp func(string)) {
+	if !strings.HasPrefix(uid, groupKeyPrefix) {
+		onResp("`hook` is only available in group chat")
+		return
+	}
+
+	if len(splited) < 2 {
+		onResp(fmt.Sprintf("not enough param for command `hook`, type help for more info"))
+		return
+	}
+
+	if splited[1] == "off" {
+		c.filter.groupSetWebhook(uid, "")
+		onResp("group webhook cleared")
+	} else if strings.HasPrefix(splited[1], "https://") {
+		c.filter.groupSetWebhook(uid, splited[1])
+		onResp("group webhook set")
+	} else {
+		onResp(fmt.Sprintf("invalid webhook `%s`", splited[1]))
+	}
 }
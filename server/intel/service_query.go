@@ -0,0 +1,297 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-09-25 10:31:08
+ * @Description: 情报历史查询。数据来自redis中的IntelRedisKey_List，
+ * 供IntelSpeaker、看板等客户端使用，客户端无需直接访问redis
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aztecqt/dagger/util"
+	"github.com/aztecqt/dagger/util/logger"
+	"github.com/go-redis/redis"
+)
+
+const (
+	queryDefaultLimit = 100
+	queryMaxLimit     = 1000
+	queryChunkSize    = 500   // 每次从redis读取的条数
+	queryMaxScan      = 20000 // 单次查询最多读取的条数，超过后返回has_more，由客户端继续翻页
+)
+
+// 查询条件
+type intelQuery struct {
+	SinceSeq int       // 只返回seq大于此值的情报
+	From     time.Time // 情报时间下限，零值表示不限
+	To       time.Time // 情报时间上限，零值表示不限
+	Type     string    // 为空表示不限
+	SubType  string    // 为空表示不限
+	Level    int       // 小于0表示不限
+	Limit    int
+}
+
+func (q *intelQuery) match(intel *Intel) bool {
+	if intel.Seq <= q.SinceSeq {
+		return false
+	}
+
+	if !q.From.IsZero() && intel.Time.Before(q.From) {
+		return false
+	}
+
+	if !q.To.IsZero() && intel.Time.After(q.To) {
+		return false
+	}
+
+	if len(q.Type) > 0 && !strings.EqualFold(q.Type, intel.Type) {
+		return false
+	}
+
+	if len(q.SubType) > 0 && !strings.EqualFold(q.SubType, intel.SubType) {
+		return false
+	}
+
+	if q.Level >= 0 && q.Level != intel.Level {
+		return false
+	}
+
+	return true
+}
+
+// 查询结果
+type intelQueryResult struct {
+	Intels       []Intel `json:"intels"`
+	LatestSeq    int     `json:"latest_seq"`     // 服务器当前最新的流水号
+	HasMore      bool    `json:"has_more"`       // 还有更多符合条件的情报，或者达到了单次查询的扫描上限
+	NextSinceSeq int     `json:"next_since_seq"` // 翻页时，作为下一次查询的since_seq。没有匹配结果时也会前进到最后扫描的位置
+}
+
+// 情报列表的读取接口，区间的含义与redis的LRANGE相同，负数表示从尾部倒数
+type intelListReader interface {
+	lrange(start, stop int64) ([]string, bool)
+}
+
+// 从redis读取情报列表。RedisClient没有提供列表的读取，这里直接使用go-redis，配置与RedisClient相同
+type redisListReader struct {
+	client *redis.Client
+}
+
+func newRedisListReader(cfg util.RedisConfig) *redisListReader {
+	return &redisListReader{client: redis.NewClient(&redis.Options{Addr: cfg.Addr, Password: cfg.Password, DB: cfg.DB})}
+}
+
+func (r *redisListReader) lrange(start, stop int64) ([]string, bool) {
+	strs, err := r.client.LRange(IntelRedisKey_List, start, stop).Result()
+	if err != nil {
+		logger.LogImportant(logPrefix, "read %s failed, err=%s", IntelRedisKey_List, err.Error())
+		return nil, false
+	}
+	return strs, true
+}
+
+// 读取情报列表中[start, stop]区间的情报
+func (s *Service) loadIntels(start, stop int64) ([]Intel, bool) {
+	if s.list == nil {
+		return nil, false
+	}
+
+	strs, ok := s.list.lrange(start, stop)
+	if !ok {
+		return nil, false
+	}
+
+	intels := make([]Intel, 0, len(strs))
+	for _, str := range strs {
+		intel := Intel{}
+		if err := json.Unmarshal([]byte(str), &intel); err == nil {
+			intels = append(intels, intel)
+		}
+	}
+	return intels, true
+}
+
+// 估算seq在redis列表中的下标。列表中的seq是连续递增的，所以用第一条的seq即可推算
+func (s *Service) indexOfSeq(seq int) int64 {
+	first, ok := s.loadIntels(0, 0)
+	if !ok || len(first) == 0 {
+		return 0
+	}
+
+	index := int64(seq - first[0].Seq)
+	if index < 0 {
+		index = 0
+	}
+	return index
+}
+
+// 按条件查询情报，结果按seq升序排列
+func (s *Service) queryIntels(q intelQuery) intelQueryResult {
+	if q.Limit <= 0 {
+		q.Limit = queryDefaultLimit
+	} else if q.Limit > queryMaxLimit {
+		q.Limit = queryMaxLimit
+	}
+
+	rst := intelQueryResult{Intels: make([]Intel, 0), LatestSeq: s.pipeline.latestSeq(), NextSinceSeq: q.SinceSeq}
+
+	// seq不一定严格连续（例如redis写入失败），往前多读一点保证不漏
+	index := s.indexOfSeq(q.SinceSeq+1) - queryChunkSize
+	if index < 0 {
+		index = 0
+	}
+
+	for scanned := 0; scanned < queryMaxScan; {
+		intels, ok := s.loadIntels(index, index+queryChunkSize-1)
+		if !ok || len(intels) == 0 {
+			return rst
+		}
+
+		for i := range intels {
+			if intels[i].Seq <= q.SinceSeq {
+				continue
+			}
+
+			if q.match(&intels[i]) {
+				if len(rst.Intels) >= q.Limit {
+					rst.HasMore = true
+					return rst
+				}
+				rst.Intels = append(rst.Intels, intels[i])
+			}
+
+			rst.NextSinceSeq = intels[i].Seq
+		}
+
+		scanned += len(intels)
+		index += int64(len(intels))
+	}
+
+	// 达到扫描上限，客户端从NextSinceSeq继续
+	rst.HasMore = true
+	return rst
+}
+
+// 按seq读取一条情报
+func (s *Service) getIntel(seq int) (Intel, bool) {
+	index := s.indexOfSeq(seq)
+	intels, ok := s.loadIntels(index, index)
+	if ok && len(intels) == 1 && intels[0].Seq == seq {
+		return intels[0], true
+	}
+
+	// 下标推算失败，在附近查找
+	rst := s.queryIntels(intelQuery{SinceSeq: seq - 1, Level: -1, Limit: 1})
+	if len(rst.Intels) > 0 && rst.Intels[0].Seq == seq {
+		return rst.Intels[0], true
+	}
+
+	return Intel{}, false
+}
+
+// 解析时间参数，支持毫秒时间戳和"2006-01-02 15:04:05"格式
+func parseTimeParam(str string) (time.Time, bool) {
+	if len(str) == 0 {
+		return time.Time{}, true
+	}
+
+	if ms, ok := util.String2Int64(str); ok {
+		return time.UnixMilli(ms), true
+	}
+
+	if t, err := time.ParseInLocation(time.DateTime, str, time.Local); err == nil {
+		return t, true
+	}
+
+	return time.Time{}, false
+}
+
+// /intel/list?since_seq=0&from=&to=&type=&subtype=&level=&limit=100
+// 翻页时，用返回的next_since_seq作为下一次的since_seq
+func (s *Service) onHttpIntelList(w http.ResponseWriter, r *http.Request) {
+	defer util.DefaultRecover()
+	if !s.checkReader(w, r) {
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	query := intelQuery{Level: -1}
+	query.Type = q.Get("type")
+	query.SubType = q.Get("subtype")
+
+	var ok bool
+	if str := q.Get("since_seq"); len(str) > 0 {
+		if query.SinceSeq, ok = util.String2Int(str); !ok {
+			http.Error(w, "invalid since_seq", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if str := q.Get("level"); len(str) > 0 {
+		if query.Level, ok = util.String2Int(str); !ok {
+			http.Error(w, "invalid level", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if str := q.Get("limit"); len(str) > 0 {
+		if query.Limit, ok = util.String2Int(str); !ok {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if query.From, ok = parseTimeParam(q.Get("from")); !ok {
+		http.Error(w, "invalid from", http.StatusBadRequest)
+		return
+	}
+
+	if query.To, ok = parseTimeParam(q.Get("to")); !ok {
+		http.Error(w, "invalid to", http.StatusBadRequest)
+		return
+	}
+
+	b, _ := json.Marshal(s.queryIntels(query))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// /intel/get?seq=123
+func (s *Service) onHttpIntelGet(w http.ResponseWriter, r *http.Request) {
+	defer util.DefaultRecover()
+	if !s.checkReader(w, r) {
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	seq, ok := util.String2Int(r.URL.Query().Get("seq"))
+	if !ok {
+		http.Error(w, "invalid seq", http.StatusBadRequest)
+		return
+	}
+
+	intel, ok := s.getIntel(seq)
+	if !ok {
+		http.Error(w, "intel not found", http.StatusNotFound)
+		return
+	}
+
+	b, _ := json.Marshal(intel)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
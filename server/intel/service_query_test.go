@@ -0,0 +1,109 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-26 14:08:51
+ * @Description: 情报历史查询的测试
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"testing"
+	"time"
+)
+
+// 内存中的情报列表，区间语义与redis的LRANGE相同
+type memListReader struct {
+	items []string
+}
+
+func (r *memListReader) lrange(start, stop int64) ([]string, bool) {
+	n := int64(len(r.items))
+	if start < 0 {
+		start = max(n+start, 0)
+	}
+	if stop < 0 {
+		stop = n + stop
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop {
+		return []string{}, true
+	}
+	return r.items[start : stop+1], true
+}
+
+func (r *memListReader) push(intel Intel) {
+	r.items = append(r.items, intelJson(intel))
+}
+
+// seq从1到n的情报，时间间隔1分钟，奇数为news、偶数为price
+func newTestQueryService(n int, start time.Time) *Service {
+	s := newTestIntelService()
+	list := &memListReader{}
+	for i := 1; i <= n; i++ {
+		mainType := "price"
+		if i%2 == 1 {
+			mainType = "news"
+		}
+		list.push(Intel{Seq: i, Time: start.Add(time.Minute * time.Duration(i)), Level: 1, Type: mainType})
+	}
+	s.list = list
+	s.pipeline.lastSeq = n
+	return s
+}
+
+func TestQueryPaging(t *testing.T) {
+	s := newTestQueryService(1200, time.Now())
+
+	// 按since_seq翻页，不重复不遗漏
+	seen := 0
+	q := intelQuery{Type: "news", Level: -1, Limit: 100}
+	for {
+		rst := s.queryIntels(q)
+		for _, intel := range rst.Intels {
+			if intel.Seq <= q.SinceSeq || intel.Type != "news" {
+				t.Fatalf("unexpected intel %+v after since_seq %d", intel, q.SinceSeq)
+			}
+			seen++
+		}
+
+		if !rst.HasMore {
+			break
+		}
+		q.SinceSeq = rst.NextSinceSeq
+	}
+
+	if seen != 600 {
+		t.Fatalf("expected 600 news, got %d", seen)
+	}
+}
+
+func TestQueryNoMatchAdvances(t *testing.T) {
+	s := newTestQueryService(100, time.Now())
+	rst := s.queryIntels(intelQuery{Type: "none", Level: -1})
+	if len(rst.Intels) != 0 || rst.HasMore || rst.NextSinceSeq != 100 || rst.LatestSeq != 100 {
+		t.Fatalf("unexpected result: %+v", rst)
+	}
+}
+
+func TestQueryTimeRange(t *testing.T) {
+	start := time.Now()
+	s := newTestQueryService(100, start)
+	rst := s.queryIntels(intelQuery{From: start.Add(time.Minute * 10), To: start.Add(time.Minute * 19), Level: -1})
+	if len(rst.Intels) != 10 || rst.Intels[0].Seq != 10 || rst.Intels[9].Seq != 19 {
+		t.Fatalf("unexpected result: %+v", rst.Intels)
+	}
+
+	if intel, ok := s.getIntel(42); !ok || intel.Seq != 42 {
+		t.Fatalf("get intel 42 failed: %+v", intel)
+	}
+}
+
+func TestQueryWithoutRedis(t *testing.T) {
+	s := newTestIntelService()
+	if rst := s.queryIntels(intelQuery{Level: -1}); len(rst.Intels) != 0 || rst.HasMore {
+		t.Fatalf("unexpected result: %+v", rst)
+	}
+}
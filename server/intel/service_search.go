@@ -0,0 +1,182 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-24 15:12:40
+ * @Description: 情报搜索命令。钉钉消息被刷走以后，用户可以按关键词找回最近的情报
+ * 从redis列表的尾部（最新的情报）往前查找，超过时间范围或扫描数量上限后停止
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aztecqt/dagger/util"
+)
+
+const (
+	searchDefaultHours = 24
+	searchMaxHours     = 24 * 7
+	searchMaxResults   = 10
+	searchMaxScan      = 20000 // 最多扫描的情报数量
+	searchTitleLen     = 40    // 结果列表中标题的最大长度
+	searchAllChannels  = "all"
+)
+
+// 搜索条件
+type intelSearch struct {
+	Keyword  string // 匹配标题、内容和子频道，不区分大小写
+	MainType string // 为空表示所有频道
+	From     time.Time
+	Debug    bool // 是否包含调试情报
+	Limit    int
+}
+
+func (q *intelSearch) match(intel *Intel) bool {
+	if intel.Level == 0 && !q.Debug {
+		return false
+	}
+
+	if intel.Time.Before(q.From) {
+		return false
+	}
+
+	if len(q.MainType) > 0 && !strings.EqualFold(q.MainType, intel.Type) {
+		return false
+	}
+
+	kw := strings.ToLower(q.Keyword)
+	return strings.Contains(strings.ToLower(intel.Title), kw) ||
+		strings.Contains(strings.ToLower(intel.Content), kw) ||
+		strings.Contains(strings.ToLower(intel.SubType), kw)
+}
+
+// 搜索最近的情报，结果按seq倒序（最新的在前）。第二个返回值表示是否还有更多结果
+func (s *Service) searchIntels(q intelSearch) ([]Intel, bool) {
+	rst := make([]Intel, 0, q.Limit)
+	stop := int64(-1)
+	for scanned := 0; scanned < searchMaxScan; {
+		intels, ok := s.loadIntels(stop-queryChunkSize+1, stop)
+		if !ok || len(intels) == 0 {
+			break
+		}
+
+		allExpired := true
+		for i := len(intels) - 1; i >= 0; i-- {
+			// 旧数据中可能有没有时间的情报，不能据此判断后面的情报都已过期
+			if intels[i].Time.IsZero() || !intels[i].Time.Before(q.From) {
+				allExpired = false
+			}
+
+			if !q.match(&intels[i]) {
+				continue
+			}
+
+			if len(rst) >= q.Limit {
+				return rst, true
+			}
+			rst = append(rst, intels[i])
+		}
+
+		// 已经到了列表头部，或者这一段全部早于时间范围
+		if len(intels) < queryChunkSize || allExpired {
+			break
+		}
+
+		scanned += len(intels)
+		stop -= queryChunkSize
+	}
+
+	return rst, false
+}
+
+// 截取单行标题
+func shortTitle(intel *Intel) string {
+	title := intel.Title
+	if len(title) == 0 {
+		title, _, _ = strings.Cut(intel.Content, "\n")
+	}
+
+	runes := []rune(strings.TrimSpace(title))
+	if len(runes) > searchTitleLen {
+		return string(runes[:searchTitleLen]) + "..."
+	}
+	return string(runes)
+}
+
+// find <keyword> [chName|all] [hours]
+func (c *Service) onCmdFind(splited []string, uid string, onResp func(string)) {
+	if len(splited) < 2 {
+		onResp("not enough param for command `find`, type help for more info")
+		return
+	}
+
+	q := intelSearch{Keyword: splited[1], Debug: c.isAdmin(uid), Limit: searchMaxResults}
+	if len(splited) >= 3 && !strings.EqualFold(splited[2], searchAllChannels) {
+		q.MainType = strings.ToLower(c.tryConvertFromIndexToMainType(splited[2]))
+	}
+
+	hours := searchDefaultHours
+	if len(splited) >= 4 {
+		var ok bool
+		if hours, ok = util.String2Int(splited[3]); !ok || hours <= 0 {
+			onResp(fmt.Sprintf("invalid hours: `%s`", splited[3]))
+			return
+		}
+
+		if hours > searchMaxHours {
+			hours = searchMaxHours
+		}
+	}
+	q.From = time.Now().Add(-time.Hour * time.Duration(hours))
+
+	intels, more := c.searchIntels(q)
+	channelStr := util.ValueIf(len(q.MainType) > 0, fmt.Sprintf("频道[%s]", q.MainType), "所有频道")
+	if len(intels) == 0 {
+		onResp(fmt.Sprintf("%s最近%d小时内没有包含`%s`的情报", channelStr, hours, q.Keyword))
+		return
+	}
+
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("%s最近%d小时内包含`%s`的情报%s：\n", channelStr, hours, q.Keyword, util.ValueIf(more, fmt.Sprintf("(仅显示最近%d条)", searchMaxResults), "")))
+	for i := range intels {
+		intel := &intels[i]
+		sb.WriteString(fmt.Sprintf("#%d %s [%s/%s] %s\n", intel.Seq, intel.Time.Format("01-02 15:04"), intel.Type, intel.SubType, shortTitle(intel)))
+	}
+	sb.WriteString("发送 show <seq> 查看完整内容")
+	onResp(sb.String())
+}
+
+// show <seq>
+func (c *Service) onCmdShow(splited []string, uid string, onResp func(string)) {
+	if len(splited) < 2 {
+		onResp("not enough param for command `show`, type help for more info")
+		return
+	}
+
+	seq, ok := util.String2Int(strings.TrimPrefix(splited[1], "#"))
+	if !ok {
+		onResp(fmt.Sprintf("invalid seq: `%s`", splited[1]))
+		return
+	}
+
+	intel, ok := c.getIntel(seq)
+	if !ok || (intel.Level == 0 && !c.isAdmin(uid)) {
+		onResp(fmt.Sprintf("情报 #%d 不存在或已过期", seq))
+		return
+	}
+
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("#%d [%s/%s] 等级:%d\n", intel.Seq, intel.Type, intel.SubType, intel.Level))
+	sb.WriteString(fmt.Sprintf("时间: %s\n", intel.Time.Format(time.DateTime)))
+	if len(intel.Title) > 0 {
+		sb.WriteString(intel.Title + "\n")
+	}
+	sb.WriteString(intel.Content)
+	if len(intel.Url) > 0 {
+		sb.WriteString("\n" + intel.Url)
+	}
+	onResp(sb.String())
+}
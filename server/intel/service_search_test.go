@@ -0,0 +1,99 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-26 14:40:26
+ * @Description: 情报搜索的测试
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSearchIntels(t *testing.T) {
+	now := time.Now()
+	s := newTestIntelService()
+	list := &memListReader{}
+	list.push(Intel{Seq: 1, Time: now.Add(-time.Hour * 30), Level: 1, Type: "news", Title: "BTC old"})
+	list.push(Intel{Seq: 2, Time: now.Add(-time.Hour), Level: 1, Type: "news", Title: "btc etf"})
+	list.push(Intel{Seq: 3, Time: now.Add(-time.Minute), Level: 0, Type: "news", Title: "btc debug"})
+	list.push(Intel{Seq: 4, Time: now.Add(-time.Minute), Level: 1, Type: "price", SubType: "BTC"})
+	list.push(Intel{Seq: 5, Time: now, Level: 1, Type: "news", Content: "eth"})
+	s.list = list
+
+	q := intelSearch{Keyword: "btc", From: now.Add(-time.Hour * 24), Limit: 10}
+	intels, more := s.searchIntels(q)
+	if more || len(intels) != 2 || intels[0].Seq != 4 || intels[1].Seq != 2 {
+		t.Fatalf("unexpected result: %+v more=%v", intels, more)
+	}
+
+	q.Debug = true
+	q.MainType = "news"
+	if intels, _ := s.searchIntels(q); len(intels) != 2 || intels[0].Seq != 3 {
+		t.Fatalf("unexpected result with debug: %+v", intels)
+	}
+
+	q = intelSearch{Keyword: "btc", From: now.Add(-time.Hour * 48), Limit: 1}
+	if intels, more := s.searchIntels(q); len(intels) != 1 || !more || intels[0].Seq != 4 {
+		t.Fatalf("unexpected result with limit: %+v more=%v", intels, more)
+	}
+}
+
+func TestSearchSkipsZeroTime(t *testing.T) {
+	now := time.Now()
+	s := newTestIntelService()
+	list := &memListReader{}
+
+	// 较早的一段情报没有时间，不能让扫描提前结束
+	list.push(Intel{Seq: 1, Time: now.Add(-time.Minute), Level: 1, Type: "news", Title: "target"})
+	for i := 2; i <= queryChunkSize+1; i++ {
+		list.push(Intel{Seq: i, Level: 1, Type: "news", Title: "no time"})
+	}
+	for i := queryChunkSize + 2; i <= queryChunkSize*2+1; i++ {
+		list.push(Intel{Seq: i, Time: now, Level: 1, Type: "news", Title: "other"})
+	}
+	s.list = list
+
+	intels, _ := s.searchIntels(intelSearch{Keyword: "target", From: now.Add(-time.Hour), Limit: 10})
+	if len(intels) != 1 || intels[0].Seq != 1 {
+		t.Fatalf("unexpected result: %+v", intels)
+	}
+}
+
+func TestSubmitIntelDefaultTime(t *testing.T) {
+	s := newTestIntelService()
+	before := time.Now()
+	s.submitIntel(Intel{Type: "news"})
+	ts := time.Now().Add(-time.Hour)
+	s.submitIntel(Intel{Type: "news", Time: ts})
+
+	if intel := <-s.pipeline.queue; intel.Time.Before(before) {
+		t.Fatalf("intel without time should use receive time, got %v", intel.Time)
+	}
+
+	if intel := <-s.pipeline.queue; !intel.Time.Equal(ts) {
+		t.Fatalf("intel time should be kept, got %v", intel.Time)
+	}
+}
+
+func TestOnCmdFind(t *testing.T) {
+	s := newTestIntelService()
+	s.menu = newTestMenuBook()
+	list := &memListReader{}
+	list.push(Intel{Seq: 7, Time: time.Now(), Level: 1, Type: "news", SubType: "cn", Title: "btc etf approved"})
+	s.list = list
+
+	resp := ""
+	s.OnCommand("find BTC news", "u1", "nick", func(str string) { resp = str })
+	if !strings.Contains(resp, "#7") || !strings.Contains(resp, "[news/cn] btc etf approved") {
+		t.Fatalf("unexpected response: %s", resp)
+	}
+
+	s.OnCommand("find eth all 0", "u1", "nick", func(str string) { resp = str })
+	if resp != "invalid hours: `0`" {
+		t.Fatalf("unexpected response: %s", resp)
+	}
+}
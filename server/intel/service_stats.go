@@ -0,0 +1,149 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-19 14:30:06
+ * @Description: 情报统计的命令和http接口
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aztecqt/dagger/util"
+)
+
+const (
+	statsTopN           = 10
+	statsDefaultBuckets = 24
+)
+
+// 各频道（或某频道下各子频道）的数量
+func statsCountsStr(b *StatsBucket, mainType string) string {
+	counts := b.ByType
+	if len(mainType) > 0 {
+		counts = make(map[string]int64)
+		prefix := mainType + "/"
+		for k, v := range b.BySubType {
+			if sub, ok := strings.CutPrefix(k, prefix); ok {
+				counts[util.ValueIf(len(sub) > 0, sub, "(无子频道)")] = v
+			}
+		}
+	}
+
+	sb := strings.Builder{}
+	for i, k := range sortedByCount(counts) {
+		if i >= statsTopN {
+			sb.WriteString(fmt.Sprintf("  ...共%d项\n", len(counts)))
+			break
+		}
+		sb.WriteString(fmt.Sprintf("  %s: %d\n", k, counts[k]))
+	}
+	return sb.String()
+}
+
+func (c *Service) onCmdStats(splited []string, uid string, onResp func(string)) {
+	mainType := ""
+	if len(splited) >= 2 {
+		mainType = strings.ToLower(c.tryConvertFromIndexToMainType(splited[1]))
+	}
+
+	hour := c.stats.recent(StatsPeriod_Hourly, 1)[0]
+	day := c.stats.recent(StatsPeriod_Daily, 1)[0]
+
+	sb := strings.Builder{}
+	if len(mainType) > 0 {
+		sb.WriteString(fmt.Sprintf("频道[%s]的子频道情报数量\n", mainType))
+	} else {
+		sb.WriteString("情报数量\n")
+	}
+
+	sb.WriteString(fmt.Sprintf("本小时(%s时), 共%d条:\n", hour.Key, hour.Total))
+	sb.WriteString(statsCountsStr(&hour, mainType))
+	sb.WriteString(fmt.Sprintf("今日(%s), 共%d条:\n", day.Key, day.Total))
+	sb.WriteString(statsCountsStr(&day, mainType))
+	sb.WriteString(fmt.Sprintf("今日收到的推送: %d条\n", day.Deliveries[uid]))
+
+	// 管理员可以看到推送最多的订阅者
+	if c.isAdmin(uid) && len(mainType) == 0 && len(day.Deliveries) > 0 {
+		sb.WriteString("今日推送最多的订阅者:\n")
+		for i, k := range sortedByCount(day.Deliveries) {
+			if i >= statsTopN {
+				break
+			}
+			sb.WriteString(fmt.Sprintf("  %s(%s): %d\n", c.filter.userNick(k), k, day.Deliveries[k]))
+		}
+	}
+
+	if c.isAdmin(uid) {
+		m := c.pipeline.metrics()
+		sb.WriteString(fmt.Sprintf("处理队列: %d/%d (最高%d), 推送队列: %d/%d, 累计拒绝: %d\n",
+			m.QueueDepth, m.QueueCapacity, m.QueueHighWater, m.DingDepth, m.DingCapacity, m.Rejected))
+	}
+
+	onResp(sb.String())
+}
+
+// GET /intel/stats?period=hourly|daily&n=24
+// 返回最近n个时间段的统计，按时间倒序。每个订阅者的推送数量只返回给带有管理令牌的请求
+func (s *Service) onHttpIntelStats(w http.ResponseWriter, r *http.Request) {
+	defer util.DefaultRecover()
+	if !s.checkReader(w, r) {
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	period := q.Get("period")
+	if len(period) == 0 {
+		period = StatsPeriod_Hourly
+	} else if period != StatsPeriod_Hourly && period != StatsPeriod_Daily {
+		http.Error(w, "invalid period", http.StatusBadRequest)
+		return
+	}
+
+	n := statsDefaultBuckets
+	if str := q.Get("n"); len(str) > 0 {
+		var ok bool
+		if n, ok = util.String2Int(str); !ok || n <= 0 {
+			http.Error(w, "invalid n", http.StatusBadRequest)
+			return
+		}
+	}
+
+	maxN := util.ValueIf(period == StatsPeriod_Daily, statsMaxDailyBuckets, statsMaxHourlyBuckets)
+	if n > maxN {
+		n = maxN
+	}
+
+	buckets := s.stats.recent(period, n)
+	if !s.adminTokenValid(r) {
+		for i := range buckets {
+			buckets[i].Deliveries = nil
+		}
+	}
+
+	writeJson(w, buckets)
+}
+
+// GET /intel/pipeline
+// 返回情报处理流水线的队列深度等指标
+func (s *Service) onHttpIntelPipeline(w http.ResponseWriter, r *http.Request) {
+	defer util.DefaultRecover()
+	if !s.checkReader(w, r) {
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJson(w, s.pipeline.metrics())
+}
@@ -0,0 +1,154 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-09-26 16:02:13
+ * @Description: 情报实时推送（SSE）
+ * 订阅语法与钉钉订阅一致：频道+子频道白名单/黑名单
+ * /intel/stream?types=news,price&wl=news:btc,news:eth&bl=price:doge&last_seq=123
+ * 断线重连时通过last_seq参数或Last-Event-ID头补发错过的情报
+ * 错过的情报超过streamBacklogSize条时，多出的部分不补发，而是发送一个gap事件（{"from":x,"to":y}），客户端可以通过/intel/list补齐
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aztecqt/center_server/server/web"
+	"github.com/aztecqt/dagger/util"
+)
+
+const (
+	streamBufSize     = 256  // 每个订阅者的缓冲区大小
+	streamBacklogSize = 1000 // 重连时最多补发的情报数量
+)
+
+// 从请求参数中构造过滤器。types为空表示接收所有频道
+func streamFilterFromQuery(r *http.Request) *dingUserTypeFilter {
+	q := r.URL.Query()
+	return buildTypeFilter(splitParam(q.Get("types")), splitParam(q.Get("wl")), splitParam(q.Get("bl")))
+}
+
+// 构造频道过滤器，wl/bl的格式为"频道:子频道"。types为空时返回nil，表示接收所有频道
+func buildTypeFilter(types, wl, bl []string) *dingUserTypeFilter {
+	if len(types) == 0 {
+		return nil
+	}
+
+	f := newDingUserTypeFilter()
+	for _, t := range types {
+		f.SubTypeFilters[strings.ToLower(t)] = newDingUserSubtypeFilter()
+	}
+
+	for _, pair := range wl {
+		if mainType, subType, ok := strings.Cut(strings.ToLower(pair), ":"); ok {
+			if stf, ok := f.SubTypeFilters[mainType]; ok {
+				stf.WlSubtypes[subType] = 0
+			}
+		}
+	}
+
+	for _, pair := range bl {
+		if mainType, subType, ok := strings.Cut(strings.ToLower(pair), ":"); ok {
+			if stf, ok := f.SubTypeFilters[mainType]; ok {
+				stf.BlSubtypes[subType] = 0
+			}
+		}
+	}
+
+	return f
+}
+
+func splitParam(str string) []string {
+	rst := make([]string, 0)
+	for _, v := range strings.Split(str, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			rst = append(rst, v)
+		}
+	}
+	return rst
+}
+
+// 补发中断的事件，from~to之间的情报没有发送。id为to，客户端重连时从to之后继续
+func gapSSEEvent(from, to int) web.SSEEvent {
+	return web.SSEEvent{
+		Id:    fmt.Sprintf("%d", to),
+		Event: "gap",
+		Data:  fmt.Sprintf(`{"from":%d,"to":%d}`, from, to),
+	}
+}
+
+func intelToSSEEvent(intel Intel, data string) web.SSEEvent {
+	return web.SSEEvent{
+		Id:      fmt.Sprintf("%d", intel.Seq),
+		Event:   "intel",
+		Data:    data,
+		Payload: intel,
+	}
+}
+
+// /intel/stream
+func (s *Service) onHttpIntelStream(w http.ResponseWriter, r *http.Request) {
+	defer util.DefaultRecover()
+	if !s.checkReader(w, r) {
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter := streamFilterFromQuery(r)
+	match := func(intel *Intel) bool {
+		return filter == nil || filter.match(strings.ToLower(intel.Type), strings.ToLower(intel.SubType))
+	}
+
+	// 先订阅，再读取补发内容，避免两者之间的情报丢失
+	sub := s.stream.Subscribe(streamBufSize, func(evt web.SSEEvent) bool {
+		intel := evt.Payload.(Intel)
+		return match(&intel)
+	})
+
+	lastSeqStr := r.URL.Query().Get("last_seq")
+	if len(lastSeqStr) == 0 {
+		lastSeqStr = r.Header.Get("Last-Event-ID")
+	}
+
+	backlog := make([]web.SSEEvent, 0)
+	lastSent := -1
+	if lastSeq, ok := util.String2Int(lastSeqStr); ok {
+		lastSent = lastSeq
+		cursor := lastSeq
+		for {
+			rst := s.queryIntels(intelQuery{SinceSeq: cursor, Level: -1, Limit: streamBacklogSize})
+			for _, intel := range rst.Intels {
+				if !match(&intel) {
+					lastSent = intel.Seq
+					continue
+				}
+
+				// 补发数量超过上限，剩余部分以gap事件通知客户端，由客户端通过/intel/list自行补齐
+				if len(backlog) >= streamBacklogSize {
+					backlog = append(backlog, gapSSEEvent(lastSent+1, rst.LatestSeq))
+					lastSent = rst.LatestSeq
+					break
+				}
+
+				backlog = append(backlog, intelToSSEEvent(intel, intelJson(intel)))
+				lastSent = intel.Seq
+			}
+
+			if lastSent >= rst.LatestSeq || !rst.HasMore {
+				break
+			}
+			cursor = rst.NextSinceSeq
+		}
+	}
+
+	web.ServeSSE(w, r, s.stream, sub, backlog, func(evt web.SSEEvent) bool {
+		return evt.Payload.(Intel).Seq <= lastSent
+	})
+}
@@ -0,0 +1,83 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-26 15:47:10
+ * @Description: 情报实时推送的测试
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aztecqt/center_server/server/web"
+)
+
+func TestBuildTypeFilter(t *testing.T) {
+	if f := buildTypeFilter(nil, []string{"news:btc"}, nil); f != nil {
+		t.Fatal("empty types should match all channels")
+	}
+
+	f := buildTypeFilter([]string{"News", "price"}, []string{"news:btc", "other:x", "bad"}, []string{"price:DOGE"})
+	cases := map[[2]string]bool{
+		{"news", "btc"}:   true,
+		{"news", "eth"}:   false,
+		{"price", "eth"}:  true,
+		{"price", "doge"}: false,
+		{"other", "x"}:    false,
+	}
+	for c, expected := range cases {
+		if f.match(c[0], c[1]) != expected {
+			t.Errorf("%s/%s: expected %v", c[0], c[1], expected)
+		}
+	}
+}
+
+// 客户端已经断开的请求，ServeSSE发送完补发内容后立即返回
+func serveTestStream(s *Service, query string) string {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest("GET", "/intel/stream?"+query, nil).WithContext(ctx)
+	r.Header.Set(AdminHeader_Token, s.adminToken)
+	w := httptest.NewRecorder()
+	s.onHttpIntelStream(w, r)
+	return w.Body.String()
+}
+
+func newTestStreamService(n int) *Service {
+	s := newTestQueryService(n, time.Now())
+	s.stream = web.NewSSEHub()
+	s.adminToken = "token"
+	return s
+}
+
+func TestStreamResume(t *testing.T) {
+	s := newTestStreamService(20)
+	body := serveTestStream(s, "types=news&last_seq=14")
+	if strings.Count(body, "event: intel") != 3 || !strings.Contains(body, "id: 15\n") || !strings.Contains(body, "id: 19\n") || strings.Contains(body, "id: 16\n") {
+		t.Fatalf("unexpected backlog: %s", body)
+	}
+
+	if body := serveTestStream(s, "types=news"); strings.Contains(body, "event: intel") {
+		t.Fatalf("no backlog without last_seq: %s", body)
+	}
+}
+
+func TestStreamBacklogGap(t *testing.T) {
+	n := streamBacklogSize*2 + 500
+	s := newTestStreamService(n)
+	body := serveTestStream(s, "last_seq=0")
+	if count := strings.Count(body, "event: intel"); count != streamBacklogSize {
+		t.Fatalf("expected %d intels in backlog, got %d", streamBacklogSize, count)
+	}
+
+	gap := fmt.Sprintf("id: %d\nevent: gap\ndata: {\"from\":%d,\"to\":%d}\n", n, streamBacklogSize+1, n)
+	if strings.Count(body, "event: gap") != 1 || !strings.HasSuffix(body, gap+"\n") {
+		t.Fatalf("backlog should end with a gap event, got tail %q", body[len(body)-100:])
+	}
+}
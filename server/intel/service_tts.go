@@ -0,0 +1,187 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-18 14:12:55
+ * @Description: 语音播报队列的http接口
+ * POST /intel/tts/register 注册播报端，body为TTSSpeakerSpec
+ * DELETE /intel/tts/register?id=xxx 注销播报端
+ * GET /intel/tts/pull?id=xxx&max=10 领取待播报内容，已领取未确认的内容在超时前不会再次返回
+ * GET /intel/tts/stream?id=xxx 通过SSE实时接收待播报内容（连接时先发送队列中未领取的内容）
+ * POST /intel/tts/ack?id=xxx&seq=123 确认播报完成
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/aztecqt/center_server/server/web"
+	"github.com/aztecqt/dagger/util"
+)
+
+const ttsStreamBufSize = 64
+
+// 实时推送的附加信息
+type ttsStreamPayload struct {
+	item   TTSItem
+	queues map[string]bool // 放入了哪些队列
+}
+
+func ttsItemToSSEEvent(item TTSItem, payload interface{}) web.SSEEvent {
+	b, _ := json.Marshal(item)
+	return web.SSEEvent{
+		Id:      fmt.Sprintf("%d", item.Seq),
+		Event:   "tts",
+		Data:    string(b),
+		Payload: payload,
+	}
+}
+
+// 处理情报中的TTS内容
+func (s *Service) enqueueTTS(intel *Intel) {
+	if len(intel.TTS) == 0 {
+		return
+	}
+
+	queues := s.tts.enqueue(intel)
+	if len(queues) == 0 {
+		return
+	}
+
+	item := TTSItem{Seq: intel.Seq, Time: intel.Time, Level: intel.Level, Type: intel.Type, SubType: intel.SubType, Text: intel.TTS}
+	s.ttsStream.Publish(ttsItemToSSEEvent(item, ttsStreamPayload{item: item, queues: queues}))
+}
+
+func (s *Service) onHttpTTSRegister(w http.ResponseWriter, r *http.Request) {
+	defer util.DefaultRecover()
+	if !s.checkReader(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+		if err != nil || len(body) > maxBodySize {
+			http.Error(w, "read body error", http.StatusBadRequest)
+			return
+		}
+
+		spec := TTSSpeakerSpec{}
+		if err := json.Unmarshal(body, &spec); err != nil {
+			http.Error(w, "parse body error", http.StatusBadRequest)
+			return
+		}
+
+		if len(spec.Id) == 0 {
+			http.Error(w, "missing id", http.StatusBadRequest)
+			return
+		}
+
+		s.tts.register(spec)
+		io.WriteString(w, "ok")
+	case "DELETE":
+		if !s.tts.unregister(r.URL.Query().Get("id")) {
+			http.Error(w, "speaker not found", http.StatusNotFound)
+			return
+		}
+		io.WriteString(w, "ok")
+	default:
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Service) onHttpTTSPull(w http.ResponseWriter, r *http.Request) {
+	defer util.DefaultRecover()
+	if !s.checkReader(w, r) {
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	id := q.Get("id")
+	if _, ok := s.tts.speaker(id); !ok {
+		http.Error(w, "speaker not registered", http.StatusNotFound)
+		return
+	}
+
+	max := 0
+	if str := q.Get("max"); len(str) > 0 {
+		var ok bool
+		if max, ok = util.String2Int(str); !ok {
+			http.Error(w, "invalid max", http.StatusBadRequest)
+			return
+		}
+	}
+
+	writeJson(w, s.tts.pull(id, max))
+}
+
+func (s *Service) onHttpTTSStream(w http.ResponseWriter, r *http.Request) {
+	defer util.DefaultRecover()
+	if !s.checkReader(w, r) {
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	speaker, ok := s.tts.speaker(id)
+	if !ok {
+		http.Error(w, "speaker not registered", http.StatusNotFound)
+		return
+	}
+
+	// 先订阅，再领取队列中已有的内容，避免两者之间的内容丢失
+	key := speaker.queueKey()
+	sub := s.ttsStream.Subscribe(ttsStreamBufSize, func(evt web.SSEEvent) bool {
+		return evt.Payload.(ttsStreamPayload).queues[key]
+	})
+
+	backlog := make([]web.SSEEvent, 0)
+	sent := make(map[int]bool)
+	for _, item := range s.tts.pull(id, 0) {
+		backlog = append(backlog, ttsItemToSSEEvent(item, nil))
+		sent[item.Seq] = true
+	}
+
+	// 实时内容在发送前领取，同房间的其他播报端已经领取的不再发送
+	web.ServeSSE(w, r, s.ttsStream, sub, backlog, func(evt web.SSEEvent) bool {
+		seq := evt.Payload.(ttsStreamPayload).item.Seq
+		return sent[seq] || !s.tts.claim(id, seq)
+	})
+}
+
+func (s *Service) onHttpTTSAck(w http.ResponseWriter, r *http.Request) {
+	defer util.DefaultRecover()
+	if !s.checkReader(w, r) {
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	seq, ok := util.String2Int(q.Get("seq"))
+	if !ok {
+		http.Error(w, "invalid seq", http.StatusBadRequest)
+		return
+	}
+
+	if !s.tts.ack(q.Get("id"), seq) {
+		http.Error(w, "item not found or claimed by another speaker", http.StatusNotFound)
+		return
+	}
+	io.WriteString(w, "ok")
+}
@@ -0,0 +1,200 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-19 10:18:44
+ * @Description: 情报数量统计
+ * 按小时和按天分桶，统计各频道、子频道、等级的情报数量，以及每个订阅者收到的钉钉推送数量
+ * 统计数据持久化到文件，重启后继续累计
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aztecqt/dagger/util"
+	"github.com/aztecqt/dagger/util/logger"
+)
+
+const statsFile = "intel_stats.json"
+
+const (
+	StatsPeriod_Hourly = "hourly"
+	StatsPeriod_Daily  = "daily"
+)
+
+const (
+	statsMaxHourlyBuckets = 48
+	statsMaxDailyBuckets  = 31
+	statsHourlyKeyFormat  = "2006-01-02 15"
+	statsDailyKeyFormat   = time.DateOnly
+)
+
+// 一个时间段内的统计
+type StatsBucket struct {
+	Key        string           `json:"key"` // 小时："2006-01-02 15"，天："2006-01-02"
+	Total      int64            `json:"total"`
+	ByType     map[string]int64 `json:"by_type"`
+	BySubType  map[string]int64 `json:"by_subtype"` // key为"频道/子频道"
+	ByLevel    map[string]int64 `json:"by_level"`   // key为等级
+	Deliveries map[string]int64 `json:"deliveries"` // 订阅者uid->钉钉推送数量
+}
+
+func newStatsBucket(key string) *StatsBucket {
+	b := new(StatsBucket)
+	b.Key = key
+	b.ByType = make(map[string]int64)
+	b.BySubType = make(map[string]int64)
+	b.ByLevel = make(map[string]int64)
+	b.Deliveries = make(map[string]int64)
+	return b
+}
+
+func cloneCounts(m map[string]int64) map[string]int64 {
+	c := make(map[string]int64, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func (b *StatsBucket) clone() StatsBucket {
+	return StatsBucket{
+		Key:        b.Key,
+		Total:      b.Total,
+		ByType:     cloneCounts(b.ByType),
+		BySubType:  cloneCounts(b.BySubType),
+		ByLevel:    cloneCounts(b.ByLevel),
+		Deliveries: cloneCounts(b.Deliveries),
+	}
+}
+
+type intelStats struct {
+	Hourly map[string]*StatsBucket `json:"hourly"`
+	Daily  map[string]*StatsBucket `json:"daily"`
+	dirty  bool
+	mu     sync.Mutex
+}
+
+func (s *intelStats) init() {
+	s.Hourly = make(map[string]*StatsBucket)
+	s.Daily = make(map[string]*StatsBucket)
+	if !util.ObjectFromFile(statsFile, s) {
+		logger.LogImportant(logPrefix, "load %s failed", statsFile)
+	} else {
+		logger.LogImportant(logPrefix, "load %s ok", statsFile)
+	}
+}
+
+// 保存有变化的统计，并清理过旧的分桶
+func (s *intelStats) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return
+	}
+
+	trimBuckets(s.Hourly, statsMaxHourlyBuckets)
+	trimBuckets(s.Daily, statsMaxDailyBuckets)
+	s.dirty = false
+	if !util.ObjectToFile(statsFile, s) {
+		logger.LogImportant(logPrefix, "save %s failed", statsFile)
+	}
+}
+
+// 只保留最新的max个分桶。key的格式保证按字符串排序即按时间排序
+func trimBuckets(buckets map[string]*StatsBucket, max int) {
+	if len(buckets) <= max {
+		return
+	}
+
+	keys := make([]string, 0, len(buckets))
+	for k := range buckets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys[:len(keys)-max] {
+		delete(buckets, k)
+	}
+}
+
+// 调用者需持有锁
+func (s *intelStats) buckets(t time.Time) []*StatsBucket {
+	hk := t.Format(statsHourlyKeyFormat)
+	dk := t.Format(statsDailyKeyFormat)
+	if _, ok := s.Hourly[hk]; !ok {
+		s.Hourly[hk] = newStatsBucket(hk)
+	}
+	if _, ok := s.Daily[dk]; !ok {
+		s.Daily[dk] = newStatsBucket(dk)
+	}
+	return []*StatsBucket{s.Hourly[hk], s.Daily[dk]}
+}
+
+// 记录一条收到的情报
+func (s *intelStats) recordIntel(intel *Intel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, b := range s.buckets(time.Now()) {
+		b.Total++
+		b.ByType[intel.Type]++
+		b.BySubType[fmt.Sprintf("%s/%s", intel.Type, intel.SubType)]++
+		b.ByLevel[fmt.Sprintf("%d", intel.Level)]++
+	}
+	s.dirty = true
+}
+
+// 记录对一组订阅者的一次推送
+func (s *intelStats) recordDelivery(uids ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, b := range s.buckets(time.Now()) {
+		for _, uid := range uids {
+			b.Deliveries[uid]++
+		}
+	}
+	s.dirty = true
+}
+
+// 最近n个分桶（含当前），按时间倒序。没有数据的时间段返回空分桶
+func (s *intelStats) recent(period string, n int) []StatsBucket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	source, format, step := s.Hourly, statsHourlyKeyFormat, time.Hour
+	if period == StatsPeriod_Daily {
+		source, format, step = s.Daily, statsDailyKeyFormat, time.Hour*24
+	}
+
+	rst := make([]StatsBucket, 0, n)
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		key := now.Add(-step * time.Duration(i)).Format(format)
+		if b, ok := source[key]; ok {
+			rst = append(rst, b.clone())
+		} else {
+			rst = append(rst, *newStatsBucket(key))
+		}
+	}
+	return rst
+}
+
+// 按数量倒序排列的key
+func sortedByCount(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if m[keys[i]] != m[keys[j]] {
+			return m[keys[i]] > m[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
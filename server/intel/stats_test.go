@@ -0,0 +1,112 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-26 17:21:36
+ * @Description: 情报数量统计的测试
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestStatsService() *Service {
+	s := newTestIntelService()
+	s.filter = newTestDingFilter()
+	s.stats.Hourly = make(map[string]*StatsBucket)
+	s.stats.Daily = make(map[string]*StatsBucket)
+	s.adminUids = map[string]bool{"admin": true}
+	s.adminToken = "token"
+
+	s.stats.recordIntel(&Intel{Type: "news", SubType: "cn", Level: 1})
+	s.stats.recordIntel(&Intel{Type: "news", SubType: "us", Level: 1})
+	s.stats.recordIntel(&Intel{Type: "price", Level: 2})
+	s.stats.recordDelivery("u1", "u2")
+	s.stats.recordDelivery("u1")
+	return s
+}
+
+func TestStatsRecord(t *testing.T) {
+	s := newTestStatsService()
+	for _, period := range []string{StatsPeriod_Hourly, StatsPeriod_Daily} {
+		buckets := s.stats.recent(period, 3)
+		if len(buckets) != 3 || buckets[1].Total != 0 || buckets[2].Total != 0 {
+			t.Fatalf("%s: expected 3 buckets with only the current one filled, got %+v", period, buckets)
+		}
+
+		b := buckets[0]
+		if b.Total != 3 || b.ByType["news"] != 2 || b.BySubType["news/cn"] != 1 || b.BySubType["price/"] != 1 ||
+			b.ByLevel["1"] != 2 || b.Deliveries["u1"] != 2 || b.Deliveries["u2"] != 1 {
+			t.Fatalf("%s: unexpected bucket %+v", period, b)
+		}
+	}
+
+	// 返回的是副本
+	s.stats.recent(StatsPeriod_Hourly, 1)[0].ByType["news"] = 100
+	if s.stats.recent(StatsPeriod_Hourly, 1)[0].ByType["news"] != 2 {
+		t.Fatal("recent should return copies")
+	}
+}
+
+func TestTrimBuckets(t *testing.T) {
+	buckets := make(map[string]*StatsBucket)
+	for i := 1; i <= 5; i++ {
+		key := fmt.Sprintf("2023-10-%02d", i)
+		buckets[key] = newStatsBucket(key)
+	}
+
+	trimBuckets(buckets, 3)
+	if len(buckets) != 3 || buckets["2023-10-02"] != nil || buckets["2023-10-05"] == nil {
+		t.Fatalf("only the latest buckets should be kept, got %v", buckets)
+	}
+}
+
+func TestHttpStatsDeliveries(t *testing.T) {
+	s := newTestStatsService()
+	s.auth.init(nil, 0)
+
+	for token, visible := range map[string]bool{"": false, "wrong": false, "token": true} {
+		r := httptest.NewRequest("GET", "/intel/stats?period=daily&n=2", nil)
+		if len(token) > 0 {
+			r.Header.Set(AdminHeader_Token, token)
+		}
+		w := httptest.NewRecorder()
+		s.onHttpIntelStats(w, r)
+
+		buckets := []StatsBucket{}
+		if err := json.Unmarshal(w.Body.Bytes(), &buckets); err != nil || len(buckets) != 2 || buckets[0].Total != 3 {
+			t.Fatalf("token=%q: unexpected response %s", token, w.Body.String())
+		}
+
+		if (buckets[0].Deliveries["u1"] == 2) != visible {
+			t.Errorf("token=%q: deliveries visible should be %v, got %v", token, visible, buckets[0].Deliveries)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s.onHttpIntelStats(w, httptest.NewRequest("GET", "/intel/stats?period=weekly", nil))
+	if w.Code != 400 {
+		t.Fatalf("invalid period should be rejected, got %d", w.Code)
+	}
+}
+
+func TestOnCmdStats(t *testing.T) {
+	s := newTestStatsService()
+	resp := ""
+	onResp := func(str string) { resp = str }
+
+	s.onCmdStats([]string{"stats"}, "u1", onResp)
+	if !strings.Contains(resp, "  news: 2\n") || !strings.Contains(resp, "今日收到的推送: 2条") || strings.Contains(resp, "推送最多") {
+		t.Fatalf("unexpected response for user: %s", resp)
+	}
+
+	s.onCmdStats([]string{"stats"}, "admin", onResp)
+	if !strings.Contains(resp, "今日推送最多的订阅者") || !strings.Contains(resp, "(u2): 1") || !strings.Contains(resp, "处理队列") {
+		t.Fatalf("unexpected response for admin: %s", resp)
+	}
+}
@@ -0,0 +1,310 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-18 10:41:26
+ * @Description: 语音播报队列
+ * 播报端（speaker）注册自己的频道过滤条件，服务器把带TTS内容的情报放入队列，播报端拉取或者通过SSE接收，播报完成后确认
+ * 同一个房间（room）的多个播报端共享一个队列，一条情报只会被其中一个播报端领取，避免重复播报
+ * 领取后超时未确认的条目可以被重新领取；时间较久的条目排在新条目之后，过期的条目直接丢弃
+ * 拉取只返回未领取或者领取超时的条目，已领取未确认的条目不会在每次拉取时重复返回
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aztecqt/dagger/util"
+	"github.com/aztecqt/dagger/util/logger"
+)
+
+const ttsSpeakerFile = "tts_speakers.json"
+
+const (
+	ttsDefaultStaleSec      = 60
+	ttsDefaultExpireSec     = 600
+	ttsDefaultAckTimeoutSec = 30
+	ttsMaxQueueSize         = 200 // 每个队列的最大条目数，超出时丢弃最旧的
+)
+
+// 播报端的注册信息
+type TTSSpeakerSpec struct {
+	Id       string   `json:"id"`
+	Name     string   `json:"name"`
+	Room     string   `json:"room"`      // 房间，同房间的播报端不会重复播报同一条情报。为空表示独立播报
+	Types    []string `json:"types"`     // 接收的频道，为空表示所有频道
+	Wl       []string `json:"wl"`        // 子频道白名单，格式为"频道:子频道"
+	Bl       []string `json:"bl"`        // 子频道黑名单，格式同上
+	MinLevel int      `json:"min_level"` // 最低情报等级
+	Debug    bool     `json:"debug"`     // 是否播报调试情报（等级0），默认不播报
+}
+
+type ttsSpeaker struct {
+	spec   TTSSpeakerSpec
+	filter *dingUserTypeFilter
+}
+
+func newTTSSpeaker(spec TTSSpeakerSpec) *ttsSpeaker {
+	return &ttsSpeaker{spec: spec, filter: buildTypeFilter(spec.Types, spec.Wl, spec.Bl)}
+}
+
+// 播报端所在的队列
+func (s *ttsSpeaker) queueKey() string {
+	return util.ValueIf(len(s.spec.Room) > 0, "room:"+s.spec.Room, "speaker:"+s.spec.Id)
+}
+
+func (s *ttsSpeaker) match(item *TTSItem) bool {
+	if item.Level < s.spec.MinLevel || (item.Level == 0 && !s.spec.Debug) {
+		return false
+	}
+	return s.filter == nil || s.filter.match(strings.ToLower(item.Type), strings.ToLower(item.SubType))
+}
+
+// 一条待播报的内容
+type TTSItem struct {
+	Seq     int       `json:"seq"`
+	Time    time.Time `json:"time"`
+	Level   int       `json:"level"`
+	Type    string    `json:"type"`
+	SubType string    `json:"subtype"`
+	Text    string    `json:"text"`
+	Stale   bool      `json:"stale"` // 已经等待较久，播报端可以酌情跳过
+
+	enqueueTime time.Time
+	claimedBy   string
+	claimTime   time.Time
+}
+
+type ttsQueue struct {
+	speakers map[string]*ttsSpeaker
+	queues   map[string][]*TTSItem // queueKey->条目
+
+	staleDuration  time.Duration
+	expireDuration time.Duration
+	ackTimeout     time.Duration
+
+	mu sync.Mutex
+}
+
+func (q *ttsQueue) init(staleSec, expireSec, ackTimeoutSec int) {
+	q.speakers = make(map[string]*ttsSpeaker)
+	q.queues = make(map[string][]*TTSItem)
+	q.staleDuration = time.Second * time.Duration(util.ValueIf(staleSec > 0, staleSec, ttsDefaultStaleSec))
+	q.expireDuration = time.Second * time.Duration(util.ValueIf(expireSec > 0, expireSec, ttsDefaultExpireSec))
+	q.ackTimeout = time.Second * time.Duration(util.ValueIf(ackTimeoutSec > 0, ackTimeoutSec, ttsDefaultAckTimeoutSec))
+
+	specs := make([]TTSSpeakerSpec, 0)
+	if util.ObjectFromFile(ttsSpeakerFile, &specs) {
+		for _, spec := range specs {
+			q.speakers[spec.Id] = newTTSSpeaker(spec)
+		}
+		logger.LogImportant(logPrefix, "load %s ok, %d speakers", ttsSpeakerFile, len(q.speakers))
+	}
+}
+
+// 调用者需持有锁
+func (q *ttsQueue) toFile() {
+	specs := make([]TTSSpeakerSpec, 0, len(q.speakers))
+	for _, s := range q.speakers {
+		specs = append(specs, s.spec)
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Id < specs[j].Id })
+
+	if !util.ObjectToFile(ttsSpeakerFile, specs) {
+		logger.LogImportant(logPrefix, "save %s failed", ttsSpeakerFile)
+	}
+}
+
+// 注册或者更新播报端
+func (q *ttsQueue) register(spec TTSSpeakerSpec) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.speakers[spec.Id] = newTTSSpeaker(spec)
+	q.toFile()
+	logger.LogImportant(logPrefix, "tts speaker registered: id=%s, name=%s, room=%s", spec.Id, spec.Name, spec.Room)
+}
+
+// 注销播报端
+func (q *ttsQueue) unregister(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.speakers[id]; !ok {
+		return false
+	}
+
+	delete(q.speakers, id)
+	q.toFile()
+	return true
+}
+
+func (q *ttsQueue) speaker(id string) (*ttsSpeaker, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s, ok := q.speakers[id]
+	return s, ok
+}
+
+// 把情报放入所有匹配的队列，返回放入的队列
+func (q *ttsQueue) enqueue(intel *Intel) map[string]bool {
+	item := TTSItem{
+		Seq:         intel.Seq,
+		Time:        intel.Time,
+		Level:       intel.Level,
+		Type:        intel.Type,
+		SubType:     intel.SubType,
+		Text:        intel.TTS,
+		enqueueTime: time.Now(),
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	keys := make(map[string]bool)
+	for _, s := range q.speakers {
+		if s.match(&item) {
+			keys[s.queueKey()] = true
+		}
+	}
+
+	for key := range keys {
+		copied := item
+		queue := append(q.queues[key], &copied)
+		if len(queue) > ttsMaxQueueSize {
+			queue = queue[len(queue)-ttsMaxQueueSize:]
+		}
+		q.queues[key] = queue
+	}
+	return keys
+}
+
+// 未被领取，或者领取已超时。调用者需持有锁
+func (q *ttsQueue) available(item *TTSItem, now time.Time) bool {
+	return len(item.claimedBy) == 0 || now.Sub(item.claimTime) > q.ackTimeout
+}
+
+// 可以被speakerId领取或确认，包括它自己领取中的条目。调用者需持有锁
+func (q *ttsQueue) claimable(item *TTSItem, speakerId string, now time.Time) bool {
+	return item.claimedBy == speakerId || q.available(item, now)
+}
+
+// 领取最多max条未领取（或领取超时）的待播报内容。新条目优先（等级高的在前），较久的条目排在后面
+func (q *ttsQueue) pull(speakerId string, max int) []TTSItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	rst := make([]TTSItem, 0)
+	s, ok := q.speakers[speakerId]
+	if !ok {
+		return rst
+	}
+
+	now := time.Now()
+	candidates := make([]*TTSItem, 0)
+	for _, item := range q.queues[s.queueKey()] {
+		if s.match(item) && q.available(item, now) {
+			item.Stale = now.Sub(item.enqueueTime) > q.staleDuration
+			candidates = append(candidates, item)
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Stale != candidates[j].Stale {
+			return !candidates[i].Stale
+		}
+		if candidates[i].Level != candidates[j].Level {
+			return candidates[i].Level > candidates[j].Level
+		}
+		return candidates[i].Seq < candidates[j].Seq
+	})
+
+	for _, item := range candidates {
+		if max > 0 && len(rst) >= max {
+			break
+		}
+		item.claimedBy = speakerId
+		item.claimTime = now
+		rst = append(rst, *item)
+	}
+	return rst
+}
+
+// 领取一条指定的内容，用于实时推送。同房间的其他播报端已经领取时返回false
+func (q *ttsQueue) claim(speakerId string, seq int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	s, ok := q.speakers[speakerId]
+	if !ok {
+		return false
+	}
+
+	now := time.Now()
+	for _, item := range q.queues[s.queueKey()] {
+		if item.Seq == seq {
+			if !s.match(item) || !q.claimable(item, speakerId, now) {
+				return false
+			}
+			item.claimedBy = speakerId
+			item.claimTime = now
+			return true
+		}
+	}
+	return false
+}
+
+// 确认播报完成，从队列中移除。同房间其他播报端领取中（未超时）的条目不能确认
+func (q *ttsQueue) ack(speakerId string, seq int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	s, ok := q.speakers[speakerId]
+	if !ok {
+		return false
+	}
+
+	key := s.queueKey()
+	for i, item := range q.queues[key] {
+		if item.Seq == seq {
+			if !q.claimable(item, speakerId, time.Now()) {
+				return false
+			}
+			q.queues[key] = util.SliceRemoveAt(q.queues[key], i)
+			return true
+		}
+	}
+	return false
+}
+
+// 丢弃过期条目，以及已经没有播报端的队列
+func (q *ttsQueue) cleanup() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	alive := make(map[string]bool)
+	for _, s := range q.speakers {
+		alive[s.queueKey()] = true
+	}
+
+	now := time.Now()
+	for key, queue := range q.queues {
+		if !alive[key] {
+			delete(q.queues, key)
+			continue
+		}
+
+		kept := make([]*TTSItem, 0, len(queue))
+		for _, item := range queue {
+			if now.Sub(item.enqueueTime) <= q.expireDuration {
+				kept = append(kept, item)
+			}
+		}
+
+		if dropped := len(queue) - len(kept); dropped > 0 {
+			logger.LogInfo(logPrefix, "tts queue %s: %d expired items dropped", key, dropped)
+		}
+		q.queues[key] = kept
+	}
+}
@@ -0,0 +1,143 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-25 14:31:50
+ * @Description: 语音播报队列领取/确认的测试
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package intel
+
+import (
+	"testing"
+	"time"
+)
+
+// 直接构造播报端，不经过register，避免写入文件
+func newTestTTSQueue(specs ...TTSSpeakerSpec) *ttsQueue {
+	q := &ttsQueue{
+		speakers:       make(map[string]*ttsSpeaker),
+		queues:         make(map[string][]*TTSItem),
+		staleDuration:  time.Minute,
+		expireDuration: time.Minute * 10,
+		ackTimeout:     time.Second * 30,
+	}
+
+	for _, spec := range specs {
+		q.speakers[spec.Id] = newTTSSpeaker(spec)
+	}
+	return q
+}
+
+func TestTTSRoomClaim(t *testing.T) {
+	q := newTestTTSQueue(TTSSpeakerSpec{Id: "a", Room: "r1"}, TTSSpeakerSpec{Id: "b", Room: "r1"})
+	if keys := q.enqueue(&Intel{Seq: 1, Level: 1, Type: "news", TTS: "hello"}); len(keys) != 1 {
+		t.Fatalf("speakers in the same room should share one queue, got %v", keys)
+	}
+
+	if !q.claim("a", 1) {
+		t.Fatal("a should claim the item")
+	}
+
+	// 同房间的b不能领取、拉取或确认a领取中的条目
+	if q.claim("b", 1) || len(q.pull("b", 0)) != 0 || q.ack("b", 1) {
+		t.Fatal("item claimed by a should not be available to b")
+	}
+
+	// a可以重复领取并确认
+	if !q.claim("a", 1) || !q.ack("a", 1) {
+		t.Fatal("a should ack its own item")
+	}
+
+	if q.ack("a", 1) || len(q.queues["room:r1"]) != 0 {
+		t.Fatal("acked item should be removed")
+	}
+}
+
+func TestTTSClaimTimeout(t *testing.T) {
+	q := newTestTTSQueue(TTSSpeakerSpec{Id: "a", Room: "r1"}, TTSSpeakerSpec{Id: "b", Room: "r1"})
+	q.enqueue(&Intel{Seq: 1, Level: 1, TTS: "hello"})
+	if items := q.pull("a", 0); len(items) != 1 {
+		t.Fatalf("a should pull 1 item, got %d", len(items))
+	}
+
+	// a领取后超时未确认，b可以接手
+	q.queues["room:r1"][0].claimTime = time.Now().Add(-q.ackTimeout - time.Second)
+	if items := q.pull("b", 0); len(items) != 1 || items[0].Seq != 1 {
+		t.Fatalf("b should take over the timed out item, got %v", items)
+	}
+
+	if q.ack("a", 1) || !q.ack("b", 1) {
+		t.Fatal("only the new claimer can ack")
+	}
+}
+
+func TestTTSPullOnce(t *testing.T) {
+	q := newTestTTSQueue(TTSSpeakerSpec{Id: "a"})
+	q.enqueue(&Intel{Seq: 1, Level: 1, TTS: "hello"})
+	if items := q.pull("a", 0); len(items) != 1 {
+		t.Fatalf("a should pull 1 item, got %d", len(items))
+	}
+
+	// 已领取未确认的条目不再重复返回，但仍可以确认
+	if items := q.pull("a", 0); len(items) != 0 {
+		t.Fatalf("claimed item should not be pulled again, got %+v", items)
+	}
+
+	q.enqueue(&Intel{Seq: 2, Level: 1, TTS: "world"})
+	if items := q.pull("a", 0); len(items) != 1 || items[0].Seq != 2 {
+		t.Fatalf("only the new item should be pulled, got %+v", items)
+	}
+
+	if !q.ack("a", 1) || !q.ack("a", 2) {
+		t.Fatal("pulled items should be acked")
+	}
+
+	// 自己领取超时未确认的条目会再次返回
+	q.enqueue(&Intel{Seq: 3, Level: 1, TTS: "again"})
+	q.pull("a", 0)
+	q.queues["speaker:a"][0].claimTime = time.Now().Add(-q.ackTimeout - time.Second)
+	if items := q.pull("a", 0); len(items) != 1 || items[0].Seq != 3 {
+		t.Fatalf("timed out item should be pulled again, got %+v", items)
+	}
+}
+
+func TestTTSSeparateSpeakers(t *testing.T) {
+	q := newTestTTSQueue(TTSSpeakerSpec{Id: "a"}, TTSSpeakerSpec{Id: "b"})
+	if keys := q.enqueue(&Intel{Seq: 1, Level: 1, TTS: "hello"}); len(keys) != 2 {
+		t.Fatalf("speakers without room should have their own queues, got %v", keys)
+	}
+
+	if !q.claim("a", 1) || !q.claim("b", 1) || !q.ack("a", 1) || !q.ack("b", 1) {
+		t.Fatal("speakers without room should not block each other")
+	}
+}
+
+func TestTTSDebugItems(t *testing.T) {
+	q := newTestTTSQueue(TTSSpeakerSpec{Id: "a"}, TTSSpeakerSpec{Id: "d", Debug: true})
+	keys := q.enqueue(&Intel{Seq: 1, Level: 0, TTS: "debug"})
+	if len(keys) != 1 || !keys["speaker:d"] {
+		t.Fatalf("debug item should only go to debug speakers, got %v", keys)
+	}
+
+	if q.claim("a", 1) || !q.claim("d", 1) {
+		t.Fatal("debug item claim broken")
+	}
+}
+
+func TestTTSPullOrder(t *testing.T) {
+	q := newTestTTSQueue(TTSSpeakerSpec{Id: "a"})
+	q.enqueue(&Intel{Seq: 1, Level: 1, TTS: "old"})
+	q.enqueue(&Intel{Seq: 2, Level: 1, TTS: "low"})
+	q.enqueue(&Intel{Seq: 3, Level: 3, TTS: "high"})
+	q.queues["speaker:a"][0].enqueueTime = time.Now().Add(-q.staleDuration - time.Second)
+
+	// 新条目优先且等级高的在前，较久的条目排在最后
+	if items := q.pull("a", 1); len(items) != 1 || items[0].Seq != 3 {
+		t.Fatalf("pull should respect max, got %+v", items)
+	}
+
+	items := q.pull("a", 0)
+	if len(items) != 2 || items[0].Seq != 2 || items[1].Seq != 1 || !items[1].Stale {
+		t.Fatalf("unexpected pull order: %+v", items)
+	}
+}
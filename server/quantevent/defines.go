@@ -6,3 +6,13 @@
  * Copyright (c) 2023 by aztec, All Rights Reserved.
  */
 package quantevent
+
+import "github.com/aztecqt/center_server/server/stratergys"
+
+const maxBodySize = 1024 * 128 // 请求body的最大长度
+
+// 修改事件类型（POST/DELETE /quantevent/type）时需要携带的令牌
+const AdminHeader_Token = "X-QuantEvent-Admin-Token"
+
+// /quantevent/new 的返回内容
+type NewEventResp = stratergys.QuantEventSendResult
@@ -8,30 +8,133 @@
 package quantevent
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"time"
 
 	"github.com/aztecqt/center_server/server/stratergys"
 	"github.com/aztecqt/dagger/util/logger"
-	"github.com/aztecqt/dagger/util/network"
 )
 
 // 向服务器提交一个量化事件
 type Sender struct {
-	url string
+	url    string
+	client *http.Client
+
+	RetryCount    int           // 网络错误时的重试次数
+	RetryInterval time.Duration // 重试间隔
+	PollInterval  time.Duration // 等待确认时查询投递状态的间隔
 }
 
 func NewSender(url string) *Sender {
 	s := new(Sender)
 	s.url = url
+	s.client = &http.Client{Timeout: time.Second * 5}
+	s.RetryCount = 3
+	s.RetryInterval = time.Second
+	s.PollInterval = time.Millisecond * 500
 	return s
 }
 
-func (s *Sender) Send(event stratergys.QuantEvent) {
+// 提交事件，返回服务器分配的序列号和投递的策略数量
+// 注意：网络错误时会重试，如果服务器其实已经收到了请求，事件可能被投递多次
+func (s *Sender) Send(event stratergys.QuantEvent) (NewEventResp, error) {
+	resp := NewEventResp{}
+	b, err := json.Marshal(event)
+	if err != nil {
+		return resp, err
+	}
+
 	url := fmt.Sprintf("%s/quantevent/new", s.url)
-	network.HttpCall(url, "POST", "", nil, func(r *http.Response, err error) {
+	body, err := s.call("POST", url, b)
+	if err != nil {
+		return resp, err
+	}
+
+	err = json.Unmarshal(body, &resp)
+	return resp, err
+}
+
+// 查询事件的投递状态
+func (s *Sender) Status(eseq int) (stratergys.QuantEventStatus, error) {
+	st := stratergys.QuantEventStatus{}
+	url := fmt.Sprintf("%s/quantevent/status?eseq=%d", s.url, eseq)
+	body, err := s.call("GET", url, nil)
+	if err != nil {
+		return st, err
+	}
+
+	err = json.Unmarshal(body, &st)
+	return st, err
+}
+
+// 提交事件，并阻塞等待所有策略确认（或超时）。事件带有Quorum时，同时等待确认结果
+// 返回最后一次查询到的投递状态。超时返回错误，此时状态中未完成的投递仍可查看
+func (s *Sender) SendAndWait(event stratergys.QuantEvent, timeout time.Duration) (stratergys.QuantEventStatus, error) {
+	resp, err := s.Send(event)
+	if err != nil {
+		return stratergys.QuantEventStatus{}, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		st, err := s.Status(resp.EventSeq)
+		if err == nil && st.Finished && (event.Quorum == nil || st.Quorum != nil) {
+			return st, nil
+		}
+
+		if time.Now().After(deadline) {
+			if err == nil {
+				err = errors.New("wait for acks timeout")
+			}
+			return st, err
+		}
+
+		time.Sleep(s.PollInterval)
+	}
+}
+
+// 执行http请求。只有网络错误会重试，服务器返回的错误直接返回
+func (s *Sender) call(method, url string, payload []byte) ([]byte, error) {
+	var lastErr error
+	for i := 0; i <= s.RetryCount; i++ {
+		if i > 0 {
+			time.Sleep(s.RetryInterval)
+		}
+
+		req, err := http.NewRequest(method, url, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+
+		if payload != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		r, err := s.client.Do(req)
 		if err != nil {
-			logger.LogImportant(logPrefix, err.Error())
+			lastErr = err
+			logger.LogImportant(logPrefix, "%s %s failed(%d/%d), err=%s", method, url, i+1, s.RetryCount+1, err.Error())
+			continue
 		}
-	})
+
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if r.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s %s failed, status=%d, body=%s", method, url, r.StatusCode, string(body))
+		}
+
+		return body, nil
+	}
+
+	return nil, lastErr
 }
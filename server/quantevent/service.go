@@ -8,6 +8,7 @@
 package quantevent
 
 import (
+	"crypto/hmac"
 	"encoding/json"
 	"io"
 	"net/http"
@@ -21,31 +22,152 @@ import (
 const logPrefix = "service-quantevent"
 
 type Service struct {
+	adminToken string // 为空表示不允许通过http修改事件类型
 }
 
-func (s *Service) Start(webservice *web.Service) {
+func (s *Service) Start(webservice *web.Service, adminToken string) {
+	s.adminToken = adminToken
 	webservice.RegisterPath("/quantevent/new", s.onHttp_NewQuantEvent)
+	webservice.RegisterPath("/quantevent/status", s.onHttp_QuantEventStatus)
+	webservice.RegisterPath("/quantevent/types", s.onHttp_QuantEventTypes)
+	webservice.RegisterPath("/quantevent/type", s.onHttp_QuantEventType)
 }
 
 func (s *Service) onHttp_NewQuantEvent(w http.ResponseWriter, r *http.Request) {
 	defer util.DefaultRecover()
-	if r.Method == "POST" {
-		qe := stratergys.QuantEvent{}
-		body := make([]byte, 1024*128)
-		n, err := r.Body.Read(body)
-		if err == nil || err == io.EOF {
-			err = json.Unmarshal(body[:n], &qe)
-			if err != nil {
-				logger.LogImportant(logPrefix, "parse body error, err=%s", err.Error())
-				io.WriteString(w, "internal error")
-			}
-
-			// 解析成功，处理这个intel
-			io.WriteString(w, "ok")
-			stratergys.Instance().SendQuantEvent(qe.EventName, qe.EventParam)
-		} else {
-			logger.LogImportant(logPrefix, "read body error, err=%s", err.Error())
-			io.WriteString(w, "internal error")
+	if r.Method != "POST" {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	if err != nil {
+		logger.LogImportant(logPrefix, "read body error, err=%s", err.Error())
+		http.Error(w, "read body error", http.StatusBadRequest)
+		return
+	}
+
+	if len(body) > maxBodySize {
+		http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	qe := stratergys.QuantEvent{}
+	if err := json.Unmarshal(body, &qe); err != nil {
+		logger.LogImportant(logPrefix, "parse body error, err=%s", err.Error())
+		http.Error(w, "parse body error", http.StatusBadRequest)
+		return
+	}
+
+	if len(qe.EventName) == 0 {
+		http.Error(w, "missing ename", http.StatusBadRequest)
+		return
+	}
+
+	// 解析成功，投递这个事件
+	resp, err := stratergys.Instance().SendQuantEvent(qe)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	b, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// /quantevent/status?eseq=123
+func (s *Service) onHttp_QuantEventStatus(w http.ResponseWriter, r *http.Request) {
+	defer util.DefaultRecover()
+	if r.Method != "GET" {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	seq, ok := util.String2Int(r.URL.Query().Get("eseq"))
+	if !ok {
+		http.Error(w, "invalid eseq", http.StatusBadRequest)
+		return
+	}
+
+	st, ok := stratergys.Instance().QuantEventStatus(seq)
+	if !ok {
+		http.Error(w, "event not found", http.StatusNotFound)
+		return
+	}
+
+	b, _ := json.Marshal(st)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// /quantevent/types 列出所有已声明的事件类型
+func (s *Service) onHttp_QuantEventTypes(w http.ResponseWriter, r *http.Request) {
+	defer util.DefaultRecover()
+	b, _ := json.Marshal(stratergys.Instance().QuantEventTypes())
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// 验证修改事件类型的令牌。失败时已写入错误应答
+func (s *Service) checkAdminToken(w http.ResponseWriter, r *http.Request) bool {
+	if len(s.adminToken) == 0 {
+		http.Error(w, "admin api disabled", http.StatusForbidden)
+		return false
+	}
+
+	if !hmac.Equal([]byte(r.Header.Get(AdminHeader_Token)), []byte(s.adminToken)) {
+		logger.LogImportant(logPrefix, "rejected %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+// /quantevent/type，需要管理令牌
+// POST：声明（或更新）一个事件类型，body为QuantEventType
+// DELETE：/quantevent/type?name=xxx 删除一个事件类型
+func (s *Service) onHttp_QuantEventType(w http.ResponseWriter, r *http.Request) {
+	defer util.DefaultRecover()
+	if r.Method != "POST" && r.Method != "DELETE" {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !s.checkAdminToken(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+		if err != nil || len(body) > maxBodySize {
+			http.Error(w, "read body error", http.StatusBadRequest)
+			return
+		}
+
+		t := stratergys.QuantEventType{}
+		if err := json.Unmarshal(body, &t); err != nil {
+			http.Error(w, "parse body error", http.StatusBadRequest)
+			return
 		}
+
+		if err := stratergys.Instance().RegisterQuantEventType(t); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logger.LogImportant(logPrefix, "quant-event type [%s] registered", t.Name)
+		io.WriteString(w, "ok")
+	case "DELETE":
+		name := r.URL.Query().Get("name")
+		if !stratergys.Instance().RemoveQuantEventType(name) {
+			http.Error(w, "event type not found", http.StatusNotFound)
+			return
+		}
+
+		logger.LogImportant(logPrefix, "quant-event type [%s] removed", name)
+		io.WriteString(w, "ok")
 	}
 }
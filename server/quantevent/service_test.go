@@ -0,0 +1,44 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-26 10:52:09
+ * @Description: 事件类型管理接口权限的测试
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package quantevent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestQuantEventTypeAuth(t *testing.T) {
+	cases := []struct {
+		adminToken string
+		method     string
+		token      string
+		expected   int
+	}{
+		{"", "POST", "", http.StatusForbidden},
+		{"", "DELETE", "any", http.StatusForbidden},
+		{"secret", "POST", "", http.StatusUnauthorized},
+		{"secret", "DELETE", "wrong", http.StatusUnauthorized},
+		{"secret", "GET", "secret", http.StatusMethodNotAllowed},
+	}
+
+	for _, c := range cases {
+		s := &Service{adminToken: c.adminToken}
+		r := httptest.NewRequest(c.method, "/quantevent/type?name=x", strings.NewReader(`{"name":"x"}`))
+		if len(c.token) > 0 {
+			r.Header.Set(AdminHeader_Token, c.token)
+		}
+
+		w := httptest.NewRecorder()
+		s.onHttp_QuantEventType(w, r)
+		if w.Code != c.expected {
+			t.Errorf("admin_token=%q %s token=%q: expected %d, got %d", c.adminToken, c.method, c.token, c.expected, w.Code)
+		}
+	}
+}
@@ -10,6 +10,7 @@
 package server
 
 import (
+	"github.com/aztecqt/center_server/dingbot"
 	"github.com/aztecqt/center_server/server/activestatus"
 	"github.com/aztecqt/center_server/server/antntf"
 	"github.com/aztecqt/center_server/server/file"
@@ -35,19 +36,20 @@ type LaunchConfig struct {
 			Port    int  `json:"port"`
 		} `json:"web"`
 		Stratergy struct {
-			Enabled       bool   `json:"enabled"`
-			Port          int    `json:"port"`
-			DingbotSecret string `json:"ding_bot_secret"`
+			Enabled            bool   `json:"enabled"`
+			Port               int    `json:"port"`
+			DingbotSecret      string `json:"ding_bot_secret"`
+			NameConflictPolicy string `json:"name_conflict_policy"`    // allow/reject/suffix，默认allow
+			QuantEventDebounce int    `json:"quant_event_debounce_ms"` // 相同量化事件的防抖窗口，0表示不防抖
+			AllowUndeclared    *bool  `json:"allow_undeclared"`        // 是否放行未声明的量化事件，默认放行
 		} `json:"stratergy"`
 		ActiveStatus struct {
 			Enabled bool `json:"enabled"`
 		} `json:"active_status"`
-		Intel struct {
-			Enabled       bool   `json:"enabled"`
-			DingbotSecret string `json:"ding_bot_secret"`
-		} `json:"intel"`
+		Intel      intel.Config `json:"intel"`
 		QuantEvent struct {
-			Enabled bool `json:"enabled"`
+			Enabled    bool   `json:"enabled"`
+			AdminToken string `json:"admin_token"` // 修改事件类型的令牌，为空表示不允许通过http修改
 		} `json:"quant_event"`
 		FileServer struct {
 			Enabled bool `json:"enabled"`
@@ -65,6 +67,7 @@ type LaunchConfig struct {
 
 type CenterServer struct {
 	ding *dingtalk.Notifier
+	work *dingbot.WorkNotifier
 	rc   *util.RedisClient
 }
 
@@ -72,6 +75,7 @@ func (s *CenterServer) Start(lc LaunchConfig) {
 	if lc.DingConfig.AgentId > 0 {
 		s.ding = new(dingtalk.Notifier)
 		s.ding.Init(lc.DingConfig)
+		s.work = dingbot.NewWorkNotifier(lc.DingConfig)
 	}
 
 	if len(lc.RedisConfig.Addr) > 0 {
@@ -92,7 +96,15 @@ func (s *CenterServer) Start(lc LaunchConfig) {
 	}
 
 	if lc.Services.Stratergy.Enabled {
-		service_stratergys.Start(service_web, lc.Services.Stratergy.Port, lc.Services.Stratergy.DingbotSecret)
+		service_stratergys.Start(
+			service_web,
+			s.ding,
+			lc.DingAdminMob,
+			lc.Services.Stratergy.Port,
+			lc.Services.Stratergy.DingbotSecret,
+			lc.Services.Stratergy.NameConflictPolicy,
+			lc.Services.Stratergy.QuantEventDebounce,
+			lc.Services.Stratergy.AllowUndeclared == nil || *lc.Services.Stratergy.AllowUndeclared)
 	}
 
 	if lc.Services.ActiveStatus.Enabled {
@@ -100,11 +112,11 @@ func (s *CenterServer) Start(lc LaunchConfig) {
 	}
 
 	if lc.Services.Intel.Enabled {
-		service_intel.Start(service_web, s.ding, s.rc, lc.DingAdminMob, lc.Services.Intel.DingbotSecret)
+		service_intel.Start(service_web, s.ding, s.work, s.rc, lc.RedisConfig, lc.DingAdminMob, lc.Services.Intel)
 	}
 
 	if lc.Services.QuantEvent.Enabled {
-		service_quantEvent.Start(service_web)
+		service_quantEvent.Start(service_web, lc.Services.QuantEvent.AdminToken)
 	}
 
 	if lc.Services.FileServer.Enabled {
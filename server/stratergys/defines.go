@@ -9,6 +9,7 @@ package stratergys
 
 import (
 	"net"
+	"slices"
 	"time"
 )
 
@@ -19,4 +20,17 @@ type Stratergy struct {
 	class     string
 	addr      *net.UDPAddr
 	aliveTime time.Time
+	events    []string // 策略声明可以处理的量化事件，为空表示不限制
 }
+
+// 策略是否处理某个量化事件
+func (s *Stratergy) handlesEvent(ename string) bool {
+	return len(s.events) == 0 || slices.Contains(s.events, ename)
+}
+
+// 策略重名（同名但guid不同）时的处理方式
+const (
+	NameConflict_Allow  = "allow"  // 允许上线，仅报警
+	NameConflict_Reject = "reject" // 拒绝新策略上线
+	NameConflict_Suffix = "suffix" // 给新策略的名称加上后缀
+)
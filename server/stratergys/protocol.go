@@ -11,6 +11,11 @@ package stratergys
 
 import (
 	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/aztecqt/dagger/util/udpsocket"
 )
@@ -28,31 +33,41 @@ const OpQuantEventResp = "qevent_resp"
 // 策略->服务器
 type PingReq struct {
 	udpsocket.Header
-	GUID  string `json:"guid"`
-	Name  string `json:"name"`
-	Class string `json:"class"`
+	GUID   string   `json:"guid"`
+	Name   string   `json:"name"`
+	Class  string   `json:"class"`
+	Events []string `json:"events,omitempty"` // 策略可以处理的量化事件，为空表示全部接收
 }
 
-func NewPingReq(guid, name, class string) []byte {
+func NewPingReq(guid, name, class string, events []string) []byte {
 	req := PingReq{
-		GUID:  guid,
-		Name:  name,
-		Class: class,
+		GUID:   guid,
+		Name:   name,
+		Class:  class,
+		Events: events,
 	}
 	req.OP = OpPingReq
 	b, _ := json.Marshal(&req)
 	return b
 }
 
+// ping结果
+const (
+	PingResult_OK           = "ok"
+	PingResult_NameConflict = "name_conflict" // 策略重名，被拒绝上线
+)
+
 // 服务器->策略
 type PingResp struct {
 	udpsocket.Header
 	Result string `json:"rst"`
+	Name   string `json:"name,omitempty"` // 服务器登记的策略名。重名被改名时与策略自己的名字不同
 }
 
-func NewPingResp(rst string) []byte {
+func NewPingResp(rst, name string) []byte {
 	resp := PingResp{
 		Result: rst,
+		Name:   name,
 	}
 	resp.OP = OpPingResp
 	b, _ := json.Marshal(&resp)
@@ -113,6 +128,60 @@ func NewCommandResp(name, rst, webhook string) []byte {
 type QuantEvent struct {
 	EventName  string            `json:"ename"`
 	EventParam map[string]string `json:"eparam"`
+	Targets    []string          `json:"targets,omitempty"`   // 投递目标，可以是策略的guid/name/class。为空表示所有策略
+	Priority   int               `json:"priority,omitempty"`  // 优先级，决定重发的频率和时长
+	ExpireTs   int64             `json:"expire_ts,omitempty"` // 过期时间（毫秒时间戳），过期后停止投递。0表示不过期
+	Quorum     *QuantEventQuorum `json:"quorum,omitempty"`    // 非空时，服务器跟踪各策略的处理结果，完成后回调通知
+}
+
+// 量化事件优先级
+const (
+	QuantEventPriority_Low    = -1
+	QuantEventPriority_Normal = 0
+	QuantEventPriority_High   = 1
+	QuantEventPriority_Urgent = 2
+)
+
+// 事件是否已过期
+func (qe *QuantEvent) expired(now time.Time) bool {
+	return qe.ExpireTs > 0 && now.UnixMilli() >= qe.ExpireTs
+}
+
+// 事件去重用的key：名称+排序后的参数+投递目标+优先级
+// 目标或优先级不同的事件会投递给不同的策略（或以不同频率重发），不能合并
+func (qe *QuantEvent) debounceKey() string {
+	keys := make([]string, 0, len(qe.EventParam))
+	for k := range qe.EventParam {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	targets := slices.Clone(qe.Targets)
+	sort.Strings(targets)
+
+	sb := strings.Builder{}
+	sb.WriteString(qe.EventName)
+	for _, k := range keys {
+		sb.WriteString(fmt.Sprintf("\n%s=%s", k, qe.EventParam[k]))
+	}
+	sb.WriteString(fmt.Sprintf("\ntargets=%s", strings.Join(targets, ",")))
+	sb.WriteString(fmt.Sprintf("\npriority=%d", qe.Priority))
+	return sb.String()
+}
+
+// 判断策略是否属于事件的投递目标
+func (qe *QuantEvent) isTarget(stg *Stratergy) bool {
+	if len(qe.Targets) == 0 {
+		return true
+	}
+
+	for _, t := range qe.Targets {
+		if t == stg.guid || t == stg.name || t == stg.class {
+			return true
+		}
+	}
+
+	return false
 }
 
 // 量化事件，由服务器广播给策略
@@ -122,12 +191,14 @@ type QuantEventBroadcast struct {
 	EventSeq int `json:"eseq"` // 事件序列号，同一个序列号的事件只应处理一次。策略上报时填-1
 }
 
-func NewQuantEventBroadcast(seq int, ename string, eparam map[string]string) []byte {
+func NewQuantEventBroadcast(seq int, evt QuantEvent) []byte {
 	qe := QuantEventBroadcast{}
 	qe.OP = OpQuantEventBroadcast
 	qe.EventSeq = seq
-	qe.EventName = ename
-	qe.EventParam = eparam
+	qe.EventName = evt.EventName
+	qe.EventParam = evt.EventParam
+	qe.Priority = evt.Priority
+	qe.ExpireTs = evt.ExpireTs
 	b, _ := json.Marshal(&qe)
 	return b
 }
@@ -0,0 +1,34 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-25 10:40:51
+ * @Description: 量化事件防抖key的测试
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package stratergys
+
+import "testing"
+
+func TestDebounceKeyIgnoresOrder(t *testing.T) {
+	a := QuantEvent{EventName: "e", EventParam: map[string]string{"a": "1", "b": "2"}, Targets: []string{"s1", "s2"}}
+	b := QuantEvent{EventName: "e", EventParam: map[string]string{"b": "2", "a": "1"}, Targets: []string{"s2", "s1"}}
+	if a.debounceKey() != b.debounceKey() {
+		t.Fatalf("keys should be equal:\n%s\n%s", a.debounceKey(), b.debounceKey())
+	}
+}
+
+func TestDebounceKeyDiffers(t *testing.T) {
+	base := QuantEvent{EventName: "e", EventParam: map[string]string{"a": "1"}}
+	cases := map[string]QuantEvent{
+		"name":     {EventName: "f", EventParam: map[string]string{"a": "1"}},
+		"param":    {EventName: "e", EventParam: map[string]string{"a": "2"}},
+		"targets":  {EventName: "e", EventParam: map[string]string{"a": "1"}, Targets: []string{"s1"}},
+		"priority": {EventName: "e", EventParam: map[string]string{"a": "1"}, Priority: QuantEventPriority_High},
+	}
+
+	for name, qe := range cases {
+		if qe.debounceKey() == base.debounceKey() {
+			t.Errorf("key should differ when %s differs", name)
+		}
+	}
+}
@@ -10,6 +10,7 @@ package stratergys
 
 import (
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/aztecqt/dagger/util/udpsocket"
@@ -22,46 +23,140 @@ type quantEvent2Stratergy struct {
 	us           udpsocket.Socket
 	guid         string
 	seq          int
-	acknowledged bool
-	finished     bool
+	priority     int
+	expireTs     int64
+	acknowledged atomic.Bool // 由收到回复的udp线程设置
+	expired      atomic.Bool
+	finished     atomic.Bool // 重发结束，在finished之前设置expired
 }
 
 func newQuantEvent2Stratergy(
 	seq int,
-	ename string,
-	eparam map[string]string,
+	qe QuantEvent,
 	addr *net.UDPAddr,
 	us udpsocket.Socket,
 	guid string) *quantEvent2Stratergy {
 	sender := new(quantEvent2Stratergy)
-	sender.eData = NewQuantEventBroadcast(seq, ename, eparam)
+	sender.eData = NewQuantEventBroadcast(seq, qe)
 	sender.addr = addr
 	sender.us = us
 	sender.guid = guid
 	sender.seq = seq
-	sender.acknowledged = false
-	sender.finished = false
+	sender.priority = qe.Priority
+	sender.expireTs = qe.ExpireTs
 	return sender
 }
 
+// 不同优先级的重发间隔和重发时长
+func resendPolicy(priority int) (interval, duration time.Duration) {
+	switch {
+	case priority <= QuantEventPriority_Low:
+		return time.Second, time.Second * 10
+	case priority == QuantEventPriority_Normal:
+		return time.Millisecond * 500, time.Second * 10
+	case priority == QuantEventPriority_High:
+		return time.Millisecond * 250, time.Second * 30
+	default:
+		return time.Millisecond * 100, time.Second * 60
+	}
+}
+
 func (s *quantEvent2Stratergy) run() {
 	// 首次立即发送
 	s.us.SendTo(s.eData, s.addr)
 
-	// 未收到确认之前，一秒2次，重复10秒
-	ticker := time.NewTicker(time.Millisecond * 500)
-	sendCount := 0
+	// 未收到确认之前，按优先级定频重发，直到超时或过期
+	interval, duration := resendPolicy(s.priority)
+	deadline := time.Now().Add(duration)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 	for {
-		<-ticker.C
-		if s.acknowledged {
+		now := <-ticker.C
+		if s.acknowledged.Load() {
 			break
 		}
 
-		s.us.SendTo(s.eData, s.addr)
-		sendCount++
-		if sendCount > 20 {
+		if s.expireTs > 0 && now.UnixMilli() >= s.expireTs {
+			s.expired.Store(true)
+			break
+		}
+
+		if now.After(deadline) {
 			break
 		}
+
+		s.us.SendTo(s.eData, s.addr)
 	}
-	s.finished = true
+	s.finished.Store(true)
+}
+
+// 一个量化事件的投递状态
+type QuantEventStatus struct {
+	EventSeq   int                                `json:"eseq"`
+	EventName  string                             `json:"ename"`
+	Priority   int                                `json:"priority"`
+	ExpireTs   int64                              `json:"expire_ts"`
+	CreateTime time.Time                          `json:"create_time"`
+	Deliveries map[string]*QuantEventDeliveryInfo `json:"deliveries"`       // guid->投递情况
+	Finished   bool                               `json:"finished"`         // 所有投递都已确认或超时
+	Quorum     *QuantEventQuorumReport            `json:"quorum,omitempty"` // 确认结果，确认结束后才有
+}
+
+// 量化事件对单个策略的投递情况
+type QuantEventDeliveryInfo struct {
+	Name         string `json:"name"`
+	Acknowledged bool   `json:"acked"`    // 策略已回复
+	Handled      bool   `json:"handled"`  // 策略回复的处理结果
+	TimedOut     bool   `json:"time_out"` // 重发结束仍未收到回复
+	Expired      bool   `json:"expired"`  // 事件过期时仍未收到回复
+}
+
+func newQuantEventStatus(seq int, qe QuantEvent) *QuantEventStatus {
+	st := new(QuantEventStatus)
+	st.EventSeq = seq
+	st.EventName = qe.EventName
+	st.Priority = qe.Priority
+	st.ExpireTs = qe.ExpireTs
+	st.CreateTime = time.Now()
+	st.Deliveries = make(map[string]*QuantEventDeliveryInfo)
+	return st
+}
+
+func (st *QuantEventStatus) refreshFinished() {
+	for _, d := range st.Deliveries {
+		if !d.Acknowledged && !d.TimedOut && !d.Expired {
+			st.Finished = false
+			return
+		}
+	}
+	st.Finished = true
+}
+
+// 复制一份，供外部读取
+func (st *QuantEventStatus) clone() QuantEventStatus {
+	c := *st
+	c.Deliveries = make(map[string]*QuantEventDeliveryInfo)
+	for k, v := range st.Deliveries {
+		d := *v
+		c.Deliveries[k] = &d
+	}
+	if st.Quorum != nil {
+		q := *st.Quorum
+		c.Quorum = &q
+	}
+	return c
+}
+
+// 量化事件发送结果
+type QuantEventSendResult struct {
+	EventSeq  int  `json:"eseq"`      // 事件序列号，用于查询投递状态
+	Count     int  `json:"count"`     // 投递的策略数量
+	Coalesced bool `json:"coalesced"` // 在防抖窗口内与之前的相同事件合并，未重复投递。此时EventSeq为之前那个事件的序列号
+}
+
+// 最近一次投递的相同事件，用于防抖
+type quantEventDebounceRecord struct {
+	seq   int
+	count int
+	time  time.Time
 }
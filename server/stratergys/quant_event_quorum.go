@@ -0,0 +1,162 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-09-22 14:05:17
+ * @Description: 需要确认的量化事件。服务器统计期望的策略是否都处理了事件，
+ * 全部回复或者到达截止时间后，通过webhook或者钉钉通知事件的发起者
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package stratergys
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aztecqt/dagger/util"
+	"github.com/aztecqt/dagger/util/logger"
+	"github.com/aztecqt/dagger/util/network"
+)
+
+const quantEventQuorumDefaultDuration = time.Minute // 未指定截止时间时，默认等待时长
+
+// 事件的确认要求
+type QuantEventQuorum struct {
+	Expected    []string `json:"expected,omitempty"`     // 期望处理此事件的策略（guid/name/class），为空表示所有投递目标
+	DeadlineTs  int64    `json:"deadline_ts,omitempty"`  // 截止时间（毫秒时间戳），0表示使用事件过期时间或默认1分钟
+	CallbackUrl string   `json:"callback_url,omitempty"` // 结果以json POST到此地址
+	DingMobs    []int64  `json:"ding_mobs,omitempty"`    // 结果以钉钉消息发给这些手机号
+}
+
+// 确认结果
+type QuantEventQuorumReport struct {
+	EventSeq  int      `json:"eseq"`
+	EventName string   `json:"ename"`
+	Reached   bool     `json:"reached"`   // 所有期望的策略都处理了事件。没有任何期望的策略时为false
+	Handled   []string `json:"handled"`   // 已处理
+	Refused   []string `json:"refused"`   // 回复了但未处理
+	NoAnswer  []string `json:"no_answer"` // 截止时仍未回复，或者期望的策略不在线
+}
+
+func (r *QuantEventQuorumReport) string() string {
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("量化事件[%s](seq=%d)确认%s\n", r.EventName, r.EventSeq, util.ValueIf(r.Reached, "完成", "未完成")))
+	sb.WriteString(fmt.Sprintf("已处理(%d): %s\n", len(r.Handled), strings.Join(r.Handled, ",")))
+	sb.WriteString(fmt.Sprintf("拒绝处理(%d): %s\n", len(r.Refused), strings.Join(r.Refused, ",")))
+	sb.WriteString(fmt.Sprintf("未回复(%d): %s", len(r.NoAnswer), strings.Join(r.NoAnswer, ",")))
+	return sb.String()
+}
+
+// 跟踪一个事件的确认情况
+type quantEventQuorum struct {
+	seq      int
+	ename    string
+	spec     QuantEventQuorum
+	deadline time.Time
+	expected map[string]string // guid->name
+	answers  map[string]bool   // guid->handled
+	missing  []string          // 没有匹配到任何投递目标的期望项
+}
+
+// delivered为事件实际投递到的策略
+func newQuantEventQuorum(seq int, qe QuantEvent, delivered []*Stratergy) *quantEventQuorum {
+	q := new(quantEventQuorum)
+	q.seq = seq
+	q.ename = qe.EventName
+	q.spec = *qe.Quorum
+	q.expected = make(map[string]string)
+	q.answers = make(map[string]bool)
+	q.missing = make([]string, 0)
+
+	if q.spec.DeadlineTs > 0 {
+		q.deadline = time.UnixMilli(q.spec.DeadlineTs)
+	} else if qe.ExpireTs > 0 {
+		q.deadline = time.UnixMilli(qe.ExpireTs)
+	} else {
+		q.deadline = time.Now().Add(quantEventQuorumDefaultDuration)
+	}
+
+	if len(q.spec.Expected) == 0 {
+		for _, stg := range delivered {
+			q.expected[stg.guid] = stg.name
+		}
+	} else {
+		expectSet := QuantEvent{Targets: q.spec.Expected}
+		for _, stg := range delivered {
+			if expectSet.isTarget(stg) {
+				q.expected[stg.guid] = stg.name
+			}
+		}
+
+		for _, e := range q.spec.Expected {
+			matched := false
+			for _, stg := range delivered {
+				if e == stg.guid || e == stg.name || e == stg.class {
+					matched = true
+					break
+				}
+			}
+
+			if !matched {
+				q.missing = append(q.missing, e)
+			}
+		}
+	}
+
+	return q
+}
+
+// 记录一个回复
+func (q *quantEventQuorum) onResp(guid string, handled bool) {
+	if _, ok := q.expected[guid]; ok {
+		q.answers[guid] = handled
+	}
+}
+
+// 所有期望的策略都已回复，或者到达截止时间
+func (q *quantEventQuorum) done(now time.Time) bool {
+	return len(q.answers) == len(q.expected) || now.After(q.deadline)
+}
+
+func (q *quantEventQuorum) report() QuantEventQuorumReport {
+	r := QuantEventQuorumReport{EventSeq: q.seq, EventName: q.ename}
+	r.Handled = make([]string, 0)
+	r.Refused = make([]string, 0)
+	r.NoAnswer = append(make([]string, 0), q.missing...)
+	for guid, name := range q.expected {
+		if handled, ok := q.answers[guid]; !ok {
+			r.NoAnswer = append(r.NoAnswer, name)
+		} else if handled {
+			r.Handled = append(r.Handled, name)
+		} else {
+			r.Refused = append(r.Refused, name)
+		}
+	}
+
+	r.Reached = len(q.expected) > 0 && len(r.Refused) == 0 && len(r.NoAnswer) == 0
+	return r
+}
+
+// 发送确认结果。不要在持有锁时调用
+func (s *Service) fireQuantEventQuorum(spec QuantEventQuorum, r QuantEventQuorumReport) {
+	logger.LogImportant(logPrefix, "quant-event(seq=%d) quorum finished, reached=%v", r.EventSeq, r.Reached)
+
+	if len(spec.CallbackUrl) > 0 {
+		b, _ := json.Marshal(r)
+		network.HttpCall(spec.CallbackUrl, "POST", string(b), network.JsonHeaders(), func(resp *http.Response, err error) {
+			if err != nil {
+				logger.LogImportant(logPrefix, "quorum callback to %s failed, err=%s", spec.CallbackUrl, err.Error())
+			}
+		})
+	}
+
+	if len(spec.DingMobs) > 0 {
+		if s.ding != nil {
+			s.ding.SendTextByMob(r.string(), spec.DingMobs...)
+		} else {
+			logger.LogImportant(logPrefix, "quorum ding notify skipped, ding not configured")
+		}
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-10-25 10:12:08
+ * @Description: 需要确认的量化事件的测试
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package stratergys
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func testStratergys() []*Stratergy {
+	return []*Stratergy{
+		{guid: "g1", name: "s1", class: "arb"},
+		{guid: "g2", name: "s2", class: "arb"},
+		{guid: "g3", name: "s3", class: "mm"},
+	}
+}
+
+func TestQuorumAllHandled(t *testing.T) {
+	qe := QuantEvent{EventName: "e", Quorum: &QuantEventQuorum{}}
+	q := newQuantEventQuorum(1, qe, testStratergys())
+
+	now := time.Now()
+	q.onResp("g1", true)
+	q.onResp("g2", true)
+	if q.done(now) {
+		t.Fatal("quorum should not be done before all answered")
+	}
+
+	q.onResp("g3", true)
+	if !q.done(now) {
+		t.Fatal("quorum should be done after all answered")
+	}
+
+	r := q.report()
+	if !r.Reached || len(r.Handled) != 3 || len(r.Refused) != 0 || len(r.NoAnswer) != 0 {
+		t.Fatalf("unexpected report: %+v", r)
+	}
+}
+
+func TestQuorumRefusedAndNoAnswer(t *testing.T) {
+	qe := QuantEvent{EventName: "e", Quorum: &QuantEventQuorum{}}
+	q := newQuantEventQuorum(1, qe, testStratergys())
+	q.onResp("g1", true)
+	q.onResp("g2", false)
+	q.onResp("unknown", true) // 不在期望中的回复忽略
+
+	if !q.done(q.deadline.Add(time.Millisecond)) {
+		t.Fatal("quorum should be done after deadline")
+	}
+
+	r := q.report()
+	if r.Reached {
+		t.Fatal("quorum should not be reached")
+	}
+	if !slices.Equal(r.Handled, []string{"s1"}) || !slices.Equal(r.Refused, []string{"s2"}) || !slices.Equal(r.NoAnswer, []string{"s3"}) {
+		t.Fatalf("unexpected report: %+v", r)
+	}
+}
+
+func TestQuorumExpectedSubset(t *testing.T) {
+	qe := QuantEvent{EventName: "e", Quorum: &QuantEventQuorum{Expected: []string{"mm", "s9"}}}
+	q := newQuantEventQuorum(1, qe, testStratergys())
+
+	// 只期望mm类的策略，s9不在线
+	q.onResp("g1", true)
+	q.onResp("g3", true)
+	if !q.done(time.Now()) {
+		t.Fatal("quorum should be done after expected stratergys answered")
+	}
+
+	r := q.report()
+	if r.Reached || !slices.Equal(r.Handled, []string{"s3"}) || !slices.Equal(r.NoAnswer, []string{"s9"}) {
+		t.Fatalf("unexpected report: %+v", r)
+	}
+}
+
+func TestQuorumNoRecipients(t *testing.T) {
+	qe := QuantEvent{EventName: "e", Quorum: &QuantEventQuorum{}}
+	q := newQuantEventQuorum(1, qe, nil)
+	if !q.done(time.Now()) {
+		t.Fatal("quorum without recipients should be done immediately")
+	}
+
+	if r := q.report(); r.Reached {
+		t.Fatalf("quorum without recipients should not be reached: %+v", r)
+	}
+}
+
+func TestQuorumDeadline(t *testing.T) {
+	expire := time.Now().Add(time.Second * 5)
+	qe := QuantEvent{EventName: "e", ExpireTs: expire.UnixMilli(), Quorum: &QuantEventQuorum{}}
+	q := newQuantEventQuorum(1, qe, testStratergys())
+	if !q.deadline.Equal(time.UnixMilli(expire.UnixMilli())) {
+		t.Fatalf("deadline should fall back to expire time, got %v", q.deadline)
+	}
+
+	deadline := time.Now().Add(time.Second * 2)
+	qe.Quorum.DeadlineTs = deadline.UnixMilli()
+	q = newQuantEventQuorum(1, qe, testStratergys())
+	if q.done(deadline.Add(-time.Millisecond)) || !q.done(deadline.Add(time.Millisecond)) {
+		t.Fatal("quorum should be done right after deadline")
+	}
+}
@@ -0,0 +1,237 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-09-20 10:12:31
+ * @Description: 量化事件的类型声明。声明过的事件，参数必须符合声明
+ * 未声明的事件默认放行（只记录日志），关闭allow_undeclared后拒绝。注册表为空时总是放行，避免新部署时所有事件都被拒绝
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package stratergys
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aztecqt/dagger/util"
+	"github.com/aztecqt/dagger/util/logger"
+)
+
+const quantEventTypeFile = "quant_event_types.json"
+
+// 参数类型
+const (
+	ParamType_String = "string"
+	ParamType_Int    = "int"
+	ParamType_Float  = "float"
+	ParamType_Bool   = "bool"
+)
+
+// 事件参数声明
+type QuantEventParamDef struct {
+	Name     string   `json:"name"`
+	Desc     string   `json:"desc"`
+	Type     string   `json:"type"`              // string/int/float/bool，空等同于string
+	Required bool     `json:"required"`          // 是否必填
+	Allowed  []string `json:"allowed,omitempty"` // 允许的取值，为空表示不限制
+}
+
+// 事件类型声明
+type QuantEventType struct {
+	Name       string               `json:"name"`
+	Desc       string               `json:"desc"`
+	Params     []QuantEventParamDef `json:"params"`
+	DebounceMs int64                `json:"debounce_ms,omitempty"` // 防抖窗口，覆盖全局配置。0表示使用全局配置，-1表示不防抖
+}
+
+// 检查声明本身是否合法
+func (t *QuantEventType) check() error {
+	if len(t.Name) == 0 {
+		return fmt.Errorf("missing event name")
+	}
+
+	names := make(map[string]bool)
+	for _, p := range t.Params {
+		if len(p.Name) == 0 {
+			return fmt.Errorf("event [%s] has param without name", t.Name)
+		}
+
+		if names[p.Name] {
+			return fmt.Errorf("event [%s] has duplicated param [%s]", t.Name, p.Name)
+		}
+		names[p.Name] = true
+
+		switch p.Type {
+		case "", ParamType_String, ParamType_Int, ParamType_Float, ParamType_Bool:
+		default:
+			return fmt.Errorf("event [%s] param [%s] has unknown type [%s]", t.Name, p.Name, p.Type)
+		}
+
+		for _, v := range p.Allowed {
+			if err := checkParamValue(p, v); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// 检查一组事件参数是否符合声明
+func (t *QuantEventType) validate(param map[string]string) error {
+	for k := range param {
+		if !slices.ContainsFunc(t.Params, func(p QuantEventParamDef) bool { return p.Name == k }) {
+			return fmt.Errorf("event [%s] has no param [%s]", t.Name, k)
+		}
+	}
+
+	for _, p := range t.Params {
+		v, ok := param[p.Name]
+		if !ok {
+			if p.Required {
+				return fmt.Errorf("event [%s] missing required param [%s]", t.Name, p.Name)
+			}
+			continue
+		}
+
+		if err := checkParamValue(p, v); err != nil {
+			return fmt.Errorf("event [%s]: %s", t.Name, err.Error())
+		}
+
+		if len(p.Allowed) > 0 && !slices.Contains(p.Allowed, v) {
+			return fmt.Errorf("event [%s] param [%s] value `%s` not in %v", t.Name, p.Name, v, p.Allowed)
+		}
+	}
+
+	return nil
+}
+
+func (t *QuantEventType) string() string {
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("[%s] %s\n", t.Name, t.Desc))
+	for _, p := range t.Params {
+		sb.WriteString(fmt.Sprintf("  %s(%s)", p.Name, util.ValueIf(len(p.Type) > 0, p.Type, ParamType_String)))
+		if p.Required {
+			sb.WriteString(" required")
+		}
+		if len(p.Allowed) > 0 {
+			sb.WriteString(fmt.Sprintf(" in [%s]", strings.Join(p.Allowed, ",")))
+		}
+		if len(p.Desc) > 0 {
+			sb.WriteString(fmt.Sprintf(" %s", p.Desc))
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func checkParamValue(p QuantEventParamDef, v string) error {
+	var err error
+	switch p.Type {
+	case ParamType_Int:
+		_, err = strconv.ParseInt(v, 10, 64)
+	case ParamType_Float:
+		_, err = strconv.ParseFloat(v, 64)
+	case ParamType_Bool:
+		_, err = strconv.ParseBool(v)
+	}
+
+	if err != nil {
+		return fmt.Errorf("param [%s] value `%s` is not %s", p.Name, v, p.Type)
+	}
+	return nil
+}
+
+// 事件类型注册表，持久化到文件
+type quantEventTypeRegistry struct {
+	Types           map[string]*QuantEventType `json:"types"`
+	allowUndeclared bool
+	mu              sync.RWMutex
+}
+
+func (r *quantEventTypeRegistry) init(allowUndeclared bool) {
+	r.Types = make(map[string]*QuantEventType)
+	r.allowUndeclared = allowUndeclared
+	if !util.ObjectFromFile(quantEventTypeFile, r) {
+		logger.LogImportant(logPrefix, "load %s failed", quantEventTypeFile)
+	} else {
+		logger.LogImportant(logPrefix, "load %s ok, %d types", quantEventTypeFile, len(r.Types))
+	}
+}
+
+func (r *quantEventTypeRegistry) toFile() {
+	if !util.ObjectToFile(quantEventTypeFile, r) {
+		logger.LogImportant(logPrefix, "save %s failed", quantEventTypeFile)
+	}
+}
+
+// 注册或更新一个事件类型
+func (r *quantEventTypeRegistry) register(t QuantEventType) error {
+	if err := t.check(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Types[t.Name] = &t
+	r.toFile()
+	return nil
+}
+
+func (r *quantEventTypeRegistry) remove(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.Types[name]; !ok {
+		return false
+	}
+
+	delete(r.Types, name)
+	r.toFile()
+	return true
+}
+
+// 校验一个事件
+func (r *quantEventTypeRegistry) validate(qe *QuantEvent) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.Types[qe.EventName]
+	if !ok {
+		if r.allowUndeclared || len(r.Types) == 0 {
+			logger.LogInfo(logPrefix, "quant-event [%s] is not declared, passed without validation", qe.EventName)
+			return nil
+		}
+		return fmt.Errorf("event [%s] is not declared, type `qtypes` to list declared events", qe.EventName)
+	}
+
+	return t.validate(qe.EventParam)
+}
+
+// 某事件的防抖窗口
+func (r *quantEventTypeRegistry) debounceWindow(ename string, defaultWindow time.Duration) time.Duration {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if t, ok := r.Types[ename]; ok && t.DebounceMs != 0 {
+		if t.DebounceMs < 0 {
+			return 0
+		}
+		return time.Duration(t.DebounceMs) * time.Millisecond
+	}
+	return defaultWindow
+}
+
+// 按名称排序的所有类型
+func (r *quantEventTypeRegistry) list() []QuantEventType {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	types := make([]QuantEventType, 0, len(r.Types))
+	for _, t := range r.Types {
+		types = append(types, *t)
+	}
+
+	sort.Slice(types, func(i, j int) bool { return types[i].Name < types[j].Name })
+	return types
+}
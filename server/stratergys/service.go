@@ -24,11 +24,13 @@ import (
 	"github.com/aztecqt/center_server/dingbot"
 	"github.com/aztecqt/center_server/server/web"
 	"github.com/aztecqt/dagger/util"
+	"github.com/aztecqt/dagger/util/dingtalk"
 	"github.com/aztecqt/dagger/util/logger"
 	"github.com/aztecqt/dagger/util/udpsocket"
 )
 
 const logPrefix = "service-stratergys"
+const quantEventStatusKeepDuration = time.Minute * 10 // 量化事件投递状态的保留时长
 
 var instance *Service
 
@@ -41,29 +43,64 @@ type Service struct {
 	us udpsocket.Socket
 
 	// 策略列表 guid-stratergy
-	stratergys     map[string]*Stratergy
-	stratergyNames []string
-	stratergyGuids []string
-	muStratergys   sync.Mutex
+	// stratergyList按上线顺序排列，用于列表展示和按索引连接
+	stratergys    map[string]*Stratergy
+	stratergyList []*Stratergy
+	muStratergys  sync.Mutex
+
+	// 策略重名处理
+	nameConflictPolicy string
+	rejectedGuids      map[string]time.Time // 被拒绝上线的guid，避免重复报警
 
 	// 当前选中的策略
 	connectedStratergy *Stratergy
 
 	// 发往策略的QuantEvent
 	sendingQuantEvent   []*quantEvent2Stratergy
+	quantEventStatus    map[int]*QuantEventStatus // seq->投递状态
+	quantEventQuorums   map[int]*quantEventQuorum // seq->需要确认的事件
 	muSendingQuantEvent sync.Mutex
 	quantEventSeqAcc    int
 
+	// 量化事件类型声明
+	quantEventTypes *quantEventTypeRegistry
+
+	// 量化事件防抖：相同事件（名称+参数）在窗口期内只投递一次
+	quantEventDebounce        time.Duration
+	quantEventDebounceRecords map[string]quantEventDebounceRecord
+
 	// 用于验证丁丁机器人的消息
 	dingBotSecret string
+
+	// 报警
+	ding         *dingtalk.Notifier
+	dingAdminMob int64
 }
 
-func (s *Service) Start(webservice *web.Service, localPort int, dingBotSecret string) {
+func (s *Service) Start(webservice *web.Service, ding *dingtalk.Notifier, dingAdminMob int64, localPort int, dingBotSecret, nameConflictPolicy string, quantEventDebounceMs int, allowUndeclared bool) {
 	s.stratergys = make(map[string]*Stratergy)
-	s.stratergyNames = make([]string, 0)
-	s.stratergyGuids = make([]string, 0)
+	s.stratergyList = make([]*Stratergy, 0)
+	s.rejectedGuids = make(map[string]time.Time)
 	s.sendingQuantEvent = make([]*quantEvent2Stratergy, 0)
+	s.quantEventStatus = make(map[int]*QuantEventStatus)
+	s.quantEventQuorums = make(map[int]*quantEventQuorum)
+	s.quantEventTypes = new(quantEventTypeRegistry)
+	s.quantEventTypes.init(allowUndeclared)
+	s.quantEventDebounce = time.Duration(quantEventDebounceMs) * time.Millisecond
+	s.quantEventDebounceRecords = make(map[string]quantEventDebounceRecord)
 	s.dingBotSecret = dingBotSecret
+	s.ding = ding
+	s.dingAdminMob = dingAdminMob
+
+	switch nameConflictPolicy {
+	case NameConflict_Allow, NameConflict_Reject, NameConflict_Suffix:
+		s.nameConflictPolicy = nameConflictPolicy
+	case "":
+		s.nameConflictPolicy = NameConflict_Allow
+	default:
+		logger.LogImportant(logPrefix, "unknown name conflict policy `%s`, use `%s` instead", nameConflictPolicy, NameConflict_Allow)
+		s.nameConflictPolicy = NameConflict_Allow
+	}
 
 	// 处理策略交互中心的消息
 	webservice.RegisterPath("/dingbots/stratergy", s.onHttp_DingMsg)
@@ -125,35 +162,133 @@ func (s *Service) onHttp_DingMsg(w http.ResponseWriter, r *http.Request) {
 }
 
 // 向策略发送一个量化事件
-func (s *Service) SendQuantEventRaw(args []string) int {
+func (s *Service) SendQuantEventRaw(args []string) (int, error) {
 	//格式：ename eparam val eparam val ...
-	ename := args[0]
-	eparam := make(map[string]string)
+	qe := QuantEvent{}
+	qe.EventName = args[0]
+	qe.EventParam = make(map[string]string)
 	for i := 1; i < len(args)-1; i = i + 2 {
-		eparam[args[i]] = args[i+1]
+		qe.EventParam[args[i]] = args[i+1]
 	}
-	return s.SendQuantEvent(ename, eparam)
+	rst, err := s.SendQuantEvent(qe)
+	return rst.Count, err
 }
 
-// 向策略发送一个量化事件
-func (s *Service) SendQuantEvent(ename string, eparam map[string]string) int {
+// 向策略发送一个量化事件，返回事件序列号和投递的策略数量
+// 声明过的事件参数必须符合声明，否则返回错误。未声明的事件是否放行由allow_undeclared决定
+// 防抖窗口内的相同事件不会重复投递，直接返回之前那次的结果
+func (s *Service) SendQuantEvent(qe QuantEvent) (QuantEventSendResult, error) {
+	if err := s.quantEventTypes.validate(&qe); err != nil {
+		logger.LogImportant(logPrefix, "reject quant-event: %s", err.Error())
+		return QuantEventSendResult{EventSeq: -1}, err
+	}
+
+	now := time.Now()
+	if qe.expired(now) {
+		logger.LogImportant(logPrefix, "reject quant-event(name=%s): already expired", qe.EventName)
+		return QuantEventSendResult{EventSeq: -1}, fmt.Errorf("event [%s] already expired", qe.EventName)
+	}
+
 	s.muStratergys.Lock()
 	defer s.muStratergys.Unlock()
+	s.muSendingQuantEvent.Lock()
+	defer s.muSendingQuantEvent.Unlock()
+
+	// 防抖。需要确认的事件各自有回调，不参与防抖
+	debounceKey := qe.debounceKey()
+	if window := s.quantEventTypes.debounceWindow(qe.EventName, s.quantEventDebounce); window > 0 && qe.Quorum == nil {
+		if rec, ok := s.quantEventDebounceRecords[debounceKey]; ok && now.Sub(rec.time) < window {
+			logger.LogInfo(logPrefix, "quant-event(name=%s) coalesced into seq=%d", qe.EventName, rec.seq)
+			return QuantEventSendResult{EventSeq: rec.seq, Count: rec.count, Coalesced: true}, nil
+		}
+	}
 
-	// 目前是发给所有策略
-	sended := 0
+	// 同一个事件发给各个策略时使用同一个序列号
+	seq := s.quantEventSeqAcc
+	s.quantEventSeqAcc++
+	status := newQuantEventStatus(seq, qe)
+
+	delivered := make([]*Stratergy, 0)
 	for _, stg := range s.stratergys {
-		qes := newQuantEvent2Stratergy(s.quantEventSeqAcc, ename, eparam, stg.addr, s.us, stg.guid)
-		s.quantEventSeqAcc++
+		if !qe.isTarget(stg) || !stg.handlesEvent(qe.EventName) {
+			continue
+		}
+
+		qes := newQuantEvent2Stratergy(seq, qe, stg.addr, s.us, stg.guid)
 		go qes.run()
-		s.muSendingQuantEvent.Lock()
 		s.sendingQuantEvent = append(s.sendingQuantEvent, qes)
-		s.muSendingQuantEvent.Unlock()
-		logger.LogImportant(logPrefix, fmt.Sprintf("send quant-event(seq=%d, name=%s) to stratergy %s", qes.seq, ename, stg.guid))
-		sended++
+		status.Deliveries[stg.guid] = &QuantEventDeliveryInfo{Name: stg.name}
+		logger.LogImportant(logPrefix, fmt.Sprintf("send quant-event(seq=%d, name=%s, priority=%d) to stratergy %s", qes.seq, qe.EventName, qe.Priority, stg.guid))
+		delivered = append(delivered, stg)
+	}
+
+	sended := len(delivered)
+	if qe.Quorum != nil {
+		s.quantEventQuorums[seq] = newQuantEventQuorum(seq, qe, delivered)
+	}
+
+	status.refreshFinished()
+	s.quantEventStatus[seq] = status
+	if qe.Quorum == nil {
+		s.quantEventDebounceRecords[debounceKey] = quantEventDebounceRecord{seq: seq, count: sended, time: now}
+	}
+	return QuantEventSendResult{EventSeq: seq, Count: sended}, nil
+}
+
+// 声明（或更新）一个量化事件类型
+func (s *Service) RegisterQuantEventType(t QuantEventType) error {
+	return s.quantEventTypes.register(t)
+}
+
+// 删除一个量化事件类型
+func (s *Service) RemoveQuantEventType(name string) bool {
+	return s.quantEventTypes.remove(name)
+}
+
+// 所有已声明的量化事件类型
+func (s *Service) QuantEventTypes() []QuantEventType {
+	return s.quantEventTypes.list()
+}
+
+// 检查需要确认的事件，完成的发送回调
+func (s *Service) checkQuantEventQuorums() {
+	defer util.DefaultRecover()
+
+	type firing struct {
+		spec   QuantEventQuorum
+		report QuantEventQuorumReport
 	}
 
-	return sended
+	now := time.Now()
+	firings := make([]firing, 0)
+	s.muSendingQuantEvent.Lock()
+	for seq, q := range s.quantEventQuorums {
+		if q.done(now) {
+			r := q.report()
+			if st, ok := s.quantEventStatus[seq]; ok {
+				st.Quorum = &r
+			}
+			firings = append(firings, firing{spec: q.spec, report: r})
+			delete(s.quantEventQuorums, seq)
+		}
+	}
+	s.muSendingQuantEvent.Unlock()
+
+	for _, f := range firings {
+		s.fireQuantEventQuorum(f.spec, f.report)
+	}
+}
+
+// 查询某个量化事件的投递状态
+func (s *Service) QuantEventStatus(seq int) (QuantEventStatus, bool) {
+	s.muSendingQuantEvent.Lock()
+	defer s.muSendingQuantEvent.Unlock()
+
+	if st, ok := s.quantEventStatus[seq]; ok {
+		return st.clone(), true
+	} else {
+		return QuantEventStatus{}, false
+	}
 }
 
 // 消息转发给策略服务器
@@ -171,35 +306,33 @@ func (s *Service) onRecvUDPMsg(op string, data []byte, addr *net.UDPAddr) {
 	switch op {
 	case OpPingReq:
 		// 策略发来的ping请求
-		func() {
+		rst := PingResult_OK
+		name := ""
+		alertMsg := ""
+		req := PingReq{}
+		if err := json.Unmarshal(data, &req); err == nil {
 			s.muStratergys.Lock()
-			defer s.muStratergys.Unlock()
-			req := PingReq{}
-			if err := json.Unmarshal(data, &req); err == nil {
-				if stg, ok := s.stratergys[req.GUID]; ok {
-					// 刷新aliveTime
-					stg.aliveTime = time.Now()
-				} else {
-					// 创建新的策略镜像
-					stg := new(Stratergy)
-					stg.addr = addr
-					stg.guid = req.GUID
-					stg.name = req.Name
-					stg.class = req.Class
-					stg.aliveTime = time.Now()
-					s.stratergys[stg.guid] = stg
-					s.stratergyGuids = append(s.stratergyGuids, stg.guid)
-					s.stratergyNames = append(s.stratergyNames, stg.name)
-					logger.LogInfo(logPrefix, "stratergy [%s] is online", stg.name)
-				}
+			if stg, ok := s.stratergys[req.GUID]; ok {
+				// 刷新aliveTime
+				stg.aliveTime = time.Now()
+				stg.events = req.Events
+				name = stg.name
 			} else {
-				logger.LogImportant(logPrefix, "unmarshal error: %s", string(data))
+				rst, name, alertMsg = s.stratergyOnline(req, addr)
 			}
+			s.muStratergys.Unlock()
+		} else {
+			logger.LogImportant(logPrefix, "unmarshal error: %s", string(data))
+		}
 
-			// 回消息
-			resp := NewPingResp("ok")
-			s.us.SendTo(resp, addr)
-		}()
+		// 回消息
+		resp := NewPingResp(rst, name)
+		s.us.SendTo(resp, addr)
+
+		// 报警会调用钉钉接口，不能在持有锁时发送
+		if len(alertMsg) > 0 {
+			s.alert(alertMsg)
+		}
 	case OpQuitRpt:
 		// 策略通知服务器程序退出
 		rpt := QuitRpt{}
@@ -222,11 +355,24 @@ func (s *Service) onRecvUDPMsg(op string, data []byte, addr *net.UDPAddr) {
 			s.muSendingQuantEvent.Lock()
 			for _, qes := range s.sendingQuantEvent {
 				if qes.seq == resp.EventSeq && qes.guid == resp.GUID {
-					qes.acknowledged = true
+					qes.acknowledged.Store(true)
 					logger.LogImportant(logPrefix, fmt.Sprintf("quant-event(seq=%d) responsed by stratergy %s, handled=%v", resp.EventSeq, resp.GUID, resp.Handled))
 				}
 			}
+
+			if st, ok := s.quantEventStatus[resp.EventSeq]; ok {
+				if d, ok := st.Deliveries[resp.GUID]; ok {
+					d.Acknowledged = true
+					d.Handled = resp.Handled
+					st.refreshFinished()
+				}
+			}
+
+			if q, ok := s.quantEventQuorums[resp.EventSeq]; ok {
+				q.onResp(resp.GUID, resp.Handled)
+			}
 			s.muSendingQuantEvent.Unlock()
+			s.checkQuantEventQuorums()
 		} else {
 			logger.LogImportant(logPrefix, "unmarshal error: %s", string(data))
 		}
@@ -244,52 +390,142 @@ func (s *Service) update() {
 
 			s.muStratergys.Lock()
 			keys := make([]string, 0, len(s.stratergys))
-			for k := range s.stratergys {
-				keys = append(keys, k)
+			for k, stg := range s.stratergys {
+				if time.Since(stg.aliveTime).Seconds() > 10 {
+					// 10秒不活动的策略就清除
+					keys = append(keys, k)
+				}
+			}
+
+			for guid, t := range s.rejectedGuids {
+				if time.Since(t).Seconds() > 10 {
+					delete(s.rejectedGuids, guid)
+				}
 			}
 			s.muStratergys.Unlock()
 
 			for _, guid := range keys {
-				if time.Since(s.stratergys[guid].aliveTime).Seconds() > 10 {
-					// 10秒不活动的策略就清除
-					s.stratergyOffline(guid)
-				}
+				s.stratergyOffline(guid)
 			}
 		}()
 
+		// 检查需要确认的事件是否已经完成
+		s.checkQuantEventQuorums()
+
 		// 清除已经完毕的QuantEventSender
 		func() {
 			defer util.DefaultRecover()
 
 			s.muSendingQuantEvent.Lock()
-			for i, qes := range s.sendingQuantEvent {
-				if qes.finished {
-					util.SliceRemoveAt(s.sendingQuantEvent, i)
+			defer s.muSendingQuantEvent.Unlock()
+			sending := make([]*quantEvent2Stratergy, 0, len(s.sendingQuantEvent))
+			for _, qes := range s.sendingQuantEvent {
+				if qes.finished.Load() {
+					// 重发结束仍未确认，记为过期或超时
+					if st, ok := s.quantEventStatus[qes.seq]; ok {
+						if d, ok := st.Deliveries[qes.guid]; ok && !d.Acknowledged {
+							if qes.expired.Load() {
+								d.Expired = true
+								logger.LogImportant(logPrefix, "quant-event(seq=%d) expired before stratergy %s responsed", qes.seq, qes.guid)
+							} else {
+								d.TimedOut = true
+							}
+							st.refreshFinished()
+						}
+					}
+				} else {
+					sending = append(sending, qes)
+				}
+			}
+			s.sendingQuantEvent = sending
+
+			// 投递状态保留一段时间，供查询
+			for seq, st := range s.quantEventStatus {
+				if time.Since(st.CreateTime) > quantEventStatusKeepDuration {
+					delete(s.quantEventStatus, seq)
+				}
+			}
+
+			// 防抖记录只需要保留到窗口结束，这里统一按状态保留时长清理
+			for k, rec := range s.quantEventDebounceRecords {
+				if time.Since(rec.time) > quantEventStatusKeepDuration {
+					delete(s.quantEventDebounceRecords, k)
 				}
 			}
-			defer s.muSendingQuantEvent.Unlock()
 		}()
 	}
 }
 
+// 新策略上线，返回给策略的ping结果、登记的策略名，以及需要发送的报警。调用者需持有muStratergys
+func (s *Service) stratergyOnline(req PingReq, addr *net.UDPAddr) (rst, name, alertMsg string) {
+	stg := new(Stratergy)
+	stg.addr = addr
+	stg.guid = req.GUID
+	stg.name = req.Name
+	stg.class = req.Class
+	stg.aliveTime = time.Now()
+	stg.events = req.Events
+
+	// 重名检测：同名但guid不同
+	if exist := s.findStratergyByName(req.Name); exist != nil {
+		switch s.nameConflictPolicy {
+		case NameConflict_Reject:
+			if _, ok := s.rejectedGuids[req.GUID]; !ok {
+				alertMsg = fmt.Sprintf("策略重名[%s]，已拒绝新策略上线\n已在线guid:%s\n新策略guid:%s", req.Name, exist.guid, req.GUID)
+			}
+			s.rejectedGuids[req.GUID] = time.Now()
+			return PingResult_NameConflict, "", alertMsg
+		case NameConflict_Suffix:
+			for i := 2; s.findStratergyByName(stg.name) != nil; i++ {
+				stg.name = fmt.Sprintf("%s#%d", req.Name, i)
+			}
+			alertMsg = fmt.Sprintf("策略重名[%s]，新策略已改名为[%s]\n已在线guid:%s\n新策略guid:%s", req.Name, stg.name, exist.guid, req.GUID)
+		default:
+			alertMsg = fmt.Sprintf("策略重名[%s]\n已在线guid:%s\n新策略guid:%s", req.Name, exist.guid, req.GUID)
+		}
+	}
+
+	// 创建新的策略镜像
+	delete(s.rejectedGuids, req.GUID)
+	s.stratergys[stg.guid] = stg
+	s.stratergyList = append(s.stratergyList, stg)
+	logger.LogInfo(logPrefix, "stratergy [%s](%s) is online", stg.name, stg.guid)
+	return PingResult_OK, stg.name, alertMsg
+}
+
+// 按名称查找在线策略。调用者需持有muStratergys
+func (s *Service) findStratergyByName(name string) *Stratergy {
+	for _, stg := range s.stratergyList {
+		if stg.name == name {
+			return stg
+		}
+	}
+	return nil
+}
+
+// 发送报警给管理员
+func (s *Service) alert(msg string) {
+	logger.LogImportant(logPrefix, msg)
+	if s.ding != nil {
+		s.ding.SendTextByMob(msg, s.dingAdminMob)
+	}
+}
+
 func (s *Service) stratergyOffline(guid string) {
 	s.muStratergys.Lock()
 	defer s.muStratergys.Unlock()
 
-	name := s.stratergys[guid].name
-	logger.LogInfo(logPrefix, "stratergy [%s] is offline", name)
-
-	for i, v := range s.stratergyGuids {
-		if v == guid {
-			s.stratergyGuids = util.SliceRemoveAt(s.stratergyGuids, i)
-			logger.LogInfo(logPrefix, "stratergy [%s] is removed from guid list", guid)
-		}
+	stg, ok := s.stratergys[guid]
+	if !ok {
+		return
 	}
 
-	for i, v := range s.stratergyNames {
-		if v == name {
-			s.stratergyNames = util.SliceRemoveAt(s.stratergyNames, i)
-			logger.LogInfo(logPrefix, "stratergy [%s] is removed from name list", name)
+	logger.LogInfo(logPrefix, "stratergy [%s](%s) is offline", stg.name, guid)
+
+	for i, v := range s.stratergyList {
+		if v.guid == guid {
+			s.stratergyList = util.SliceRemoveAt(s.stratergyList, i)
+			break
 		}
 	}
 
@@ -313,14 +549,15 @@ func (s *Service) onCommand(cmdLine string, onResp func(string, bool)) {
 		sb.WriteString("3. conn n\nconnect to stratergy by index\n")
 		sb.WriteString("4. disc n\ndisconnect from current stratergy\n")
 		sb.WriteString("5. qevent ename k1 v1 k2 v2...\ncreate a quant-event manually\n")
+		sb.WriteString("6. qtypes\nlist declared quant-event types\n")
 		onResp(sb.String(), true)
 	case "ls": // list stratergy
 		sb := strings.Builder{}
-		sb.WriteString(fmt.Sprintf("alive stratergys count: %d\n", len(s.stratergyNames)))
 
 		s.muStratergys.Lock()
-		for i, v := range s.stratergyNames {
-			sb.WriteString(fmt.Sprintf("%d. %s\n", i, v))
+		sb.WriteString(fmt.Sprintf("alive stratergys count: %d\n", len(s.stratergyList)))
+		for i, v := range s.stratergyList {
+			sb.WriteString(fmt.Sprintf("%d. %s (%s)\n", i, v.name, v.guid))
 		}
 		s.muStratergys.Unlock()
 
@@ -342,8 +579,8 @@ func (s *Service) onCommand(cmdLine string, onResp func(string, bool)) {
 				s.muStratergys.Lock()
 				defer s.muStratergys.Unlock()
 				if index, ok := util.String2Int(splited[1]); ok {
-					if index >= 0 && index < len(s.stratergyGuids) {
-						s.connectedStratergy = s.stratergys[s.stratergyGuids[index]]
+					if index >= 0 && index < len(s.stratergyList) {
+						s.connectedStratergy = s.stratergyList[index]
 						onResp(fmt.Sprintf("stratergy [%s] connected", s.connectedStratergy.name), true)
 					} else {
 						onResp("index out of range", true)
@@ -369,9 +606,34 @@ func (s *Service) onCommand(cmdLine string, onResp func(string, bool)) {
 			return
 		}
 
-		sended := s.SendQuantEventRaw(splited[1:])
 		ename := splited[1]
-		onResp(fmt.Sprintf("send event(%s) to %d stratergys", ename, sended), true)
+		if sended, err := s.SendQuantEventRaw(splited[1:]); err == nil {
+			onResp(fmt.Sprintf("send event(%s) to %d stratergys", ename, sended), true)
+		} else {
+			onResp(fmt.Sprintf("send event(%s) failed: %s", ename, err.Error()), true)
+		}
+	case "qtypes":
+		// 列出已声明的量化事件类型，以及处理它们的策略
+		types := s.QuantEventTypes()
+		sb := strings.Builder{}
+		sb.WriteString(fmt.Sprintf("declared quant-event types: %d\n", len(types)))
+
+		s.muStratergys.Lock()
+		for _, t := range types {
+			sb.WriteString(t.string())
+			handlers := make([]string, 0)
+			for _, stg := range s.stratergyList {
+				if len(stg.events) > 0 && stg.handlesEvent(t.Name) {
+					handlers = append(handlers, stg.name)
+				}
+			}
+			if len(handlers) > 0 {
+				sb.WriteString(fmt.Sprintf("  handled by: %s\n", strings.Join(handlers, ",")))
+			}
+		}
+		s.muStratergys.Unlock()
+
+		onResp(sb.String(), true)
 	default:
 		onResp("unknown command", false)
 	}
@@ -0,0 +1,151 @@
+/*
+ * @Author: aztec
+ * @Date: 2023-09-26 15:20:44
+ * @Description: Server-Sent Events支持。其他service创建SSEHub并发布事件，
+ * 在自己注册的http路径回调中用ServeSSE把事件推给客户端
+ *
+ * Copyright (c) 2023 by aztec, All Rights Reserved.
+ */
+package web
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sseKeepAliveInterval = time.Second * 15
+
+// 一个SSE事件
+type SSEEvent struct {
+	Id      string      // 客户端断线重连时会通过Last-Event-ID头带回
+	Event   string      // 事件名，为空时客户端按message处理
+	Data    string      // 事件内容
+	Payload interface{} // 原始对象，不发送给客户端，供订阅过滤使用
+}
+
+func (e *SSEEvent) writeTo(w io.Writer) {
+	sb := strings.Builder{}
+	if len(e.Id) > 0 {
+		sb.WriteString(fmt.Sprintf("id: %s\n", e.Id))
+	}
+	if len(e.Event) > 0 {
+		sb.WriteString(fmt.Sprintf("event: %s\n", e.Event))
+	}
+	for _, line := range strings.Split(e.Data, "\n") {
+		sb.WriteString(fmt.Sprintf("data: %s\n", line))
+	}
+	sb.WriteString("\n")
+	io.WriteString(w, sb.String())
+}
+
+// 一个订阅者
+type SSESubscriber struct {
+	C      chan SSEEvent // 订阅者跟不上发布速度时会被关闭，客户端需要重连并补发
+	filter func(SSEEvent) bool
+}
+
+// 事件分发中心
+type SSEHub struct {
+	subs map[*SSESubscriber]bool
+	mu   sync.Mutex
+}
+
+func NewSSEHub() *SSEHub {
+	h := new(SSEHub)
+	h.subs = make(map[*SSESubscriber]bool)
+	return h
+}
+
+// 订阅。filter为nil表示接收所有事件
+func (h *SSEHub) Subscribe(bufSize int, filter func(SSEEvent) bool) *SSESubscriber {
+	sub := new(SSESubscriber)
+	sub.C = make(chan SSEEvent, bufSize)
+	sub.filter = filter
+	h.mu.Lock()
+	h.subs[sub] = true
+	h.mu.Unlock()
+	return sub
+}
+
+func (h *SSEHub) Unsubscribe(sub *SSESubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[sub]; ok {
+		delete(h.subs, sub)
+		close(sub.C)
+	}
+}
+
+// 发布一个事件，不会阻塞。缓冲区已满的订阅者会被断开
+func (h *SSEHub) Publish(evt SSEEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs {
+		if sub.filter != nil && !sub.filter(evt) {
+			continue
+		}
+
+		select {
+		case sub.C <- evt:
+		default:
+			delete(h.subs, sub)
+			close(sub.C)
+		}
+	}
+}
+
+// 当前订阅者数量
+func (h *SSEHub) Count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+// 把事件推送给http客户端，直到客户端断开或者订阅被关闭
+// backlog先于实时事件发送；skip非空时，实时事件中skip返回true的不发送（用于去掉与backlog重复的部分）
+func ServeSSE(w http.ResponseWriter, r *http.Request, hub *SSEHub, sub *SSESubscriber, backlog []SSEEvent, skip func(SSEEvent) bool) {
+	defer hub.Unsubscribe(sub)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	for _, evt := range backlog {
+		evt.writeTo(w)
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(sseKeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case evt, ok := <-sub.C:
+			if !ok {
+				return
+			}
+
+			if skip != nil && skip(evt) {
+				continue
+			}
+
+			evt.writeTo(w)
+			flusher.Flush()
+		case <-ticker.C:
+			io.WriteString(w, ": keep-alive\n\n")
+			flusher.Flush()
+		}
+	}
+}